@@ -81,6 +81,19 @@ class PostContainer {
         this.Dir = "";
         this.HasThumbnail = false;
         this.Thumbnail = "";
+        this.ThumbnailDerived = false;
+        this.ThumbnailWidth = 0;
+        this.ThumbnailHeight = 0;
+        this.ThumbnailCard = "";
+        this.ThumbnailCardWidth = 0;
+        this.ThumbnailCardHeight = 0;
+        this.ThumbnailRetina = "";
+        this.ThumbnailRetinaWidth = 0;
+        this.ThumbnailRetinaHeight = 0;
+        this.ThumbnailPlaceholder = "";
+        this.ThumbnailDominantColor = "";
+        this.ThumbnailAspectRatio = 0;
+        this.ShareImage = "";
     }
 }
 class Post {
@@ -93,6 +106,19 @@ class Post {
         this.dir = "";
         this.hasThumbnail = false;
         this.thumbnail = "";
+        this.thumbnailDerived = false;
+        this.thumbnailWidth = 0;
+        this.thumbnailHeight = 0;
+        this.thumbnailCard = "";
+        this.thumbnailCardWidth = 0;
+        this.thumbnailCardHeight = 0;
+        this.thumbnailRetina = "";
+        this.thumbnailRetinaWidth = 0;
+        this.thumbnailRetinaHeight = 0;
+        this.thumbnailPlaceholder = "";
+        this.thumbnailDominantColor = "";
+        this.thumbnailAspectRatio = 0;
+        this.shareImage = "";
     }
     setFromPostJsonOrThrow(json) {
         const expect = (value, type, must) => {
@@ -117,6 +143,19 @@ class Post {
         this.dir = expect(json.Dir, 'string', true);
         this.hasThumbnail = expect(json.HasThumbnail, 'boolean', false);
         this.thumbnail = expect(json.Thumbnail, 'string', false);
+        this.thumbnailDerived = expect(json.ThumbnailDerived, 'boolean', false);
+        this.thumbnailWidth = expect(json.ThumbnailWidth, 'number', false);
+        this.thumbnailHeight = expect(json.ThumbnailHeight, 'number', false);
+        this.thumbnailCard = expect(json.ThumbnailCard, 'string', false);
+        this.thumbnailCardWidth = expect(json.ThumbnailCardWidth, 'number', false);
+        this.thumbnailCardHeight = expect(json.ThumbnailCardHeight, 'number', false);
+        this.thumbnailRetina = expect(json.ThumbnailRetina, 'string', false);
+        this.thumbnailRetinaWidth = expect(json.ThumbnailRetinaWidth, 'number', false);
+        this.thumbnailRetinaHeight = expect(json.ThumbnailRetinaHeight, 'number', false);
+        this.thumbnailPlaceholder = expect(json.ThumbnailPlaceholder, 'string', false);
+        this.thumbnailDominantColor = expect(json.ThumbnailDominantColor, 'string', false);
+        this.thumbnailAspectRatio = expect(json.ThumbnailAspectRatio, 'number', false);
+        this.shareImage = expect(json.ShareImage, 'string', false);
     }
     toPostContainer() {
         const container = new PostContainer();
@@ -128,6 +167,19 @@ class Post {
         container.Dir = this.dir;
         container.HasThumbnail = this.hasThumbnail;
         container.Thumbnail = this.thumbnail;
+        container.ThumbnailDerived = this.thumbnailDerived;
+        container.ThumbnailWidth = this.thumbnailWidth;
+        container.ThumbnailHeight = this.thumbnailHeight;
+        container.ThumbnailCard = this.thumbnailCard;
+        container.ThumbnailCardWidth = this.thumbnailCardWidth;
+        container.ThumbnailCardHeight = this.thumbnailCardHeight;
+        container.ThumbnailRetina = this.thumbnailRetina;
+        container.ThumbnailRetinaWidth = this.thumbnailRetinaWidth;
+        container.ThumbnailRetinaHeight = this.thumbnailRetinaHeight;
+        container.ThumbnailPlaceholder = this.thumbnailPlaceholder;
+        container.ThumbnailDominantColor = this.thumbnailDominantColor;
+        container.ThumbnailAspectRatio = this.thumbnailAspectRatio;
+        container.ShareImage = this.shareImage;
         return container;
     }
     clone() {
@@ -390,6 +442,184 @@ function report(text, color) {
         reportText.style.color = color;
     }
 }
+// diagnostic from server as 'dir/file:line: severity: message'
+function describeDiagnostic(d) {
+    let where = d.Dir || '';
+    if (d.File) {
+        where = where ? `${where}/${d.File}` : d.File;
+    }
+    if (d.Line > 0) {
+        where = `${where}:${d.Line}`;
+    }
+    return where ? `${where}: ${d.Severity}: ${d.Message}` : `${d.Severity}: ${d.Message}`;
+}
+function logDiagnostics(diagnostics) {
+    if (!Array.isArray(diagnostics)) {
+        return;
+    }
+    for (const d of diagnostics) {
+        if (d.Severity === 'warning') {
+            console.warn(describeDiagnostic(d));
+        }
+        else {
+            console.error(describeDiagnostic(d));
+        }
+    }
+}
+// make a readable message out of failed api response
+function getFailedResponseMessage(json) {
+    const message = `request failed: ${json.Error}`;
+    logDiagnostics(json.Diagnostics);
+    return message;
+}
+function getErrorMessage(err) {
+    if (err instanceof Error) {
+        return err.message;
+    }
+    return `${err}`;
+}
+function describeThumbnail(post) {
+    if (!post.hasThumbnail) {
+        return 'thumbnail: none';
+    }
+    if (post.thumbnailDerived) {
+        return `thumbnail: ${post.thumbnail} (derived)`;
+    }
+    return `thumbnail: ${post.thumbnail}`;
+}
+// changes server found between saved and scanned post list,
+// see PostListDiff in postlist/diff.go
+class PostChanges {
+    constructor() {
+        this.added = new Set();
+        this.removed = new Set();
+        // uuid to changed files, null if server doesn't know which files
+        this.modified = new Map();
+        // uuid to dir post used to be in
+        this.renamed = new Map();
+    }
+}
+function parsePostChangesJson(json) {
+    const changes = new PostChanges();
+    for (const p of json.Added || []) {
+        changes.added.add(p.UUID);
+    }
+    for (const p of json.Removed || []) {
+        changes.removed.add(p.UUID);
+    }
+    for (const m of json.Modified || []) {
+        changes.modified.set(m.Post.UUID, m.FilesKnown ? (m.ChangedFiles || []) : null);
+    }
+    for (const r of json.Renamed || []) {
+        changes.renamed.set(r.Post.UUID, r.OldDir);
+    }
+    return changes;
+}
+function describePostChanges(changes, uuid) {
+    const parts = [];
+    const oldDir = changes.renamed.get(uuid);
+    if (oldDir !== undefined) {
+        parts.push(`moved from ${oldDir}`);
+    }
+    const files = changes.modified.get(uuid);
+    if (files === null) {
+        parts.push('files changed');
+    }
+    else if (files !== undefined) {
+        parts.push(`changed: ${files.join(', ')}`);
+    }
+    return parts.join(', ');
+}
+// posts dirs to api that works on post directories
+function postDirs(api, dirs) {
+    return __awaiter(this, void 0, void 0, function* () {
+        const res = yield fetch(api, {
+            method: 'POST',
+            headers: {
+                'Content-type': 'application/json'
+            },
+            body: JSON.stringify({ Dirs: dirs })
+        });
+        if (res.status !== 200) {
+            if (res.headers.get('Content-Type') === 'application/json') {
+                const json = yield res.json();
+                throw new Error(getFailedResponseMessage(json));
+            }
+        }
+        const json = yield res.json();
+        if (json.Result !== 'success') {
+            throw new Error(getFailedResponseMessage(json));
+        }
+    });
+}
+// post directories without post-uuid.txt,
+// they don't show up in post list until they get adopted
+function showUnadoptedPosts(unadopted) {
+    const unadoptedDiv = mustGetElementById('unadopted-posts');
+    unadoptedDiv.innerHTML = '';
+    if (!Array.isArray(unadopted) || unadopted.length === 0) {
+        unadoptedDiv.style.display = 'none';
+        return;
+    }
+    unadoptedDiv.style.display = '';
+    const dirs = unadopted.map((u) => u.Dir);
+    const text = document.createElement('p');
+    text.style.display = 'inline';
+    text.innerText = `not adopted: ${dirs.join(', ')} `;
+    const adoptButton = document.createElement('button');
+    adoptButton.innerText = 'adopt';
+    adoptButton.onclick = () => __awaiter(this, void 0, void 0, function* () {
+        try {
+            yield postDirs('/api/adopt-posts', dirs);
+        }
+        catch (err) {
+            console.error(err);
+            report(`adopt failed, ${getErrorMessage(err)}`, ColorError);
+            return;
+        }
+        // adopted posts show up as new posts
+        window.location.reload();
+    });
+    unadoptedDiv.appendChild(text);
+    unadoptedDiv.appendChild(adoptButton);
+}
+// copied post directories, they don't show up in post list
+// and nothing compiles until they get their own uuid
+function showDuplicatePosts(duplicates) {
+    const duplicatesDiv = mustGetElementById('duplicate-posts');
+    duplicatesDiv.innerHTML = '';
+    if (!Array.isArray(duplicates) || duplicates.length === 0) {
+        duplicatesDiv.style.display = 'none';
+        return;
+    }
+    duplicatesDiv.style.display = '';
+    const descriptions = [];
+    const copies = [];
+    for (const d of duplicates) {
+        descriptions.push(`${d.Copies.join(', ')} (copy of ${d.Original})`);
+        copies.push(...d.Copies);
+    }
+    const text = document.createElement('p');
+    text.style.display = 'inline';
+    text.style.color = ColorError;
+    text.innerText = `same uuid as another post: ${descriptions.join(', ')} `;
+    const rekeyButton = document.createElement('button');
+    rekeyButton.innerText = 're-key copies';
+    rekeyButton.onclick = () => __awaiter(this, void 0, void 0, function* () {
+        try {
+            yield postDirs('/api/rekey-duplicates', copies);
+        }
+        catch (err) {
+            console.error(err);
+            report(`re-key failed, ${getErrorMessage(err)}`, ColorError);
+            return;
+        }
+        // re-keyed copies show up as new posts
+        window.location.reload();
+    });
+    duplicatesDiv.appendChild(text);
+    duplicatesDiv.appendChild(rekeyButton);
+}
 let PostListEntryIdMax = -1;
 function getNewPostListEntryId() {
     PostListEntryIdMax += 1;
@@ -409,53 +639,43 @@ class PostList {
             yield this.submit();
         });
     }
-    setPostList(oldPosts, newPosts) {
+    setPostList(oldPosts, newPosts, changes) {
         while (this.listDiv.children.length > 0) {
             this.listDiv.children[0].remove();
         }
         this.savedAllPosts.clear();
         this.savedOldPosts = oldPosts;
         this.savedNewPosts = newPosts;
-        const addedPosts = new Map();
         for (const p of newPosts.values()) {
-            if (!this.savedOldPosts.has(p.uuid)) {
-                addedPosts.set(p.uuid, p);
+            if (changes.added.has(p.uuid)) {
+                this.savedAllPosts.set(p.uuid, p);
             }
         }
-        const deletedPosts = new Map();
-        for (const p of oldPosts.values()) {
-            if (!newPosts.has(p.uuid)) {
-                deletedPosts.set(p.uuid, p);
-            }
-        }
-        for (const p of addedPosts.values()) {
-            this.savedAllPosts.set(p.uuid, p);
-        }
         for (const p of this.savedOldPosts.values()) {
             this.savedAllPosts.set(p.uuid, p);
         }
         for (let post of this.savedAllPosts.values()) {
             let postStatus = PostStatus.Normal;
-            if (this.savedOldPosts.has(post.uuid) &&
-                this.savedNewPosts.has(post.uuid) &&
-                this.savedOldPosts.get(post.uuid).hasChanged(this.savedNewPosts.get(post.uuid))) {
+            if (changes.modified.has(post.uuid) || changes.renamed.has(post.uuid)) {
                 postStatus = PostStatus.Changed;
             }
-            if (addedPosts.has(post.uuid)) {
+            if (changes.added.has(post.uuid)) {
                 postStatus = PostStatus.Added;
             }
-            if (deletedPosts.has(post.uuid)) {
+            // removed posts stay in the list until submit drops them
+            if (changes.removed.has(post.uuid)) {
                 postStatus = PostStatus.Deleted;
             }
+            const changeText = describePostChanges(changes, post.uuid);
             if (this.savedNewPosts.has(post.uuid)) {
-                this.addEntry(this.savedNewPosts.get(post.uuid).clone(), postStatus);
+                this.addEntry(this.savedNewPosts.get(post.uuid).clone(), postStatus, changeText);
             }
             else {
-                this.addEntry(this.savedOldPosts.get(post.uuid).clone(), postStatus);
+                this.addEntry(this.savedOldPosts.get(post.uuid).clone(), postStatus, changeText);
             }
         }
     }
-    addEntry(post, postStatus) {
+    addEntry(post, postStatus, changeText) {
         const f = new BomFactory();
         let containerDiv;
         let nameInput;
@@ -464,7 +684,7 @@ class PostList {
         let postStatusDisplay;
         let handle;
         let listOverlay;
-        containerDiv = f.create('div').classes('list-container-div').add((f.create('div').classes('list-content-div').add(f.create('label').text('name'), (nameInput = f.create('div').classes('list-name-input').set('contenteditable', 'plaintext-only').html), f.create('label').text('YYYY/MM/DD ').add((dateInput = f.create('input').classes('date-input').set('type', 'text').set('size', '15').html), (dateStatus = f.create('span').text('\u2705').html)), f.create('p').text(`dir: ${post.dir}`), (postStatusDisplay = f.create('p').classes('post-status-display').text('DELETED').html)).html), (handle = f.create('div').set('tabindex', '0').classes('list-handle', 'noselect').text(':::::').html), (listOverlay = f.create('div').classes('list-overlay').html)).set('post-uuid', post.uuid).html;
+        containerDiv = f.create('div').classes('list-container-div').add((f.create('div').classes('list-content-div').add(f.create('label').text('name'), (nameInput = f.create('div').classes('list-name-input').set('contenteditable', 'plaintext-only').html), f.create('label').text('YYYY/MM/DD ').add((dateInput = f.create('input').classes('date-input').set('type', 'text').set('size', '15').html), (dateStatus = f.create('span').text('\u2705').html)), f.create('p').text(`dir: ${post.dir}`), f.create('p').text(describeThumbnail(post)), (postStatusDisplay = f.create('p').classes('post-status-display').text('DELETED').html), f.create('p').text(changeText)).html), (handle = f.create('div').set('tabindex', '0').classes('list-handle', 'noselect').text(':::::').html), (listOverlay = f.create('div').classes('list-overlay').html)).set('post-uuid', post.uuid).html;
         this.listDiv.appendChild(containerDiv);
         (listOverlay);
         const entry = {
@@ -737,12 +957,13 @@ class PostList {
                 if (res.status !== 200) {
                     if (res.headers.get('Content-Type') === 'application/json') {
                         const json = yield res.json();
-                        throw new Error(`request failed ${json}`);
+                        throw new Error(getFailedResponseMessage(json));
                     }
                 }
                 const json = yield res.json();
-                if (json.Result !== 'success') {
-                    throw new Error(`request failed ${json}`);
+                // partial means some posts failed but the rest got published
+                if (json.Result !== 'success' && json.Result !== 'partial') {
+                    throw new Error(getFailedResponseMessage(json));
                 }
                 return json;
             });
@@ -751,13 +972,24 @@ class PostList {
             try {
                 json = yield makeRequest();
                 posts = parsePostListJsonOrThrow(json.PostList);
+                console.log('build report', json.Report);
+                logDiagnostics(json.Report.Diagnostics);
             }
             catch (err) {
                 console.error(err);
-                report('submit failed, check console for details', ColorError);
+                report(`submit failed, ${getErrorMessage(err)}`, ColorError);
+                return;
+            }
+            // what we just compiled is what's saved now
+            this.setPostList(posts, posts, new PostChanges());
+            if (json.Result === 'partial') {
+                const failed = [];
+                for (const f of json.Report.Failed) {
+                    failed.push(f.KeptPrevious ? `${f.Dir} (kept previous)` : `${f.Dir} (left out)`);
+                }
+                report(`PARTIAL, failed to compile: ${failed.join(', ')}`, ColorError);
                 return;
             }
-            this.setPostList(posts, posts);
             report('SUCCESS', ColorSuccess);
         });
     }
@@ -780,27 +1012,31 @@ class PostList {
         if (res.status !== 200) {
             if (res.headers.get('Content-Type') === 'application/json') {
                 const json = yield res.json();
-                throw new Error(`request failed ${json}`);
+                throw new Error(getFailedResponseMessage(json));
             }
         }
         const json = yield res.json();
         if (json.Result !== 'success') {
-            throw new Error(`request failed ${json}`);
+            throw new Error(getFailedResponseMessage(json));
         }
         return json;
     });
     let json;
     let oldPosts;
     let newPosts;
+    let changes;
     try {
         json = yield makeRequest();
         oldPosts = parsePostListJsonOrThrow(json.Old);
         newPosts = parsePostListJsonOrThrow(json.New);
+        changes = parsePostChangesJson(json.Diff);
     }
     catch (err) {
         console.error(err);
-        report('GET request failed, check console for details', ColorError);
+        report(`GET request failed, ${getErrorMessage(err)}`, ColorError);
         return;
     }
-    postList.setPostList(oldPosts, newPosts);
+    postList.setPostList(oldPosts, newPosts, changes);
+    showUnadoptedPosts(json.Scan.Unadopted);
+    showDuplicatePosts(json.Scan.Duplicates);
 }))();
@@ -16,6 +16,209 @@ function report(text: string, color: string) {
     }
 }
 
+// diagnostic from server as 'dir/file:line: severity: message'
+function describeDiagnostic(d: any): string {
+    let where = d.Dir || ''
+    if (d.File) {
+        where = where ? `${where}/${d.File}` : d.File
+    }
+    if (d.Line > 0) {
+        where = `${where}:${d.Line}`
+    }
+
+    return where ? `${where}: ${d.Severity}: ${d.Message}` : `${d.Severity}: ${d.Message}`
+}
+
+function logDiagnostics(diagnostics: any) {
+    if (!Array.isArray(diagnostics)) {
+        return
+    }
+    for (const d of diagnostics) {
+        if (d.Severity === 'warning') {
+            console.warn(describeDiagnostic(d))
+        } else {
+            console.error(describeDiagnostic(d))
+        }
+    }
+}
+
+// make a readable message out of failed api response
+function getFailedResponseMessage(json: any): string {
+    const message = `request failed: ${json.Error}`
+
+    logDiagnostics(json.Diagnostics)
+
+    return message
+}
+
+function getErrorMessage(err: unknown): string {
+    if (err instanceof Error) {
+        return err.message
+    }
+    return `${err}`
+}
+
+function describeThumbnail(post: Post): string {
+    if (!post.hasThumbnail) {
+        return 'thumbnail: none'
+    }
+    if (post.thumbnailDerived) {
+        return `thumbnail: ${post.thumbnail} (derived)`
+    }
+    return `thumbnail: ${post.thumbnail}`
+}
+
+// changes server found between saved and scanned post list,
+// see PostListDiff in postlist/diff.go
+class PostChanges {
+    added: Set<string> = new Set()
+    removed: Set<string> = new Set()
+    // uuid to changed files, null if server doesn't know which files
+    modified: Map<string, string[] | null> = new Map()
+    // uuid to dir post used to be in
+    renamed: Map<string, string> = new Map()
+}
+
+function parsePostChangesJson(json: any): PostChanges {
+    const changes = new PostChanges()
+
+    for (const p of json.Added || []) {
+        changes.added.add(p.UUID)
+    }
+    for (const p of json.Removed || []) {
+        changes.removed.add(p.UUID)
+    }
+    for (const m of json.Modified || []) {
+        changes.modified.set(m.Post.UUID, m.FilesKnown ? (m.ChangedFiles || []) : null)
+    }
+    for (const r of json.Renamed || []) {
+        changes.renamed.set(r.Post.UUID, r.OldDir)
+    }
+
+    return changes
+}
+
+function describePostChanges(changes: PostChanges, uuid: string): string {
+    const parts: string[] = []
+
+    const oldDir = changes.renamed.get(uuid)
+    if (oldDir !== undefined) {
+        parts.push(`moved from ${oldDir}`)
+    }
+
+    const files = changes.modified.get(uuid)
+    if (files === null) {
+        parts.push('files changed')
+    } else if (files !== undefined) {
+        parts.push(`changed: ${files.join(', ')}`)
+    }
+
+    return parts.join(', ')
+}
+
+// posts dirs to api that works on post directories
+async function postDirs(api: string, dirs: string[]) {
+    const res = await fetch(api, {
+        method: 'POST',
+        headers: {
+            'Content-type': 'application/json'
+        },
+        body: JSON.stringify({ Dirs: dirs })
+    });
+
+    if (res.status !== 200) {
+        if (res.headers.get('Content-Type') === 'application/json') {
+            const json = await res.json()
+            throw new Error(getFailedResponseMessage(json))
+        }
+    }
+
+    const json = await res.json()
+    if (json.Result !== 'success') {
+        throw new Error(getFailedResponseMessage(json))
+    }
+}
+
+// post directories without post-uuid.txt,
+// they don't show up in post list until they get adopted
+function showUnadoptedPosts(unadopted: any) {
+    const unadoptedDiv = mustGetElementById('unadopted-posts')
+    unadoptedDiv.innerHTML = ''
+
+    if (!Array.isArray(unadopted) || unadopted.length === 0) {
+        unadoptedDiv.style.display = 'none'
+        return
+    }
+    unadoptedDiv.style.display = ''
+
+    const dirs: string[] = unadopted.map((u: any) => u.Dir)
+
+    const text = document.createElement('p')
+    text.style.display = 'inline'
+    text.innerText = `not adopted: ${dirs.join(', ')} `
+
+    const adoptButton = document.createElement('button')
+    adoptButton.innerText = 'adopt'
+    adoptButton.onclick = async () => {
+        try {
+            await postDirs('/api/adopt-posts', dirs)
+        } catch (err) {
+            console.error(err)
+            report(`adopt failed, ${getErrorMessage(err)}`, ColorError)
+            return
+        }
+
+        // adopted posts show up as new posts
+        window.location.reload()
+    }
+
+    unadoptedDiv.appendChild(text)
+    unadoptedDiv.appendChild(adoptButton)
+}
+
+// copied post directories, they don't show up in post list
+// and nothing compiles until they get their own uuid
+function showDuplicatePosts(duplicates: any) {
+    const duplicatesDiv = mustGetElementById('duplicate-posts')
+    duplicatesDiv.innerHTML = ''
+
+    if (!Array.isArray(duplicates) || duplicates.length === 0) {
+        duplicatesDiv.style.display = 'none'
+        return
+    }
+    duplicatesDiv.style.display = ''
+
+    const descriptions: string[] = []
+    const copies: string[] = []
+    for (const d of duplicates) {
+        descriptions.push(`${d.Copies.join(', ')} (copy of ${d.Original})`)
+        copies.push(...d.Copies)
+    }
+
+    const text = document.createElement('p')
+    text.style.display = 'inline'
+    text.style.color = ColorError
+    text.innerText = `same uuid as another post: ${descriptions.join(', ')} `
+
+    const rekeyButton = document.createElement('button')
+    rekeyButton.innerText = 're-key copies'
+    rekeyButton.onclick = async () => {
+        try {
+            await postDirs('/api/rekey-duplicates', copies)
+        } catch (err) {
+            console.error(err)
+            report(`re-key failed, ${getErrorMessage(err)}`, ColorError)
+            return
+        }
+
+        // re-keyed copies show up as new posts
+        window.location.reload()
+    }
+
+    duplicatesDiv.appendChild(text)
+    duplicatesDiv.appendChild(rekeyButton)
+}
+
 interface PostListEntry {
     id: number
 
@@ -58,7 +261,7 @@ class PostList {
         }
     }
 
-    setPostList(oldPosts: Map<string, Post>, newPosts: Map<string, Post>) {
+    setPostList(oldPosts: Map<string, Post>, newPosts: Map<string, Post>, changes: PostChanges) {
         while (this.listDiv.children.length > 0) {
             this.listDiv.children[0].remove()
         }
@@ -68,23 +271,11 @@ class PostList {
         this.savedOldPosts = oldPosts
         this.savedNewPosts = newPosts
 
-        const addedPosts: Map<string, Post> = new Map()
         for (const p of newPosts.values()) {
-            if (!this.savedOldPosts.has(p.uuid)) {
-                addedPosts.set(p.uuid, p)
+            if (changes.added.has(p.uuid)) {
+                this.savedAllPosts.set(p.uuid, p)
             }
         }
-
-        const deletedPosts: Map<string, Post> = new Map()
-        for (const p of oldPosts.values()) {
-            if (!newPosts.has(p.uuid)) {
-                deletedPosts.set(p.uuid, p)
-            }
-        }
-
-        for (const p of addedPosts.values()) {
-            this.savedAllPosts.set(p.uuid, p)
-        }
         for (const p of this.savedOldPosts.values()) {
             this.savedAllPosts.set(p.uuid, p)
         }
@@ -92,31 +283,30 @@ class PostList {
         for (let post of this.savedAllPosts.values()) {
             let postStatus = PostStatus.Normal
 
-            if (
-                this.savedOldPosts.has(post.uuid) &&
-                this.savedNewPosts.has(post.uuid) &&
-                this.savedOldPosts.get(post.uuid)!.hasChanged(this.savedNewPosts.get(post.uuid)!)
-            ) {
+            if (changes.modified.has(post.uuid) || changes.renamed.has(post.uuid)) {
                 postStatus = PostStatus.Changed
             }
 
-            if (addedPosts.has(post.uuid)) {
+            if (changes.added.has(post.uuid)) {
                 postStatus = PostStatus.Added
             }
 
-            if (deletedPosts.has(post.uuid)) {
+            // removed posts stay in the list until submit drops them
+            if (changes.removed.has(post.uuid)) {
                 postStatus = PostStatus.Deleted
             }
 
+            const changeText = describePostChanges(changes, post.uuid)
+
             if (this.savedNewPosts.has(post.uuid)) {
-                this.addEntry(this.savedNewPosts.get(post.uuid)!.clone(), postStatus)
+                this.addEntry(this.savedNewPosts.get(post.uuid)!.clone(), postStatus, changeText)
             } else {
-                this.addEntry(this.savedOldPosts.get(post.uuid)!.clone(), postStatus)
+                this.addEntry(this.savedOldPosts.get(post.uuid)!.clone(), postStatus, changeText)
             }
         }
     }
 
-    addEntry(post: Post, postStatus: PostStatus) {
+    addEntry(post: Post, postStatus: PostStatus, changeText: string) {
         const f = new BomFactory()
 
         let containerDiv: HTMLElement
@@ -136,7 +326,9 @@ class PostList {
                     (dateStatus = f.create('span').text('\u2705').html),
                 ),
                 f.create('p').text(`dir: ${post.dir}`),
-                (postStatusDisplay = f.create('p').classes('post-status-display').text('DELETED').html as HTMLParagraphElement)
+                f.create('p').text(describeThumbnail(post)),
+                (postStatusDisplay = f.create('p').classes('post-status-display').text('DELETED').html as HTMLParagraphElement),
+                f.create('p').text(changeText)
             ).html),
             (handle = f.create('div').set('tabindex', '0').classes('list-handle', 'noselect').text(':::::').html),
             (listOverlay = f.create('div').classes('list-overlay').html)
@@ -461,13 +653,14 @@ class PostList {
             if (res.status !== 200) {
                 if (res.headers.get('Content-Type') === 'application/json') {
                     const json = await res.json()
-                    throw new Error(`request failed ${json}`)
+                    throw new Error(getFailedResponseMessage(json))
                 }
             }
 
             const json = await res.json()
-            if (json.Result !== 'success') {
-                throw new Error(`request failed ${json}`)
+            // partial means some posts failed but the rest got published
+            if (json.Result !== 'success' && json.Result !== 'partial') {
+                throw new Error(getFailedResponseMessage(json))
             }
 
             return json
@@ -481,13 +674,26 @@ class PostList {
 
             posts = parsePostListJsonOrThrow(json.PostList)
 
+            console.log('build report', json.Report)
+            logDiagnostics(json.Report.Diagnostics)
+
         } catch (err) {
             console.error(err)
-            report('submit failed, check console for details', ColorError)
+            report(`submit failed, ${getErrorMessage(err)}`, ColorError)
             return
         }
 
-        this.setPostList(posts, posts)
+        // what we just compiled is what's saved now
+        this.setPostList(posts, posts, new PostChanges())
+
+        if (json.Result === 'partial') {
+            const failed: string[] = []
+            for (const f of json.Report.Failed) {
+                failed.push(f.KeptPrevious ? `${f.Dir} (kept previous)` : `${f.Dir} (left out)`)
+            }
+            report(`PARTIAL, failed to compile: ${failed.join(', ')}`, ColorError)
+            return
+        }
 
         report('SUCCESS', ColorSuccess)
     }
@@ -514,13 +720,13 @@ class PostList {
         if (res.status !== 200) {
             if (res.headers.get('Content-Type') === 'application/json') {
                 const json = await res.json()
-                throw new Error(`request failed ${json}`)
+                throw new Error(getFailedResponseMessage(json))
             }
         }
 
         const json = await res.json()
         if (json.Result !== 'success') {
-            throw new Error(`request failed ${json}`)
+            throw new Error(getFailedResponseMessage(json))
         }
 
         return json
@@ -530,17 +736,21 @@ class PostList {
 
     let oldPosts: Map<string, Post>
     let newPosts: Map<string, Post>
+    let changes: PostChanges
     try {
         json = await makeRequest()
 
         oldPosts = parsePostListJsonOrThrow(json.Old)
         newPosts = parsePostListJsonOrThrow(json.New)
+        changes = parsePostChangesJson(json.Diff)
     } catch (err) {
         console.error(err)
-        report('GET request failed, check console for details', ColorError)
+        report(`GET request failed, ${getErrorMessage(err)}`, ColorError)
         return
     }
 
-    postList.setPostList(oldPosts, newPosts)
+    postList.setPostList(oldPosts, newPosts, changes)
+    showUnadoptedPosts(json.Scan.Unadopted)
+    showDuplicatePosts(json.Scan.Duplicates)
 })()
 
@@ -0,0 +1,14 @@
+// files built into the binary that more than one package uses
+package assets
+
+import (
+	_ "embed"
+)
+
+// same font admin page uses, share images are drawn with it
+
+//go:embed Roboto_Mono/RobotoMono-Bold.ttf
+var RobotoMonoBold []byte
+
+//go:embed Roboto_Mono/RobotoMono-Regular.ttf
+var RobotoMonoRegular []byte
@@ -0,0 +1,550 @@
+package compiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// how many builds we keep besides the live one
+var KeepBuilds = 5
+
+const (
+	buildInfoFileName     = "build.json"
+	buildPostListFileName = "post-list.json"
+	buildOutputDirName    = "posts"
+	liveBuildFileName     = "live"
+)
+
+// build kept in BuildsPath
+//
+// each build has a directory with its info and post list,
+// ones that are not live also have their output there
+type BuildInfo struct {
+	ID   string
+	Time time.Time
+
+	Posts int
+	// hash directories in SharedAssetsPath that build uses
+	Assets []string
+
+	// output of build is what's being served
+	Live bool
+}
+
+func newBuildID(t time.Time) string {
+	return t.UTC().Format("20060102-150405.000")
+}
+
+// where builds are kept, where shared files they use are
+// and where post list of live output is,
+// exported functions use BuildsPath, SharedAssetsPath and postlist.PostListPath
+type buildStore struct {
+	BuildsPath string
+	AssetsPath string
+	// empty means there is no live output we know of
+	PostListPath string
+}
+
+func defaultBuildStore() buildStore {
+	return buildStore{
+		BuildsPath:   BuildsPath,
+		AssetsPath:   SharedAssetsPath,
+		PostListPath: postlist.PostListPath,
+	}
+}
+
+// post list of output that is live now
+func (bs buildStore) livePostList() (model.PostList, error) {
+	if bs.PostListPath == "" {
+		return model.PostList{}, nil
+	}
+	return postlist.LoadPostList(bs.PostListPath)
+}
+
+func (bs buildStore) dir(id string) string {
+	return filepath.Join(bs.BuildsPath, id)
+}
+
+func isBuildID(id string) bool {
+	_, err := time.Parse("20060102-150405.000", id)
+	return err == nil
+}
+
+func (bs buildStore) readLiveID() (string, error) {
+	idBytes, err := os.ReadFile(filepath.Join(bs.BuildsPath, liveBuildFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(idBytes)), nil
+}
+
+func (bs buildStore) writeRecord(info BuildInfo, postListBytes []byte) error {
+	dir := bs.dir(info.ID)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	info.Live = false
+	infoBytes, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.ReplaceFile(filepath.Join(dir, buildInfoFileName), infoBytes, 0644); err != nil {
+		return err
+	}
+
+	return util.ReplaceFile(filepath.Join(dir, buildPostListFileName), postListBytes, 0644)
+}
+
+// how many times renames of the two step swap are tried,
+// on windows they fail for a moment while something has a file open
+const swapRenameAttempts = 5
+
+func renameRetrying(oldPath string, newPath string) error {
+	var err error
+	for attempt := range swapRenameAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		if err = os.Rename(oldPath, newPath); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// swaps newDir in as liveDir, newDir ends up with what liveDir had
+// or doesn't exist if liveDir didn't
+//
+// swap is only atomic on linux, where renameat2 swaps both in one step.
+// everywhere else (windows included) liveDir is renamed aside first,
+// so for a moment there is no liveDir, and if putting it back fails
+// it's left missing and error says where it is
+func swapDirs(newDir string, liveDir string) error {
+	exists, err := util.FileExists(liveDir, true)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return os.Rename(newDir, liveDir)
+	}
+
+	err = util.ExchangePaths(newDir, liveDir)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	swapNotAtomicWarning.Do(func() {
+		util.WarnLogger.Printf("can't swap directories in one step here, %s is missing for a moment while it's replaced", liveDir)
+	})
+
+	// there is a moment without liveDir, but it's as short as we can make it
+	asideDir := newDir + "_old"
+	if err := renameRetrying(liveDir, asideDir); err != nil {
+		return err
+	}
+	if err := renameRetrying(newDir, liveDir); err != nil {
+		if restoreErr := renameRetrying(asideDir, liveDir); restoreErr != nil {
+			return fmt.Errorf(
+				"%w, and failed to put %s back, it's in %s: %w", err, liveDir, asideDir, restoreErr,
+			)
+		}
+		return err
+	}
+	return renameRetrying(asideDir, newDir)
+}
+
+var swapNotAtomicWarning sync.Once
+
+// moves hash directories in stagingDir to assets path
+// returns ones that got moved so they can be taken back out
+func (bs buildStore) moveStagedAssets(stagingDir string) ([]string, error) {
+	staged, err := ListSharedAssets(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []string
+
+	for _, hash := range staged {
+		dst := filepath.Join(bs.AssetsPath, hash)
+
+		exists, err := util.FileExists(dst, true)
+		if err != nil {
+			return moved, err
+		}
+		if exists {
+			// shared copy with the same content under another name
+			// is already there, only add what's missing
+			files, err := os.ReadDir(filepath.Join(stagingDir, hash))
+			if err != nil {
+				return moved, err
+			}
+			for _, file := range files {
+				dstFile := filepath.Join(dst, file.Name())
+				if exists, err := util.FileExists(dstFile, false); err != nil {
+					return moved, err
+				} else if exists {
+					continue
+				}
+				if err := os.Rename(filepath.Join(stagingDir, hash, file.Name()), dstFile); err != nil {
+					return moved, err
+				}
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(bs.AssetsPath, 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(filepath.Join(stagingDir, hash), dst); err != nil {
+			return moved, err
+		}
+		moved = append(moved, hash)
+	}
+
+	return moved, nil
+}
+
+// removes hash directories moveStagedAssets moved when build didn't go live
+func (bs buildStore) removeMovedAssets(moved []string) {
+	for _, hash := range moved {
+		if err := os.RemoveAll(filepath.Join(bs.AssetsPath, hash)); err != nil {
+			util.WarnLogger.Printf("failed to remove shared files %s: %v", hash, err)
+		}
+	}
+}
+
+// puts output in tmpOutDir live at outDir
+// and keeps what was there in BuildsPath
+//
+// output is only swapped in atomically on linux, see swapDirs
+//
+// new shared files in tmpAssetsDir are moved to SharedAssetsPath first
+// so they are there once output that uses them is
+//
+// if BuildsPath is empty previous output is just removed
+func PublishBuild(
+	tmpOutDir string,
+	tmpAssetsDir string,
+	outDir string,
+	postList model.PostList,
+	assets []string,
+) (BuildInfo, error) {
+	return defaultBuildStore().publish(tmpOutDir, tmpAssetsDir, outDir, postList, assets)
+}
+
+func (bs buildStore) publish(
+	tmpOutDir string,
+	tmpAssetsDir string,
+	outDir string,
+	postList model.PostList,
+	assets []string,
+) (BuildInfo, error) {
+	now := time.Now()
+
+	info := BuildInfo{
+		ID:     newBuildID(now),
+		Time:   now,
+		Posts:  len(postList.Posts),
+		Assets: assets,
+		Live:   true,
+	}
+
+	if bs.BuildsPath == "" {
+		moved, err := bs.moveStagedAssets(tmpAssetsDir)
+		if err == nil {
+			err = swapDirs(tmpOutDir, outDir)
+		}
+		if err != nil {
+			bs.removeMovedAssets(moved)
+			return BuildInfo{}, err
+		}
+		return info, os.RemoveAll(tmpOutDir)
+	}
+
+	liveID, err := bs.readLiveID()
+	if err != nil {
+		return BuildInfo{}, err
+	}
+
+	// same millisecond as the live one
+	for info.ID == liveID || !bs.isNewID(info.ID) {
+		now = now.Add(time.Millisecond)
+		info.ID = newBuildID(now)
+	}
+
+	postListBytes, err := json.MarshalIndent(postList, "", "  ")
+	if err != nil {
+		return BuildInfo{}, err
+	}
+	if err := bs.writeRecord(info, postListBytes); err != nil {
+		return BuildInfo{}, err
+	}
+
+	moved, err := bs.moveStagedAssets(tmpAssetsDir)
+	if err == nil {
+		err = swapDirs(tmpOutDir, outDir)
+	}
+	if err != nil {
+		bs.removeMovedAssets(moved)
+		return BuildInfo{}, err
+	}
+
+	// what was live
+	if exists, err := util.FileExists(tmpOutDir, true); err != nil {
+		return BuildInfo{}, err
+	} else if exists {
+		if err := bs.keepOldOutput(tmpOutDir, liveID); err != nil {
+			return BuildInfo{}, err
+		}
+	}
+
+	if err := util.ReplaceFile(filepath.Join(bs.BuildsPath, liveBuildFileName), []byte(info.ID), 0644); err != nil {
+		return BuildInfo{}, err
+	}
+
+	if err := bs.prune(); err != nil {
+		util.WarnLogger.Printf("failed to remove old builds: %v", err)
+	}
+
+	return info, nil
+}
+
+func (bs buildStore) isNewID(id string) bool {
+	exists, err := util.FileExists(bs.dir(id), true)
+	return err == nil && !exists
+}
+
+// moves output that used to be live into record of build liveID
+func (bs buildStore) keepOldOutput(oldOutDir string, liveID string) error {
+	if liveID == "" || !isBuildID(liveID) || bs.isNewID(liveID) {
+		// we don't know what build it was,
+		// post list of it is still in PostListPath
+		liveID = newBuildID(time.Unix(0, 0))
+
+		postList, err := bs.livePostList()
+		if err != nil {
+			return err
+		}
+
+		postListBytes, err := json.MarshalIndent(postList, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		assets, err := ListSharedAssets(bs.AssetsPath)
+		if err != nil {
+			return err
+		}
+
+		os.RemoveAll(bs.dir(liveID))
+
+		info := BuildInfo{ID: liveID, Posts: len(postList.Posts), Assets: assets}
+		if err := bs.writeRecord(info, postListBytes); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(oldOutDir, filepath.Join(bs.dir(liveID), buildOutputDirName))
+}
+
+// builds in BuildsPath, newest first
+func ListBuilds() ([]BuildInfo, error) {
+	return defaultBuildStore().list()
+}
+
+func (bs buildStore) list() ([]BuildInfo, error) {
+	if bs.BuildsPath == "" {
+		return nil, nil
+	}
+
+	dirents, err := os.ReadDir(bs.BuildsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	liveID, err := bs.readLiveID()
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []BuildInfo
+
+	for _, dirent := range dirents {
+		if !dirent.IsDir() || !isBuildID(dirent.Name()) {
+			continue
+		}
+
+		infoBytes, err := os.ReadFile(filepath.Join(bs.BuildsPath, dirent.Name(), buildInfoFileName))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var info BuildInfo
+		if err := json.Unmarshal(infoBytes, &info); err != nil {
+			return nil, fmt.Errorf("build %s: %w", dirent.Name(), err)
+		}
+		info.ID = dirent.Name()
+		info.Live = info.ID == liveID
+
+		// output went missing, nothing to roll back to
+		if !info.Live {
+			exists, err := util.FileExists(filepath.Join(bs.dir(info.ID), buildOutputDirName), true)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+		}
+
+		builds = append(builds, info)
+	}
+
+	slices.SortFunc(builds, func(a, b BuildInfo) int {
+		return strings.Compare(b.ID, a.ID)
+	})
+
+	return builds, nil
+}
+
+// removes builds past KeepBuilds
+func (bs buildStore) prune() error {
+	dirents, err := os.ReadDir(bs.BuildsPath)
+	if err != nil {
+		return err
+	}
+
+	liveID, err := bs.readLiveID()
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, dirent := range dirents {
+		if dirent.IsDir() && isBuildID(dirent.Name()) && dirent.Name() != liveID {
+			ids = append(ids, dirent.Name())
+		}
+	}
+
+	// newest first
+	slices.Sort(ids)
+	slices.Reverse(ids)
+
+	for _, id := range ids[min(len(ids), max(KeepBuilds, 0)):] {
+		if err := os.RemoveAll(bs.dir(id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shared assets that builds we keep use
+func KeptBuildAssets() ([]string, error) {
+	return defaultBuildStore().keptAssets()
+}
+
+func (bs buildStore) keptAssets() ([]string, error) {
+	builds, err := bs.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var assets []string
+	for _, build := range builds {
+		assets = append(assets, build.Assets...)
+	}
+	slices.Sort(assets)
+
+	return slices.Compact(assets), nil
+}
+
+// makes build with id live at outDir again
+// and puts its post list in PostListPath
+func RollbackBuild(id string, outDir string) (BuildInfo, model.PostList, error) {
+	bs := defaultBuildStore()
+
+	if bs.BuildsPath == "" {
+		return BuildInfo{}, model.PostList{}, fmt.Errorf("builds are not kept")
+	}
+
+	builds, err := bs.list()
+	if err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	index := slices.IndexFunc(builds, func(build BuildInfo) bool {
+		return build.ID == id
+	})
+	if index < 0 {
+		return BuildInfo{}, model.PostList{}, fmt.Errorf("no build %q", id)
+	}
+	target := builds[index]
+	if target.Live {
+		return BuildInfo{}, model.PostList{}, fmt.Errorf("build %q is already live", id)
+	}
+
+	postList, err := postlist.LoadPostList(filepath.Join(bs.dir(id), buildPostListFileName))
+	if err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	liveID, err := bs.readLiveID()
+	if err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	targetOutDir := filepath.Join(bs.dir(id), buildOutputDirName)
+
+	if err := swapDirs(targetOutDir, outDir); err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	if exists, err := util.FileExists(targetOutDir, true); err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	} else if exists {
+		if err := bs.keepOldOutput(targetOutDir, liveID); err != nil {
+			return BuildInfo{}, model.PostList{}, err
+		}
+	}
+
+	if err := util.ReplaceFile(filepath.Join(bs.BuildsPath, liveBuildFileName), []byte(id), 0644); err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	if err := postlist.SavePostList(postList, bs.PostListPath); err != nil {
+		return BuildInfo{}, model.PostList{}, err
+	}
+
+	// stamps are about output we just swapped out
+	if err := util.DeleteFile(SourceStampsPath); err != nil {
+		util.WarnLogger.Printf("failed to remove source stamps %s: %v", SourceStampsPath, err)
+	}
+
+	target.Live = true
+
+	return target, postList, nil
+}
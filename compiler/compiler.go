@@ -0,0 +1,599 @@
+// compiles posts into what gets served, see CompileBlog
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/uuid"
+
+	"blog/markdown"
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+var (
+	// where we cache generated images, empty means no caching
+	ImageCachePath = "cache/images"
+	// where we cache optimized images, empty means no caching
+	OptimizedImageCachePath = "cache/optimized"
+	// where we remember what compiled files were copied from,
+	// empty means files from previous build are never reused
+	SourceStampsPath = "cache/source-stamps.json"
+
+	// where files shared between posts go, see DedupPostAssets
+	SharedAssetsPath = "docs/public/assets"
+
+	// where previous builds are kept for rollback, see PublishBuild
+	// empty means they are not kept
+	BuildsPath = "builds"
+
+	// size budgets of compiled posts, see SizeBudget
+	// missing file means no budget
+	SizeBudgetPath = "size-budget.json"
+)
+
+// when a post fails to compile, publish its output from previous build
+// (or leave it out if there is none) instead of failing the whole build
+var KeepFailedPosts = false
+
+// what CompileBlog takes from package variables,
+// CheckBuild compiles with its own so it leaves real output alone
+type compileOptions struct {
+	builds buildStore
+	// empty means files from previous build are never reused
+	sourceStampsPath string
+	// empty means no caching
+	imageCachePath          string
+	optimizedImageCachePath string
+	keepFailedPosts         bool
+}
+
+func defaultCompileOptions() compileOptions {
+	return compileOptions{
+		builds:                  defaultBuildStore(),
+		sourceStampsPath:        SourceStampsPath,
+		imageCachePath:          ImageCachePath,
+		optimizedImageCachePath: OptimizedImageCachePath,
+		keepFailedPosts:         KeepFailedPosts,
+	}
+}
+
+// compile posts in postList to outDir
+//
+// returns postList with things we found out while compiling filled in
+//
+// errors are *BuildError, report has diagnostics
+// of every post whether it fails or not
+func CompileBlog(postRoot string, postList model.PostList, outDir string) (model.PostList, BuildReport, error) {
+	return compileBlog(postRoot, postList, outDir, defaultCompileOptions())
+}
+
+func compileBlog(
+	postRoot string,
+	postList model.PostList,
+	outDir string,
+	opts compileOptions,
+) (model.PostList, BuildReport, error) {
+	outDirParent := filepath.Dir(outDir)
+	if outDirParent == "." {
+		return model.PostList{}, BuildReport{}, fmt.Errorf("outDir can't be a root")
+	}
+
+	// copied post directories have to get their own uuid first
+	duplicates, err := postlist.FindDuplicateUUIDs(postRoot, postList)
+	if err != nil {
+		return model.PostList{}, BuildReport{}, err
+	}
+	if len(duplicates) > 0 {
+		report := BuildReport{Diagnostics: duplicateUUIDDiagnostics(duplicates)}
+		return model.PostList{}, report, &BuildError{Diagnostics: report.Diagnostics}
+	}
+
+	// build is made next to outDir so that it can be swapped in
+	if err := os.MkdirAll(outDirParent, 0755); err != nil {
+		return model.PostList{}, BuildReport{}, err
+	}
+
+	tmpOutDir, err := os.MkdirTemp(outDirParent, "out_tmp")
+	if err != nil {
+		return model.PostList{}, BuildReport{}, err
+	}
+
+	// new shared files wait here until build is published
+	tmpAssetsDir := tmpOutDir + "_assets"
+	defer func() {
+		if err := os.RemoveAll(tmpAssetsDir); err != nil {
+			util.WarnLogger.Printf("failed to remove %s, %s", tmpAssetsDir, err)
+		}
+	}()
+
+	postList = postList.Clone()
+
+	var report BuildReport
+
+	stamps := LoadSourceStamps(opts.sourceStampsPath)
+
+	// hooks registered in the middle of build wait for the next one
+	hooks := BuildHooks()
+
+	generatePostErr := func(post model.Post, err error) error {
+		return fmt.Errorf("post \"%s\" in \"%s\": %w", post.Name, post.Dir, err)
+	}
+
+	// compiles post into tmpOutDir
+	compilePost := func(post model.Post) (model.Post, PostBuildReport, error) {
+		postDirPath := filepath.Join(postRoot, post.Dir)
+
+		// ======================================
+		// check if we know about post corretly
+		// ======================================
+		actualType, err := postlist.GetPostTypeFromDir(postDirPath)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+
+		actualUUID, foundUUIDFile, err := postlist.GetPostUUIDFromDir(postDirPath)
+
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+		if !foundUUIDFile {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticMissingUUID, postlist.PostUUIDFileName, fmt.Errorf("could not find %s", postlist.PostUUIDFileName))
+		}
+
+		if post.UUID != actualUUID {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticUUIDMismatch, postlist.PostUUIDFileName, fmt.Errorf("UUID does not match"))
+		}
+
+		if post.Type != actualType {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticTypeMismatch, "", fmt.Errorf("post type does not match"))
+		}
+
+		postOutDir := filepath.Join(tmpOutDir, post.Dir)
+
+		ignore, err := postlist.LoadPostIgnore(postRoot, postDirPath)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticPostIgnore, postlist.PostIgnoreFileName, err)
+		}
+
+		// ===========================================
+		// if post type is html, just copy directory
+		// ===========================================
+		postReport := PostBuildReport{
+			UUID: post.UUID,
+			Name: post.Name,
+			Dir:  post.Dir,
+		}
+
+		// output of previous build, files there can be reused
+		//
+		// hooks can write files in place, which would write through hard links
+		// into previous build, and what they did is already in previous output,
+		// so with hooks everything is copied from sources
+		previousOutDir := filepath.Join(outDir, post.Dir)
+		if len(hooks) > 0 {
+			previousOutDir = ""
+		}
+
+		if post.Type == model.PostTypeHTML {
+			postReport.LinkedFiles, err = CopyPostFiles(postDirPath, postOutDir, previousOutDir, ignore, stamps)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+		}
+
+		// =======================================================
+		// if post type is markdown, convert it to html
+		// =======================================================
+		if post.Type == model.PostTypeMarkDown {
+			markdownBytes, err := os.ReadFile(filepath.Join(postDirPath, "index.md"))
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+
+			// index.md becomes index.html
+			copyIgnore, err := ignore.With("markdown", "/index.md")
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+
+			postReport.LinkedFiles, err = CopyPostFiles(postDirPath, postOutDir, previousOutDir, copyIgnore, stamps)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+
+			// generate downscaled images after we copied everything
+			// so that they don't get in the way of copying
+			imageVariants, err := GenerateMarkdownImageVariants(
+				markdownBytes, postDirPath, postOutDir, opts.imageCachePath,
+			)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticImage, "index.md", err)
+			}
+
+			htmlBytes, err := markdown.ConvertMarkdown(markdownBytes, postDirPath, imageVariants)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+
+			htmlBytes, err = runTransformMarkdownHTMLHooks(hooks, post, htmlBytes)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+
+			err = util.ReplaceFile(
+				filepath.Join(postOutDir, "index.html"),
+				htmlBytes,
+				0644,
+			)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, err
+			}
+		}
+
+		// ===========================================
+		// generate thumbnails
+		// ===========================================
+		thumbnail, hasThumbnail, thumbnailDerived, err := postlist.GetPostThumbnail(postDirPath, post.Type)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticThumbnail, "", err)
+		}
+
+		post.Thumbnail = thumbnail
+		post.HasThumbnail = hasThumbnail
+		post.ThumbnailDerived = thumbnailDerived
+		post.SetGeneratedThumbnails(model.GeneratedThumbnails{})
+
+		if hasThumbnail {
+			thumbnails, err := GenerateThumbnails(postDirPath, postOutDir, thumbnail)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticThumbnail, thumbnail, err)
+			}
+			post.SetGeneratedThumbnails(thumbnails)
+		}
+
+		// ===========================================
+		// generate share image
+		// ===========================================
+
+		post.ShareImage, err = pickShareImage(postDirPath, post)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticShareImage, thumbnail, err)
+		}
+		if post.ShareImage == "" {
+			post.ShareImage, err = GenerateShareImage(post, postOutDir)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticShareImage, "", err)
+			}
+		}
+
+		indexPath := filepath.Join(postOutDir, "index.html")
+
+		indexBytes, err := os.ReadFile(indexPath)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+
+		indexBytes = InjectShareMeta(
+			indexBytes,
+			post.Name,
+			SharedFileURL(filepath.Base(outDir), post, post.ShareImage),
+		)
+
+		err = util.ReplaceFile(indexPath, indexBytes, 0644)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+
+		removed, err := removeUnusedThumbnail(postOutDir, post)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticThumbnail, thumbnail, err)
+		}
+		if removed {
+			postReport.LeftOutThumbnail = thumbnail
+		}
+
+		// ===========================================
+		// strip image metadata
+		// ===========================================
+		keepMetadata, err := util.FileExists(filepath.Join(postDirPath, postlist.PostKeepMetadataFileName), false)
+		if err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+		if !keepMetadata {
+			postReport.StrippedMetadata, err = StripImageMetadataInDir(postOutDir)
+			if err != nil {
+				return model.Post{}, PostBuildReport{}, withDiagnostic(DiagnosticMetadata, "", err)
+			}
+		}
+
+		// ===========================================
+		// custom steps
+		// ===========================================
+
+		if err := runAfterPostHooks(hooks, &post, postOutDir); err != nil {
+			return model.Post{}, PostBuildReport{}, err
+		}
+
+		return post, postReport, nil
+	}
+
+	var previousPosts map[uuid.UUID]model.Post
+	// shared files that outputs we kept from previous build refer to
+	var keptSharedAssets []string
+
+	// puts what post compiled to in previous build into tmpOutDir
+	// returns false if there is nothing to keep
+	keepPreviousPost := func(post model.Post) (model.Post, bool, error) {
+		postOutDir := filepath.Join(tmpOutDir, post.Dir)
+
+		if err := os.RemoveAll(postOutDir); err != nil {
+			return model.Post{}, false, err
+		}
+
+		if previousPosts == nil {
+			previousList, err := opts.builds.livePostList()
+			if err != nil {
+				return model.Post{}, false, err
+			}
+
+			previousPosts = make(map[uuid.UUID]model.Post)
+			for _, previous := range previousList.Posts {
+				previousPosts[previous.UUID] = previous
+			}
+		}
+
+		previous, ok := previousPosts[post.UUID]
+		if !ok {
+			return model.Post{}, false, nil
+		}
+
+		previousOutDir := filepath.Join(outDir, previous.Dir)
+
+		exists, err := util.FileExists(previousOutDir, true)
+		if err != nil {
+			return model.Post{}, false, err
+		}
+		if !exists {
+			return model.Post{}, false, nil
+		}
+
+		if _, err := CopyPostFiles(previousOutDir, postOutDir, "", postlist.PostIgnore{}, nil); err != nil {
+			return model.Post{}, false, err
+		}
+
+		refs, err := FindSharedAssetRefs(postOutDir)
+		if err != nil {
+			return model.Post{}, false, err
+		}
+		keptSharedAssets = append(keptSharedAssets, refs...)
+
+		// compiled things come from previous build,
+		// things user picked come from now
+		kept := previous.Clone()
+		kept.Name = post.Name
+		kept.Date = post.Date
+		kept.Dir = post.Dir
+
+		return kept, true, nil
+	}
+
+	copyPostsToTmp := func() error {
+		var compiledPosts []model.Post
+		anyFailed := false
+
+		for _, post := range postList.Posts {
+			compiled, postReport, err := compilePost(post)
+			if err == nil {
+				compiledPosts = append(compiledPosts, compiled)
+				report.Posts = append(report.Posts, postReport)
+				continue
+			}
+
+			report.Diagnostics = append(report.Diagnostics, PostDiagnostics(post, err)...)
+			anyFailed = true
+
+			// keep going to find problems in other posts too
+			if !opts.keepFailedPosts {
+				continue
+			}
+
+			failed := FailedPost{
+				UUID:  post.UUID,
+				Name:  post.Name,
+				Dir:   post.Dir,
+				Error: generatePostErr(post, err).Error(),
+			}
+
+			kept, ok, err := keepPreviousPost(post)
+			if err != nil {
+				return generatePostErr(post, fmt.Errorf("failed to keep previous output: %w", err))
+			}
+			if ok {
+				failed.KeptPrevious = true
+
+				compiledPosts = append(compiledPosts, kept)
+				report.Posts = append(report.Posts, PostBuildReport{
+					UUID: kept.UUID,
+					Name: kept.Name,
+					Dir:  kept.Dir,
+				})
+			}
+
+			report.Failed = append(report.Failed, failed)
+		}
+
+		if anyFailed && !opts.keepFailedPosts {
+			return &BuildError{Diagnostics: report.Diagnostics}
+		}
+
+		postList.Posts = compiledPosts
+
+		return nil
+	}
+
+	// optimize images after everything is in place
+	// so that we also get the ones we generated
+	optimizeImagesInTmp := func() error {
+		for i, post := range postList.Posts {
+			postOutDir := filepath.Join(tmpOutDir, post.Dir)
+
+			optimized, err := OptimizeImagesInDir(postOutDir, opts.optimizedImageCachePath)
+			if err != nil {
+				err = withDiagnostic(DiagnosticOptimize, "", err)
+				report.Diagnostics = append(report.Diagnostics, PostDiagnostics(post, err)...)
+				return &BuildError{Diagnostics: report.Diagnostics}
+			}
+
+			report.Posts[i].OptimizedImages = optimized
+		}
+
+		return nil
+	}
+
+	var sharedAssets []string
+	// ones in tmpAssetsDir, rest are in assets path already
+	var stagedAssets []string
+
+	sharedAssetDir := func(hash string) string {
+		if slices.Contains(stagedAssets, hash) {
+			return filepath.Join(tmpAssetsDir, hash)
+		}
+		return filepath.Join(opts.builds.AssetsPath, hash)
+	}
+
+	dedupAssetsInTmp := func() error {
+		var postDirs []string
+		for _, post := range postList.Posts {
+			postDirs = append(postDirs, post.Dir)
+		}
+
+		result, err := DedupPostAssets(tmpOutDir, postDirs, opts.builds.AssetsPath, tmpAssetsDir)
+		if err != nil {
+			return err
+		}
+
+		for i, deduped := range result.Posts {
+			report.Posts[i].DedupedAssets = deduped
+		}
+		report.DedupSaved = result.Saved
+
+		sharedAssets = result.Assets
+		stagedAssets = result.Staged
+
+		return nil
+	}
+
+	checkSizesInTmp := func() error {
+		var sharedAssetDirs []string
+		for _, hash := range sharedAssets {
+			sharedAssetDirs = append(sharedAssetDirs, sharedAssetDir(hash))
+		}
+
+		sizes, err := ComputeSizeReport(tmpOutDir, postList, sharedAssetDirs)
+		if err != nil {
+			return err
+		}
+
+		budget, err := LoadSizeBudget(SizeBudgetPath)
+		if err != nil {
+			return err
+		}
+		report.Diagnostics = append(report.Diagnostics, budget.Check(&sizes)...)
+
+		report.Sizes = sizes
+
+		if len(sizes.Failures) > 0 {
+			return &BuildError{Diagnostics: report.Diagnostics}
+		}
+
+		return nil
+	}
+
+	err = runBeforeBuildHooks(hooks, postRoot, &postList)
+	if err == nil {
+		err = copyPostsToTmp()
+	}
+	// before dedup hard links files to shared copies,
+	// and so that what hooks write gets optimized and deduped too
+	if err == nil {
+		err = runAfterBuildHooks(hooks, postList, tmpOutDir)
+	}
+	if err == nil && OptimizeImages {
+		err = optimizeImagesInTmp()
+	}
+	if err == nil && DedupAssets {
+		err = dedupAssetsInTmp()
+	}
+	if err == nil {
+		// outputs we kept from previous build may use shared files too
+		sharedAssets = append(sharedAssets, keptSharedAssets...)
+		slices.Sort(sharedAssets)
+		sharedAssets = slices.Compact(sharedAssets)
+
+		err = checkSizesInTmp()
+	}
+	if err == nil {
+		// same sources should give the same output
+		err = NormalizeOutput(tmpOutDir)
+		for _, hash := range stagedAssets {
+			if err != nil {
+				break
+			}
+			err = NormalizeOutput(filepath.Join(tmpAssetsDir, hash))
+		}
+	}
+	if err != nil {
+		removeErr := os.RemoveAll(tmpOutDir)
+		if removeErr != nil {
+			util.WarnLogger.Printf("failed to remove %s, %s", tmpOutDir, removeErr)
+		}
+
+		// every failure comes with diagnostics
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) {
+			diagnostic := Diagnostic{
+				Severity: SeverityError,
+				Code:     DiagnosticCompile,
+				Message:  err.Error(),
+			}
+
+			var diagnosticErr *DiagnosticError
+			if errors.As(err, &diagnosticErr) {
+				diagnostic.Code = diagnosticErr.Code
+			}
+
+			report.Diagnostics = append(report.Diagnostics, diagnostic)
+			err = &BuildError{Diagnostics: report.Diagnostics}
+		}
+
+		return model.PostList{}, report, err
+	}
+
+	report.Build, err = opts.builds.publish(tmpOutDir, tmpAssetsDir, outDir, postList, sharedAssets)
+	if err != nil {
+		return model.PostList{}, BuildReport{}, err
+	}
+
+	// shared files that nothing uses anymore,
+	// builds we can roll back to still use theirs
+	keptAssets, err := opts.builds.keptAssets()
+	if err == nil {
+		err = RemoveUnusedSharedAssets(opts.builds.AssetsPath, append(keptAssets, sharedAssets...))
+	}
+	if err != nil {
+		util.WarnLogger.Printf("failed to clean up %s, %s", opts.builds.AssetsPath, err)
+	}
+
+	err = stamps.Save(opts.sourceStampsPath)
+	if err != nil {
+		util.WarnLogger.Printf("failed to save source stamps %s, %s", opts.sourceStampsPath, err)
+	}
+
+	return postList, report, nil
+}
@@ -0,0 +1,2403 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/bmp"
+
+	"blog/markdown"
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// points everything CompileBlog writes besides output into a temporary directory
+func setupCompile(t *testing.T) (postRoot string, outDir string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	saved := []*string{
+		&ImageCachePath, &OptimizedImageCachePath, &SourceStampsPath,
+		&SharedAssetsPath, &BuildsPath, &SizeBudgetPath,
+		&postlist.PostListPath, &postlist.HashCachePath,
+	}
+	values := make([]string, len(saved))
+	for i, p := range saved {
+		values[i] = *p
+	}
+	t.Cleanup(func() {
+		for i, p := range saved {
+			*p = values[i]
+		}
+	})
+
+	ImageCachePath = ""
+	OptimizedImageCachePath = ""
+	SourceStampsPath = filepath.Join(dir, "cache", "source-stamps.json")
+	SharedAssetsPath = filepath.Join(dir, "docs", "public", "assets")
+	BuildsPath = filepath.Join(dir, "builds")
+	SizeBudgetPath = ""
+	postlist.PostListPath = filepath.Join(dir, "docs", "public", "post-list.json")
+	postlist.HashCachePath = ""
+
+	postRoot = filepath.Join(dir, "posts")
+	// parent doesn't exist yet, like on a fresh checkout
+	outDir = filepath.Join(dir, "docs", "posts")
+
+	return postRoot, outDir
+}
+
+func writePost(t *testing.T, postRoot string, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(postRoot, dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompileBlog(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	writePost(t, postRoot, "html-post", map[string]string{
+		"index.html":  "<html><head><title>hi</title></head><body>hi</body></html>",
+		"notes.psd":   "not for output",
+		".postignore": "*.psd\n",
+	})
+	writePost(t, postRoot, "markdown-post", map[string]string{
+		"index.md": "# Hello\n\nworld\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(compiled.Posts) != 2 || len(report.Posts) != 2 {
+		t.Fatalf("compiled %d posts with %d reports, want 2", len(compiled.Posts), len(report.Posts))
+	}
+	if report.Build.ID == "" || !report.Build.Live {
+		t.Errorf("build wasn't recorded: %+v", report.Build)
+	}
+
+	for _, post := range compiled.Posts {
+		if post.ShareImage != ShareImageName {
+			t.Errorf("%s: share image is %q", post.Dir, post.ShareImage)
+		}
+
+		indexBytes, err := os.ReadFile(filepath.Join(outDir, post.Dir, "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(indexBytes, []byte(`property="og:image"`)) {
+			t.Errorf("%s: index.html has no share meta:\n%s", post.Dir, indexBytes)
+		}
+	}
+
+	markdownIndex, err := os.ReadFile(filepath.Join(outDir, "markdown-post", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(markdownIndex, []byte("<h1>Hello</h1>")) {
+		t.Errorf("markdown didn't get converted:\n%s", markdownIndex)
+	}
+
+	for _, name := range []string{
+		"html-post/notes.psd",
+		"html-post/.postignore",
+		"html-post/" + postlist.PostUUIDFileName,
+		"markdown-post/index.md",
+	} {
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(name))); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s shouldn't be in output", name)
+		}
+	}
+
+	// building again keeps the first build for rollback
+	if _, _, err := CompileBlog(postRoot, compiled, outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || !builds[0].Live || builds[1].ID != report.Build.ID {
+		t.Errorf("builds are %+v", builds)
+	}
+}
+
+func TestCompileBlogDiagnostics(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	writePost(t, postRoot, "good", map[string]string{
+		"index.md": "# fine\n",
+	})
+	writePost(t, postRoot, "broken", map[string]string{
+		"index.md": "# broken\n\n![missing](missing.png)\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("want *BuildError, got %v", err)
+	}
+
+	if len(report.Diagnostics) != 1 {
+		t.Fatalf("got %d diagnostics, want 1: %v", len(report.Diagnostics), report.Diagnostics)
+	}
+
+	diagnostic := report.Diagnostics[0]
+	if diagnostic.Dir != "broken" || diagnostic.File != "index.md" || diagnostic.Line != 3 {
+		t.Errorf("diagnostic points to %s", diagnostic)
+	}
+	if diagnostic.Code != DiagnosticMarkdown || diagnostic.Severity != SeverityError {
+		t.Errorf("diagnostic is %s %s", diagnostic.Severity, diagnostic.Code)
+	}
+
+	// nothing went live
+	if _, err := os.Stat(outDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed build left output")
+	}
+}
+
+func TestCompileBlogDuplicateUUIDs(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	writePost(t, postRoot, "original", map[string]string{
+		"index.md": "# original\n",
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copying post directory copies its uuid
+	uuidBytes, err := os.ReadFile(filepath.Join(postRoot, "original", postlist.PostUUIDFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePost(t, postRoot, "copy", map[string]string{
+		"index.md":                "# copy\n",
+		postlist.PostUUIDFileName: string(uuidBytes),
+	})
+
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("want *BuildError, got %v", err)
+	}
+	if len(report.Diagnostics) != 1 || report.Diagnostics[0].Code != DiagnosticDuplicateUUID || report.Diagnostics[0].Dir != "copy" {
+		t.Errorf("diagnostics are %v", report.Diagnostics)
+	}
+	if _, err := os.Stat(outDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("refused build left output")
+	}
+
+	if _, err := postlist.RekeyDuplicates(postRoot, postList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CompileBlog(postRoot, postList, outDir); err != nil {
+		t.Errorf("after re-keying: %v", err)
+	}
+}
+
+type markerHook struct {
+	NopBuildHook
+	marker string
+}
+
+func (h *markerHook) Name() string {
+	return "marker"
+}
+
+func (h *markerHook) TransformMarkdownHTML(post model.Post, htmlBytes []byte) ([]byte, error) {
+	return append(htmlBytes, []byte("<!-- "+h.marker+" "+post.Dir+" -->")...), nil
+}
+
+func TestBuildHooks(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	// lower priority runs first, so its marker ends up first
+	RegisterBuildHook(&markerHook{marker: "second"}, 20)
+	RegisterBuildHook(&markerHook{marker: "first"}, 10)
+
+	writePost(t, postRoot, "post", map[string]string{
+		"index.md": "# hooked\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CompileBlog(postRoot, postList, outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	indexBytes, err := os.ReadFile(filepath.Join(outDir, "post", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := strings.Index(string(indexBytes), "<!-- first post -->")
+	second := strings.Index(string(indexBytes), "<!-- second post -->")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("hooks didn't run in order:\n%s", indexBytes)
+	}
+}
+
+// appends to a file in place like a careless hook would
+type inPlaceHook struct {
+	NopBuildHook
+}
+
+func (h *inPlaceHook) Name() string {
+	return "in place"
+}
+
+func (h *inPlaceHook) AfterPost(post *model.Post, postOutDir string) error {
+	if post.Dir != "linked" {
+		return nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(postOutDir, "notes.txt"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(" hooked")
+	return err
+}
+
+func TestBuildHooksWithHardLinks(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	savedLinkMode := PreviousBuildLinkMode
+	t.Cleanup(func() { PreviousBuildLinkMode = savedLinkMode })
+	PreviousBuildLinkMode = util.LinkModeHard
+
+	writePost(t, postRoot, "linked", map[string]string{
+		"index.html": "<html><head></head><body>linked</body></html>",
+		"notes.txt":  "original",
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstNotes, err := os.ReadFile(filepath.Join(outDir, "linked", "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterBuildHook(&inPlaceHook{}, 0)
+
+	// every build starts from sources, so hook writes once each time
+	for range 2 {
+		_, report, err := CompileBlog(postRoot, first, outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Posts[0].LinkedFiles != 0 {
+			t.Errorf("linked %d files with hooks registered", report.Posts[0].LinkedFiles)
+		}
+
+		notes, err := os.ReadFile(filepath.Join(outDir, "linked", "notes.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(notes) != "original hooked" {
+			t.Errorf("live notes.txt is %q", notes)
+		}
+	}
+
+	builds, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstBuild := builds[len(builds)-1]
+
+	kept, err := os.ReadFile(filepath.Join(BuildsPath, firstBuild.ID, buildOutputDirName, "linked", "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, firstNotes) {
+		t.Errorf("hook changed kept build %s: %q, was %q", firstBuild.ID, kept, firstNotes)
+	}
+}
+
+// jpeg of width x height with EXIF orientation
+func orientedJpeg(t *testing.T, width, height int, orientation int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exif := append(slices.Clone(jpegExifPrefix), minimalExif(orientation)...)
+	data := []byte{0xff, 0xd8, 0xff, 0xe1}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(exif)+2))
+	data = append(data, exif...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func TestGenerateThumbnailsOrientation(t *testing.T) {
+	postDir := t.TempDir()
+	postOutDir := t.TempDir()
+
+	// stored lying down, upright it's 20x40
+	if err := os.WriteFile(filepath.Join(postDir, "photo.jpg"), orientedJpeg(t, 40, 20, 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	thumbnails, err := GenerateThumbnails(postDir, postOutDir, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if thumbnails.Width != 20 || thumbnails.Height != 40 || thumbnails.AspectRatio != 0.5 {
+		t.Errorf("thumbnail is %dx%d with aspect ratio %v, want 20x40", thumbnails.Width, thumbnails.Height, thumbnails.AspectRatio)
+	}
+
+	for _, name := range []string{thumbnails.Card, thumbnails.Retina} {
+		file, err := os.Open(filepath.Join(postOutDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 20 || config.Height != 40 {
+			t.Errorf("%s is %dx%d, want 20x40", name, config.Width, config.Height)
+		}
+	}
+
+	placeholder, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(thumbnails.Placeholder, "data:image/jpeg;base64,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(placeholder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width >= config.Height {
+		t.Errorf("placeholder is %dx%d, should stand upright", config.Width, config.Height)
+	}
+}
+
+func TestGenerateImageVariantsOrientation(t *testing.T) {
+	postDir := t.TempDir()
+	postOutDir := t.TempDir()
+	cacheDir := t.TempDir()
+
+	// stored lying down, upright it's 600x1200
+	if err := os.WriteFile(filepath.Join(postDir, "photo.jpg"), orientedJpeg(t, 1200, 600, 8), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// second time comes from cache
+	for range 2 {
+		variants, err := GenerateImageVariants(postDir, postOutDir, "photo.jpg", cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []markdown.ImageVariant{
+			{Source: "photo.480w.jpg", Width: 480, Height: 960},
+			{Source: "photo.jpg", Width: 600, Height: 1200},
+		}
+		if !slices.Equal(variants, want) {
+			t.Fatalf("variants are %+v, want %+v", variants, want)
+		}
+
+		file, err := os.Open(filepath.Join(postOutDir, "photo.480w.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 480 || config.Height != 960 {
+			t.Errorf("variant is %dx%d, want 480x960", config.Width, config.Height)
+		}
+	}
+}
+
+func TestDedupStagesSharedAssets(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	savedDedup := DedupAssets
+	t.Cleanup(func() { DedupAssets = savedDedup })
+	DedupAssets = true
+
+	shared := strings.Repeat("shared between posts\n", int(DedupMinSize)/10)
+	for _, dir := range []string{"first", "second"} {
+		writePost(t, postRoot, dir, map[string]string{
+			"index.html": `<html><head></head><body><a href="shared.txt">shared</a></body></html>`,
+			"shared.txt": shared,
+		})
+	}
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only output and public files should be next to output
+	checkNoLeftovers := func() {
+		t.Helper()
+
+		dirents, err := os.ReadDir(filepath.Dir(outDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dirent := range dirents {
+			if dirent.Name() != filepath.Base(outDir) && dirent.Name() != "public" {
+				t.Errorf("build left %s behind", dirent.Name())
+			}
+		}
+	}
+
+	// build fails after dedup
+	SizeBudgetPath = filepath.Join(t.TempDir(), "size-budget.json")
+	if err := os.WriteFile(SizeBudgetPath, []byte(`{"Site": {"Max": 1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CompileBlog(postRoot, postList, outDir); err == nil {
+		t.Fatal("build over budget didn't fail")
+	}
+
+	assets, err := ListSharedAssets(SharedAssetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 0 {
+		t.Errorf("failed build left shared assets %v", assets)
+	}
+	checkNoLeftovers()
+
+	SizeBudgetPath = ""
+
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assets, err = ListSharedAssets(SharedAssetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(assets, report.Build.Assets) || len(assets) != 1 {
+		t.Fatalf("shared assets are %v, build uses %v", assets, report.Build.Assets)
+	}
+	content, err := os.ReadFile(filepath.Join(SharedAssetsPath, assets[0], "shared.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != shared {
+		t.Error("shared copy doesn't match posts")
+	}
+	checkNoLeftovers()
+}
+
+func TestDedupPostAssets(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+	assetsDir := filepath.Join(dir, "assets")
+	stagingDir := filepath.Join(dir, "staging")
+
+	big := strings.Repeat("big file\n", int(DedupMinSize)/8)
+	small := "small file\n"
+
+	writeOut := func(post string, files map[string]string) {
+		t.Helper()
+		writePost(t, outDir, post, files)
+	}
+
+	// every reference is in html, file can go
+	writeOut("rewritten", map[string]string{
+		"index.html":     `<html><body><img src="images/big.bin?v=1#top"><img src="small.txt"></body></html>`,
+		"images/big.bin": big,
+		"small.txt":      small,
+		"only-here.bin":  big + "only here",
+	})
+	// css refers to it too, file has to stay
+	writeOut("linked", map[string]string{
+		"index.html": `<html><head><link href="style.css" rel="stylesheet"></head><body><a href="big.bin">big</a></body></html>`,
+		"style.css":  `body { background: url(big.bin); }`,
+		"big.bin":    big,
+		"small.txt":  small,
+	})
+
+	result, err := DedupPostAssets(outDir, []string{"rewritten", "linked"}, assetsDir, stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Assets) != 1 || !slices.Equal(result.Assets, result.Staged) {
+		t.Fatalf("assets %v, staged %v, want one new", result.Assets, result.Staged)
+	}
+	hash := result.Assets[0]
+	sharedURL := SharedAssetsURL + "/" + hash + "/big.bin"
+	sharedPath := filepath.Join(stagingDir, hash, "big.bin")
+
+	if _, err := os.Stat(filepath.Join(assetsDir, hash)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("dedup wrote into assets dir: %v", err)
+	}
+
+	rewritten := result.Posts[0]
+	if len(rewritten) != 1 || rewritten[0].File != "images/big.bin" || !rewritten[0].Removed || rewritten[0].RewrittenRefs != 1 {
+		t.Fatalf("rewritten post deduped %+v", rewritten)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "rewritten", "images", "big.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file every reference got rewritten for is still there: %v", err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(outDir, "rewritten", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(index, []byte(`src="`+sharedURL+`?v=1#top"`)) {
+		t.Errorf("reference wasn't pointed to shared copy:\n%s", index)
+	}
+	if !bytes.Contains(index, []byte(`src="small.txt"`)) {
+		t.Errorf("small file reference got rewritten:\n%s", index)
+	}
+
+	linked := result.Posts[1]
+	if len(linked) != 1 || linked[0].File != "big.bin" || linked[0].Removed || !linked[0].HardLinked {
+		t.Fatalf("linked post deduped %+v", linked)
+	}
+
+	index, err = os.ReadFile(filepath.Join(outDir, "linked", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(index, []byte(`href="`+sharedURL+`"`)) || !bytes.Contains(index, []byte(`href="style.css"`)) {
+		t.Errorf("linked post html is\n%s", index)
+	}
+
+	kept, err := os.Stat(filepath.Join(outDir, "linked", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedInfo, err := os.Stat(sharedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(kept, sharedInfo) {
+		t.Error("kept file isn't a hard link to shared copy")
+	}
+
+	for _, name := range []string{"rewritten/small.txt", "rewritten/only-here.bin", "linked/small.txt"} {
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if want := int64(len(big)); result.Saved != want {
+		t.Errorf("saved %d bytes, want %d", result.Saved, want)
+	}
+
+	// shared copy that's already there is used as it is
+	if err := os.MkdirAll(filepath.Join(assetsDir, hash), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(sharedPath, filepath.Join(assetsDir, hash, "big.bin")); err != nil {
+		t.Fatal(err)
+	}
+	writeOut("third", map[string]string{
+		"index.html": `<html><body><img src="copy.bin"></body></html>`,
+		"copy.bin":   big,
+	})
+	writeOut("fourth", map[string]string{
+		"index.html": `<html><body><img src="big.bin"></body></html>`,
+		"big.bin":    big,
+	})
+
+	result, err = DedupPostAssets(outDir, []string{"third", "fourth"}, assetsDir, filepath.Join(dir, "staging-again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Assets, []string{hash}) || len(result.Staged) != 0 {
+		t.Errorf("assets %v, staged %v, want existing %s", result.Assets, result.Staged, hash)
+	}
+
+	// even where post calls it something else
+	index, err = os.ReadFile(filepath.Join(outDir, "third", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(index, []byte(`src="`+sharedURL+`"`)) {
+		t.Errorf("reference wasn't pointed to existing shared copy:\n%s", index)
+	}
+}
+
+func TestRewriteSrcSet(t *testing.T) {
+	sharedURLs := map[string]string{
+		"cat.png":        "/public/assets/aaa/cat.png",
+		"images/dog.png": "/public/assets/bbb/dog.png",
+	}
+
+	tests := []struct {
+		htmlDir string
+		srcSet  string
+		want    string
+		files   []string
+	}{
+		{".", "cat.png", "/public/assets/aaa/cat.png", []string{"cat.png"}},
+		{".", "cat.png 480w, images/dog.png 960w", "/public/assets/aaa/cat.png 480w, /public/assets/bbb/dog.png 960w", []string{"cat.png", "images/dog.png"}},
+		{"images", "../cat.png 1x,dog.png?v=2 2x", "/public/assets/aaa/cat.png 1x,/public/assets/bbb/dog.png?v=2 2x", []string{"cat.png", "images/dog.png"}},
+		{".", "  cat.png,,  other.png 2x ", "  /public/assets/aaa/cat.png,,  other.png 2x ", []string{"cat.png"}},
+		{".", "data:image/png;base64,AAAA 1x, cat.png 2x", "data:image/png;base64,AAAA 1x, /public/assets/aaa/cat.png 2x", []string{"cat.png"}},
+		{".", "cat.png (max-width: 10px, 1x), images/dog.png", "/public/assets/aaa/cat.png (max-width: 10px, 1x), /public/assets/bbb/dog.png", []string{"cat.png", "images/dog.png"}},
+		{".", "https://example.com/cat.png 1x, /cat.png 2x", "https://example.com/cat.png 1x, /cat.png 2x", nil},
+	}
+
+	for _, test := range tests {
+		got, files := rewriteSrcSet(test.htmlDir, test.srcSet, sharedURLs)
+		if got != test.want || !slices.Equal(files, test.files) {
+			t.Errorf("rewriteSrcSet(%q, %q) = %q, %v, want %q, %v", test.htmlDir, test.srcSet, got, files, test.want, test.files)
+		}
+	}
+}
+
+func TestDedupSrcSetAndScripts(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+
+	big := strings.Repeat("big file\n", int(DedupMinSize)/8)
+	bigger := strings.Repeat("bigger file\n", int(DedupMinSize)/8)
+
+	// variants are only referred to from srcset
+	writePost(t, outDir, "responsive", map[string]string{
+		"index.html":   `<html><body><img src="cat.png" srcset="cat.480w.png 480w, cat.png 960w"></body></html>`,
+		"cat.png":      bigger,
+		"cat.480w.png": big,
+	})
+	writePost(t, outDir, "copy", map[string]string{
+		"index.html":   `<html><body><img src="cat.png"><img src="cat.480w.png"></body></html>`,
+		"cat.png":      bigger,
+		"cat.480w.png": big,
+	})
+	// script might load files by names we can't see
+	writePost(t, outDir, "scripted", map[string]string{
+		"index.html": `<html><body><img src="cat.png"><script src="/public/markdown/main.js"></script><script src="game.js"></script></body></html>`,
+		"game.js":    "load('c' + 'at.png')",
+		"cat.png":    bigger,
+	})
+	writePost(t, outDir, "inline-script", map[string]string{
+		"index.html": `<html><body><img src="cat.png"><script>load('c' + 'at.png')</script></body></html>`,
+		"cat.png":    bigger,
+	})
+	writePost(t, outDir, "wasm", map[string]string{
+		"index.html": `<html><body><img src="cat.png"></body></html>`,
+		"game.wasm":  "\x00asm",
+		"cat.png":    bigger,
+	})
+
+	posts := []string{"responsive", "copy", "scripted", "inline-script", "wasm"}
+	result, err := DedupPostAssets(outDir, posts, filepath.Join(dir, "assets"), filepath.Join(dir, "staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responsive := result.Posts[0]
+	if len(responsive) != 2 {
+		t.Fatalf("responsive post deduped %+v", responsive)
+	}
+	for _, asset := range responsive {
+		if !asset.Removed {
+			t.Errorf("%s wasn't removed: %+v", asset.File, asset)
+		}
+	}
+	index, err := os.ReadFile(filepath.Join(outDir, "responsive", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, local := range []string{`"cat.png"`, `"cat.480w.png`, ` cat.png 960w`} {
+		if bytes.Contains(index, []byte(local)) {
+			t.Errorf("html still refers to %s:\n%s", local, index)
+		}
+	}
+	if !bytes.Contains(index, []byte(`srcset="`+SharedAssetsURL)) || !bytes.Contains(index, []byte(`.png 960w"`)) {
+		t.Errorf("srcset wasn't rewritten:\n%s", index)
+	}
+
+	for i, post := range posts[2:] {
+		deduped := result.Posts[i+2]
+		if len(deduped) != 1 || deduped[0].Removed || !deduped[0].HardLinked || deduped[0].RewrittenRefs != 1 {
+			t.Errorf("%s deduped %+v, want hard link", post, deduped)
+		}
+		if _, err := os.Stat(filepath.Join(outDir, post, "cat.png")); err != nil {
+			t.Errorf("%s: %v", post, err)
+		}
+	}
+}
+
+func TestPublishRollbackPrune(t *testing.T) {
+	_, outDir := setupCompile(t)
+
+	savedKeepBuilds := KeepBuilds
+	t.Cleanup(func() { KeepBuilds = savedKeepBuilds })
+	KeepBuilds = 2
+
+	writeOutput := func(dir string, version string) {
+		t.Helper()
+		writePost(t, dir, "post", map[string]string{"index.html": version})
+	}
+	readOutput := func() string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(outDir, "post", "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	publish := func(version string) BuildInfo {
+		t.Helper()
+
+		tmpOutDir, err := os.MkdirTemp(filepath.Dir(outDir), "out_tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeOutput(tmpOutDir, version)
+
+		postList := model.PostList{Posts: []model.Post{{Name: version, Dir: "post"}}}
+		info, err := PublishBuild(tmpOutDir, "", outDir, postList, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(tmpOutDir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("publish left %s behind: %v", tmpOutDir, err)
+		}
+		return info
+	}
+	buildIDs := func() []string {
+		t.Helper()
+
+		builds, err := ListBuilds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, build := range builds {
+			ids = append(ids, build.ID)
+		}
+		return ids
+	}
+
+	// output from before builds were kept gets a record of its own
+	writeOutput(outDir, "v0")
+
+	first := publish("v1")
+	if got := readOutput(); got != "v1" {
+		t.Fatalf("live output is %s after publishing v1", got)
+	}
+	unknownID := newBuildID(time.Unix(0, 0))
+	if ids := buildIDs(); !slices.Equal(ids, []string{first.ID, unknownID}) {
+		t.Fatalf("builds are %v, want %s and %s", ids, first.ID, unknownID)
+	}
+
+	second := publish("v2")
+	third := publish("v3")
+
+	// live one and KeepBuilds more are kept, newest first
+	if ids := buildIDs(); !slices.Equal(ids, []string{third.ID, second.ID, first.ID}) {
+		t.Fatalf("builds are %v after pruning", ids)
+	}
+	if _, err := os.Stat(defaultBuildStore().dir(unknownID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pruned build is still there: %v", err)
+	}
+
+	rolledBack, postList, err := RollbackBuild(first.ID, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rolledBack.Live || rolledBack.ID != first.ID {
+		t.Errorf("rolled back to %+v", rolledBack)
+	}
+	if got := readOutput(); got != "v1" {
+		t.Errorf("live output is %s after rolling back to v1", got)
+	}
+	if len(postList.Posts) != 1 || postList.Posts[0].Name != "v1" {
+		t.Errorf("rolled back post list is %+v", postList.Posts)
+	}
+	saved, err := postlist.LoadPostList(postlist.PostListPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Posts) != 1 || saved.Posts[0].Name != "v1" {
+		t.Errorf("saved post list is %+v", saved.Posts)
+	}
+
+	// what was live can be rolled forward to
+	kept, err := os.ReadFile(filepath.Join(defaultBuildStore().dir(third.ID), buildOutputDirName, "post", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kept) != "v3" {
+		t.Errorf("kept output of %s is %s", third.ID, kept)
+	}
+
+	builds, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, build := range builds {
+		if build.Live != (build.ID == first.ID) {
+			t.Errorf("build %s live is %v", build.ID, build.Live)
+		}
+	}
+
+	if _, _, err := RollbackBuild(first.ID, outDir); err == nil {
+		t.Error("rolled back to live build")
+	}
+	if _, _, err := RollbackBuild("20000101-000000.000", outDir); err == nil {
+		t.Error("rolled back to build that doesn't exist")
+	}
+	if got := readOutput(); got != "v1" {
+		t.Errorf("live output is %s after failed rollbacks", got)
+	}
+}
+
+// relative path of every file in dir to its size and modification time
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	snapshot := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		snapshot[relPath] = fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestCheckBuild(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	savedOptimize := OptimizeImages
+	t.Cleanup(func() { OptimizeImages = savedOptimize })
+	OptimizeImages = true
+
+	ImageCachePath = filepath.Join(t.TempDir(), "images")
+	OptimizedImageCachePath = filepath.Join(t.TempDir(), "optimized")
+
+	// wide enough to get responsive variants
+	var wide bytes.Buffer
+	if err := png.Encode(&wide, testImage(640, 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	writePost(t, postRoot, "post", map[string]string{
+		"index.md": "# Checked\n\nagain\n\n![wide](wide.png)\n",
+		"wide.png": wide.String(),
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err = CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postlist.SavePostList(postList, postlist.PostListPath); err != nil {
+		t.Fatal(err)
+	}
+
+	buildsBefore, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stampsBefore, err := os.ReadFile(SourceStampsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assetsPath, buildsPath := SharedAssetsPath, BuildsPath
+
+	imageCacheBefore := snapshotDir(t, ImageCachePath)
+	optimizedCacheBefore := snapshotDir(t, OptimizedImageCachePath)
+	if len(imageCacheBefore) == 0 || len(optimizedCacheBefore) == 0 {
+		t.Fatalf("build didn't use caches: %v %v", imageCacheBefore, optimizedCacheBefore)
+	}
+
+	// check shouldn't find anything in real caches to begin with
+	if err := os.Rename(ImageCachePath, ImageCachePath+"_moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(OptimizedImageCachePath, OptimizedImageCachePath+"_moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := CheckBuild(postRoot, postlist.PostListPath, outDir, SharedAssetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("fresh output differs: %+v", diffs)
+	}
+
+	// check leaves real builds alone
+	if SharedAssetsPath != assetsPath || BuildsPath != buildsPath {
+		t.Errorf("check changed paths to %s and %s", SharedAssetsPath, BuildsPath)
+	}
+	buildsAfter, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(buildsBefore, buildsAfter, func(a, b BuildInfo) bool { return a.ID == b.ID }) {
+		t.Errorf("builds went from %+v to %+v", buildsBefore, buildsAfter)
+	}
+	stampsAfter, err := os.ReadFile(SourceStampsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stampsBefore, stampsAfter) {
+		t.Error("check saved source stamps")
+	}
+
+	// check leaves real caches alone
+	for _, cachePath := range []string{ImageCachePath, OptimizedImageCachePath} {
+		if _, err := os.Stat(cachePath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("check wrote to %s", cachePath)
+		}
+		if err := os.Rename(cachePath+"_moved", cachePath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := CheckBuild(postRoot, postlist.PostListPath, outDir, SharedAssetsPath); err != nil {
+		t.Fatal(err)
+	}
+	if imageCacheAfter := snapshotDir(t, ImageCachePath); !maps.Equal(imageCacheBefore, imageCacheAfter) {
+		t.Errorf("check changed image cache from %v to %v", imageCacheBefore, imageCacheAfter)
+	}
+	if optimizedCacheAfter := snapshotDir(t, OptimizedImageCachePath); !maps.Equal(optimizedCacheBefore, optimizedCacheAfter) {
+		t.Errorf("check changed optimized image cache from %v to %v", optimizedCacheBefore, optimizedCacheAfter)
+	}
+
+	indexPath := filepath.Join(outDir, "post", "index.html")
+	if err := os.WriteFile(indexPath, []byte("edited by hand"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = CheckBuild(postRoot, postlist.PostListPath, outDir, SharedAssetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].File != "posts/post/index.html" {
+		t.Errorf("edited output gives %+v", diffs)
+	}
+}
+
+// ======================
+// optimize
+// ======================
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 5), uint8((x ^ y) * 3), 0xff})
+		}
+	}
+	return img
+}
+
+func encodeJpeg(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// inserts segment right after start of image
+func insertJpegSegment(data []byte, marker byte, segment []byte) []byte {
+	out := bytes.Clone(data[:2])
+	out = append(out, 0xff, marker)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func decodedPixelsEqual(t *testing.T, a []byte, b []byte) bool {
+	t.Helper()
+
+	aImg, _, err := image.Decode(bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bImg, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aImg.Bounds() != bImg.Bounds() {
+		return false
+	}
+	bounds := aImg.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if aImg.At(x, y) != bImg.At(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestOptimizeJpeg(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 37, 29))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 13)
+	}
+
+	inputs := map[string][]byte{
+		"color": encodeJpeg(t, testImage(61, 47)),
+		"gray":  encodeJpeg(t, gray),
+	}
+
+	samples, err := filepath.Glob(filepath.Join("..", "test", "posts", "*", "*.jp*g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range samples {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[filepath.ToSlash(sample)] = data
+	}
+
+	optimizedAny := false
+
+	for name, data := range inputs {
+		optimized, err := optimizeJpeg(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		// samples can be progressive
+		if optimized == nil {
+			if !strings.HasPrefix(name, "..") {
+				t.Errorf("%s: didn't get optimized", name)
+			}
+			continue
+		}
+		optimizedAny = true
+
+		if !decodedPixelsEqual(t, data, optimized) {
+			t.Errorf("%s: pixels changed", name)
+		}
+		if len(optimized) > len(data) {
+			t.Errorf("%s: got bigger, %d to %d bytes", name, len(data), len(optimized))
+		}
+
+		// optimal tables are optimal already
+		again, err := optimizeJpeg(optimized)
+		if err != nil {
+			t.Fatalf("%s: optimizing again: %v", name, err)
+		}
+		if len(again) != len(optimized) {
+			t.Errorf("%s: optimizing again went from %d to %d bytes", name, len(optimized), len(again))
+		}
+	}
+
+	if len(samples) > 0 && !optimizedAny {
+		t.Error("no sample got optimized")
+	}
+}
+
+func TestOptimizeJpegSkips(t *testing.T) {
+	data := encodeJpeg(t, testImage(64, 48))
+
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	if sof < 0 {
+		t.Fatal("go didn't write a baseline jpeg")
+	}
+	progressive := bytes.Clone(data)
+	progressive[sof+1] = 0xc2
+
+	// frame header with a fourth component
+	sofLength := int(binary.BigEndian.Uint16(data[sof+2:]))
+	cmyk := bytes.Clone(data[:sof])
+	cmyk = append(cmyk, 0xff, 0xc0)
+	cmyk = binary.BigEndian.AppendUint16(cmyk, uint16(sofLength+3))
+	cmyk = append(cmyk, data[sof+4:sof+9]...)
+	cmyk = append(cmyk, 4)
+	cmyk = append(cmyk, data[sof+10:sof+2+sofLength]...)
+	cmyk = append(cmyk, 4, 0x11, 0)
+	cmyk = append(cmyk, data[sof+2+sofLength:]...)
+
+	// interval is longer than the image so it's still a valid jpeg
+	restart := insertJpegSegment(data, 0xdd, []byte{0x01, 0x00})
+	if _, err := jpeg.Decode(bytes.NewReader(restart)); err != nil {
+		t.Fatal(err)
+	}
+
+	adobe := insertJpegSegment(data, 0xee, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+	if _, err := jpeg.Decode(bytes.NewReader(adobe)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, input := range map[string][]byte{
+		"progressive": progressive,
+		"cmyk":        cmyk,
+		"restart":     restart,
+		"adobe":       adobe,
+	} {
+		optimized, err := optimizeJpeg(input)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if optimized != nil {
+			t.Errorf("%s: got optimized", name)
+		}
+	}
+
+	// truncated files can fail, but mustn't give anything back
+	for _, length := range []int{sof + 2, len(data) / 2, len(data) - 2} {
+		optimized, _ := optimizeJpeg(data[:length])
+		if optimized != nil {
+			t.Errorf("jpeg cut at %d of %d got optimized", length, len(data))
+		}
+	}
+}
+
+func TestOptimizePng(t *testing.T) {
+	img := testImage(53, 41)
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// split image data in two and put a chunk in front of it
+	iend := bytes.Index(data, []byte("IEND")) - 4
+	idatStart := bytes.Index(data, []byte("IDAT")) - 4
+	idatLength := int(binary.BigEndian.Uint32(data[idatStart:]))
+	idat := data[idatStart+8 : idatStart+8+idatLength]
+
+	split := bytes.Clone(data[:idatStart])
+	split = appendPngChunk(split, "tEXt", []byte("Comment\x00kept"))
+	split = appendPngChunk(split, "IDAT", idat[:idatLength/2])
+	split = appendPngChunk(split, "IDAT", idat[idatLength/2:])
+	split = append(split, data[iend:]...)
+
+	optimized, err := optimizePng(split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(optimized) >= len(split) {
+		t.Errorf("didn't get smaller, %d to %d bytes", len(split), len(optimized))
+	}
+	if !decodedPixelsEqual(t, split, optimized) {
+		t.Error("pixels changed")
+	}
+	if got := bytes.Count(optimized, []byte("IDAT")); got != 1 {
+		t.Errorf("optimized png has %d IDAT chunks", got)
+	}
+	if !bytes.Contains(optimized, []byte("Comment\x00kept")) {
+		t.Error("other chunks got dropped")
+	}
+
+	for _, length := range []int{idatStart + 4, iend - 10} {
+		if optimized, _ := optimizePng(split[:length]); optimized != nil {
+			t.Errorf("png cut at %d of %d got optimized", length, len(split))
+		}
+	}
+}
+
+func TestOptimizeImagesInDir(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(t.TempDir(), "optimized")
+
+	data := encodeJpeg(t, testImage(64, 48))
+	truncated := data[:len(data)/2]
+
+	writePost(t, dir, "post", map[string]string{
+		"photo.jpg":  string(data),
+		"broken.jpg": string(truncated),
+		"notes.txt":  "not an image",
+	})
+
+	for range 2 {
+		optimized, err := OptimizeImagesInDir(dir, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(optimized) != 1 || optimized[0].File != "post/photo.jpg" || optimized[0].Before != len(data) {
+			t.Fatalf("optimized %+v", optimized)
+		}
+
+		// second time it comes from cache
+		if err := os.WriteFile(filepath.Join(dir, "post", "photo.jpg"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broken, err := os.ReadFile(filepath.Join(dir, "post", "broken.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(broken, truncated) {
+		t.Error("truncated jpeg got replaced")
+	}
+
+	cached, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 {
+		t.Errorf("cache has %d entries, want 1", len(cached))
+	}
+}
+
+// ======================
+// metadata
+// ======================
+
+// tiff structure with orientation and camera make
+func richExif(orientation int) []byte {
+	var tiff []byte
+
+	tiff = append(tiff, "II"...)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 42)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x010f) // make
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)      // ASCII
+	tiff = binary.LittleEndian.AppendUint32(tiff, 4)
+	tiff = append(tiff, "Cam\x00"...)
+
+	tiff = binary.LittleEndian.AppendUint16(tiff, util.ExifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0)
+
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+
+	return append(tiff, "serial number 1234"...)
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	plain := encodeJpeg(t, testImage(40, 30))
+
+	iccProfile := append(slices.Clone(jpegICCProfilePrefix), "\x01\x01profile"...)
+
+	withMetadata := func(orientation int) []byte {
+		// inserted right after start, so last one ends up first
+		data := insertJpegSegment(plain, 0xfe, []byte("taken by me"))
+		data = insertJpegSegment(data, 0xed, append(slices.Clone(jpegPhotoshopPrefix), "8BIM iptc"...))
+		data = insertJpegSegment(data, 0xe2, iccProfile)
+		data = insertJpegSegment(data, 0xe1, append(slices.Clone(jpegXmpPrefix), "<x:xmpmeta/>"...))
+		return insertJpegSegment(data, 0xe1, append(slices.Clone(jpegExifPrefix), richExif(orientation)...))
+	}
+
+	data := withMetadata(6)
+
+	stripped, kinds, err := StripImageMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"EXIF", "XMP", "IPTC", "comment"}; !slices.Equal(kinds, want) {
+		t.Errorf("stripped %v, want %v", kinds, want)
+	}
+	for _, gone := range []string{"Cam", "serial number", "xmpmeta", "8BIM", "taken by me"} {
+		if bytes.Contains(stripped, []byte(gone)) {
+			t.Errorf("%q is still there", gone)
+		}
+	}
+	if !bytes.Contains(stripped, iccProfile) {
+		t.Error("color profile got stripped")
+	}
+	if !decodedPixelsEqual(t, data, stripped) {
+		t.Error("pixels changed")
+	}
+
+	// orientation is all that's left of EXIF
+	if got := util.ImageOrientation(stripped); got != 6 {
+		t.Errorf("orientation is %d after stripping, want 6", got)
+	}
+	exif := append(slices.Clone(jpegExifPrefix), minimalExif(6)...)
+	if !bytes.Contains(stripped, exif) {
+		t.Error("stripped jpeg doesn't have minimal EXIF")
+	}
+
+	// upright images don't need it
+	stripped, _, err = StripImageMetadata(withMetadata(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, jpegExifPrefix) {
+		t.Error("EXIF of upright image was kept")
+	}
+
+	stripped, kinds, err = StripImageMetadata(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds != nil || !bytes.Equal(stripped, plain) {
+		t.Errorf("jpeg without metadata changed, stripped %v", kinds)
+	}
+
+	if _, _, err := StripImageMetadata(data[:len(data)/4]); err == nil {
+		t.Error("truncated jpeg didn't fail")
+	}
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(20, 10)); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// metadata goes right after IHDR
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	data := bytes.Clone(plain[:ihdrEnd])
+	data = appendPngChunk(data, "tEXt", []byte("Author\x00me"))
+	data = appendPngChunk(data, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	data = appendPngChunk(data, "tIME", []byte{0x07, 0xe9, 1, 2, 3, 4, 5})
+	data = appendPngChunk(data, "eXIf", richExif(8))
+	data = append(data, plain[ihdrEnd:]...)
+
+	stripped, kinds, err := StripImageMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"text", "XMP", "time", "EXIF"}; !slices.Equal(kinds, want) {
+		t.Errorf("stripped %v, want %v", kinds, want)
+	}
+	for _, gone := range []string{"Author", "xmpmeta", "tIME", "Cam", "serial number"} {
+		if bytes.Contains(stripped, []byte(gone)) {
+			t.Errorf("%q is still there", gone)
+		}
+	}
+	if !decodedPixelsEqual(t, data, stripped) {
+		t.Error("pixels changed")
+	}
+	if got := util.ImageOrientation(stripped); got != 8 {
+		t.Errorf("orientation is %d after stripping, want 8", got)
+	}
+
+	stripped, kinds, err = StripImageMetadata(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds != nil || !bytes.Equal(stripped, plain) {
+		t.Errorf("png without metadata changed, stripped %v", kinds)
+	}
+}
+
+func TestCompileBlogStripsMetadata(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	photo := insertJpegSegment(
+		encodeJpeg(t, testImage(40, 30)), 0xe1, append(slices.Clone(jpegExifPrefix), richExif(3)...),
+	)
+
+	for _, dir := range []string{"stripped", "kept"} {
+		writePost(t, postRoot, dir, map[string]string{
+			"index.html": `<html><head></head><body><img src="photo.jpg"></body></html>`,
+			"photo.jpg":  string(photo),
+		})
+	}
+	writePost(t, postRoot, "kept", map[string]string{
+		postlist.PostKeepMetadataFileName: "",
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, postReport := range report.Posts {
+		output, err := os.ReadFile(filepath.Join(outDir, postReport.Dir, "photo.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch postReport.Dir {
+		case "stripped":
+			if len(postReport.StrippedMetadata) != 1 || postReport.StrippedMetadata[0].File != "photo.jpg" {
+				t.Errorf("stripped %+v", postReport.StrippedMetadata)
+			}
+			if bytes.Contains(output, []byte("serial number")) || util.ImageOrientation(output) != 3 {
+				t.Error("output photo has metadata or lost orientation")
+			}
+		case "kept":
+			if len(postReport.StrippedMetadata) != 0 || !bytes.Equal(output, photo) {
+				t.Errorf("post with %s got stripped", postlist.PostKeepMetadataFileName)
+			}
+		}
+	}
+}
+
+// ======================
+// size budget
+// ======================
+
+func TestSizeBudgetCheck(t *testing.T) {
+	budgetPath := filepath.Join(t.TempDir(), "size-budget.json")
+	if err := os.WriteFile(budgetPath, []byte(`{
+		"Site": {"Warn": "5 KB"},
+		"Post": {"Max": 2000},
+		"Posts": {"big": {"Warn": "4KB", "Max": "10 KB"}}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	budget, err := LoadSizeBudget(budgetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := SizeReport{
+		Total: 7000,
+		Posts: []PostSizeReport{
+			{Name: "Small", Dir: "small", Total: 1000},
+			{Name: "Big", Dir: "big", Total: 6000},
+		},
+	}
+
+	diagnostics := budget.Check(&report)
+	if len(diagnostics) != 2 || len(report.Warnings) != 2 || len(report.Failures) != 0 {
+		t.Fatalf("got %+v", diagnostics)
+	}
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Code != DiagnosticSizeBudget || diagnostic.Severity != SeverityWarning {
+			t.Errorf("diagnostic %+v", diagnostic)
+		}
+	}
+	if diagnostics[0].Dir != "" || diagnostics[1].Dir != "big" {
+		t.Errorf("site and big post should warn, got %+v", diagnostics)
+	}
+
+	// posts without their own budget get Post
+	report.Posts[0].Total = 3000
+	report.Posts[1].Total = 12000
+
+	diagnostics = budget.Check(&report)
+	if len(report.Failures) != 2 || len(report.Warnings) != 1 {
+		t.Fatalf("failures %v, warnings %v", report.Failures, report.Warnings)
+	}
+	for _, diagnostic := range diagnostics[1:] {
+		if diagnostic.Severity != SeverityError {
+			t.Errorf("over max gives %+v", diagnostic)
+		}
+	}
+
+	// no file, no budget
+	budget, err = LoadSizeBudget(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := budget.Check(&report); len(diagnostics) != 0 || report.Failures != nil {
+		t.Errorf("empty budget gives %+v", diagnostics)
+	}
+
+	if err := os.WriteFile(budgetPath, []byte(`{"Post": {"Max": "lots"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSizeBudget(budgetPath); err == nil {
+		t.Error("broken budget loaded")
+	}
+}
+
+func TestCompileBlogSizeBudget(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	writePost(t, postRoot, "post", map[string]string{
+		"index.html": "<html><head></head><body>small</body></html>",
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SizeBudgetPath = filepath.Join(t.TempDir(), "size-budget.json")
+	writeBudget := func(budget string) {
+		t.Helper()
+		if err := os.WriteFile(SizeBudgetPath, []byte(budget), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// warnings don't stop the build
+	writeBudget(`{"Post": {"Warn": 1}}`)
+
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sizes.Warnings) != 1 || report.Sizes.Posts[0].Total == 0 {
+		t.Errorf("sizes are %+v", report.Sizes)
+	}
+	if !slices.ContainsFunc(report.Diagnostics, func(d Diagnostic) bool {
+		return d.Code == DiagnosticSizeBudget && d.Severity == SeverityWarning && d.Dir == "post"
+	}) {
+		t.Errorf("no warning in %+v", report.Diagnostics)
+	}
+	live := report.Build.ID
+
+	// going over max keeps what's live
+	writePost(t, postRoot, "post", map[string]string{
+		"index.html": "<html><head></head><body>" + strings.Repeat("big ", 1000) + "</body></html>",
+	})
+	writeBudget(`{"Post": {"Max": "2 KiB"}}`)
+
+	_, report, err = CompileBlog(postRoot, postList, outDir)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("build over budget gave %v", err)
+	}
+	if len(report.Sizes.Failures) != 1 {
+		t.Errorf("failures are %v", report.Sizes.Failures)
+	}
+	if !slices.ContainsFunc(buildErr.Diagnostics, func(d Diagnostic) bool {
+		return d.Code == DiagnosticSizeBudget && d.Severity == SeverityError
+	}) {
+		t.Errorf("no size budget error in %+v", buildErr.Diagnostics)
+	}
+
+	index, err := os.ReadFile(filepath.Join(outDir, "post", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(index, []byte("big")) {
+		t.Error("build over budget got published")
+	}
+	builds, err := ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].ID != live {
+		t.Errorf("builds are %+v, want just %s", builds, live)
+	}
+}
+
+func TestCompileBlogKeepFailedPosts(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	savedKeep := KeepFailedPosts
+	t.Cleanup(func() { KeepFailedPosts = savedKeep })
+	KeepFailedPosts = true
+
+	writePost(t, postRoot, "stable", map[string]string{
+		"index.md": "# stable\n",
+	})
+	writePost(t, postRoot, "flaky", map[string]string{
+		"index.md": "# flaky, first version\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Partial() {
+		t.Fatalf("first build is partial: %+v", report.Failed)
+	}
+	if err := postlist.SavePostList(compiled, postlist.PostListPath); err != nil {
+		t.Fatal(err)
+	}
+
+	flakyIndex := filepath.Join(outDir, "flaky", "index.html")
+	firstFlaky, err := os.ReadFile(flakyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// existing post breaks and a new one is broken from the start
+	writePost(t, postRoot, "flaky", map[string]string{
+		"index.md": "# flaky, second version\n\n![missing](missing.png)\n",
+	})
+	writePost(t, postRoot, "fresh", map[string]string{
+		"index.md": "# fresh\n\n![missing](missing.png)\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, _, err = postlist.GenerateUpdatedPostList(postRoot, compiled, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, report, err = CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatalf("failed posts failed the build: %v", err)
+	}
+
+	if !report.Partial() || len(report.Failed) != 2 {
+		t.Fatalf("failed posts are %+v", report.Failed)
+	}
+	for _, failed := range report.Failed {
+		switch failed.Dir {
+		case "flaky":
+			if !failed.KeptPrevious {
+				t.Errorf("flaky didn't keep previous output")
+			}
+		case "fresh":
+			if failed.KeptPrevious {
+				t.Errorf("fresh has previous output to keep")
+			}
+		default:
+			t.Errorf("%s failed", failed.Dir)
+		}
+		if failed.Error == "" {
+			t.Errorf("%s failed without error", failed.Dir)
+		}
+	}
+	if len(report.Diagnostics) != 2 {
+		t.Errorf("diagnostics are %v", report.Diagnostics)
+	}
+
+	var dirs []string
+	for _, post := range compiled.Posts {
+		dirs = append(dirs, post.Dir)
+	}
+	slices.Sort(dirs)
+	if !slices.Equal(dirs, []string{"flaky", "stable"}) {
+		t.Errorf("compiled posts are %v", dirs)
+	}
+
+	keptFlaky, err := os.ReadFile(flakyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keptFlaky, firstFlaky) {
+		t.Errorf("flaky output isn't the one from first build:\n%s", keptFlaky)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "fresh")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("fresh is in output")
+	}
+
+	// previous output comes from post list in options, not PostListPath
+	opts := defaultCompileOptions()
+	opts.builds.PostListPath = ""
+	compiled, report, err = compileBlog(postRoot, postList, outDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compiled.Posts) != 1 || compiled.Posts[0].Dir != "stable" || len(report.Failed) != 2 {
+		t.Errorf("without previous post list got %+v, failed %+v", compiled.Posts, report.Failed)
+	}
+
+	// without KeepFailedPosts nothing is published
+	KeepFailedPosts = false
+	if _, _, err := CompileBlog(postRoot, postList, outDir); err == nil {
+		t.Errorf("failed posts didn't fail the build")
+	}
+}
+
+func TestCompileBlogShareImage(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	img := testImage(40, 30)
+	encode := func(encoder func(io.Writer, image.Image) error) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := encoder(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	pngData := encode(png.Encode)
+	jpegData := encode(func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) })
+	gifData := encode(func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) })
+	bmpData := encode(bmp.Encode)
+	svgData := `<svg xmlns="http://www.w3.org/2000/svg" width="40" height="30"></svg>`
+
+	tests := []struct {
+		dir       string
+		thumbnail string
+		data      string
+		want      string
+	}{
+		{"no-thumbnail", "", "", ShareImageName},
+		{"svg", "post-thumbnail.svg", svgData, ShareImageName},
+		{"png", "post-thumbnail.png", pngData, "post-thumbnail.png"},
+		{"jpeg", "post-thumbnail.jpg", jpegData, "post-thumbnail.jpg"},
+		{"gif", "post-thumbnail.gif", gifData, ThumbnailRetinaName + ".jpg"},
+		{"bmp", "post-thumbnail.bmp", bmpData, ThumbnailRetinaName + ".jpg"},
+		// format comes from content, not name
+		{"misnamed", "post-thumbnail.png", gifData, ThumbnailRetinaName + ".jpg"},
+	}
+
+	for _, test := range tests {
+		files := map[string]string{"index.md": "# " + test.dir + "\n"}
+		if test.thumbnail != "" {
+			files[test.thumbnail] = test.data
+		}
+		writePost(t, postRoot, test.dir, files)
+	}
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, _, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		post := compiled.Posts[slices.IndexFunc(compiled.Posts, func(p model.Post) bool { return p.Dir == test.dir })]
+
+		if post.ShareImage != test.want {
+			t.Errorf("%s: share image is %s, want %s", test.dir, post.ShareImage, test.want)
+			continue
+		}
+
+		shareBytes, err := os.ReadFile(filepath.Join(outDir, test.dir, post.ShareImage))
+		if err != nil {
+			t.Errorf("%s: %v", test.dir, err)
+			continue
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(shareBytes))
+		if err != nil || (format != "jpeg" && format != "png") {
+			t.Errorf("%s: share image is %s: %v", test.dir, format, err)
+		}
+		if test.want == ShareImageName && (config.Width != ShareImageWidth || config.Height != ShareImageHeight) {
+			t.Errorf("%s: generated share image is %dx%d", test.dir, config.Width, config.Height)
+		}
+
+		index, err := os.ReadFile(filepath.Join(outDir, test.dir, "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(index, []byte(`property="og:image"`)) || !bytes.Contains(index, []byte(test.want)) {
+			t.Errorf("%s: og:image isn't %s:\n%s", test.dir, test.want, index)
+		}
+	}
+}
+
+func TestCompileBlogLeavesOutUnusedThumbnail(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	var gifBuf, pngBuf bytes.Buffer
+	if err := gif.Encode(&gifBuf, testImage(40, 30), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngBuf, testImage(40, 30)); err != nil {
+		t.Fatal(err)
+	}
+	svgData := `<svg xmlns="http://www.w3.org/2000/svg" width="40" height="30"></svg>`
+
+	tests := []struct {
+		dir       string
+		files     map[string]string
+		thumbnail string
+		leftOut   bool
+	}{
+		{"converted", map[string]string{"index.md": "# converted\n", "post-thumbnail.gif": gifBuf.String()}, "post-thumbnail.gif", true},
+		{"share-image", map[string]string{"index.md": "# share\n", "post-thumbnail.png": pngBuf.String()}, "post-thumbnail.png", false},
+		{"svg", map[string]string{"index.md": "# svg\n", "post-thumbnail.svg": svgData}, "post-thumbnail.svg", false},
+		{"referenced", map[string]string{
+			"index.html":         `<html><body><img src="post-thumbnail.gif"></body></html>`,
+			"post-thumbnail.gif": gifBuf.String(),
+		}, "post-thumbnail.gif", false},
+		{"derived", map[string]string{"index.md": "# derived\n\n![shot](shot.gif)\n", "shot.gif": gifBuf.String()}, "shot.gif", false},
+	}
+
+	for _, test := range tests {
+		writePost(t, postRoot, test.dir, test.files)
+	}
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		postReport := report.Posts[slices.IndexFunc(report.Posts, func(p PostBuildReport) bool { return p.Dir == test.dir })]
+
+		_, err := os.Stat(filepath.Join(outDir, test.dir, test.thumbnail))
+		if leftOut := errors.Is(err, os.ErrNotExist); leftOut != test.leftOut {
+			t.Errorf("%s: %s left out is %v, want %v", test.dir, test.thumbnail, leftOut, test.leftOut)
+		}
+
+		wantReport := ""
+		if test.leftOut {
+			wantReport = test.thumbnail
+		}
+		if postReport.LeftOutThumbnail != wantReport {
+			t.Errorf("%s: report says %q was left out", test.dir, postReport.LeftOutThumbnail)
+		}
+	}
+}
+
+func TestGenerateThumbnails(t *testing.T) {
+	postDir := t.TempDir()
+
+	// three quarters red, rest blue
+	opaque := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	for y := range 400 {
+		for x := range 800 {
+			c := color.NRGBA{0xe0, 0x10, 0x10, 0xff}
+			if x >= 600 {
+				c = color.NRGBA{0x10, 0x10, 0xe0, 0xff}
+			}
+			opaque.SetNRGBA(x, y, c)
+		}
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for i := range transparent.Pix {
+		transparent.Pix[i] = 0x80
+	}
+
+	for name, img := range map[string]image.Image{"opaque.png": opaque, "transparent.png": transparent} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(postDir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 300 100"></svg>`
+	if err := os.WriteFile(filepath.Join(postDir, "vector.svg"), []byte(svg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	decodeConfig := func(t *testing.T, data []byte) (image.Config, string) {
+		t.Helper()
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config, format
+	}
+
+	placeholderConfig := func(t *testing.T, placeholder string, mimeType string) image.Config {
+		t.Helper()
+		encoded, ok := strings.CutPrefix(placeholder, "data:"+mimeType+";base64,")
+		if !ok {
+			t.Fatalf("placeholder isn't %s data url: %.40s", mimeType, placeholder)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _ := decodeConfig(t, data)
+		return config
+	}
+
+	t.Run("opaque", func(t *testing.T) {
+		postOutDir := t.TempDir()
+
+		thumbnails, err := GenerateThumbnails(postDir, postOutDir, "opaque.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if thumbnails.Card != ThumbnailCardName+".jpg" || thumbnails.Retina != ThumbnailRetinaName+".jpg" {
+			t.Errorf("opaque thumbnails are %s and %s, want jpeg", thumbnails.Card, thumbnails.Retina)
+		}
+		if thumbnails.CardWidth != ThumbnailCardWidth || thumbnails.CardHeight != ThumbnailCardWidth/2 {
+			t.Errorf("card is %dx%d", thumbnails.CardWidth, thumbnails.CardHeight)
+		}
+		if thumbnails.RetinaWidth != ThumbnailRetinaWidth || thumbnails.RetinaHeight != ThumbnailRetinaWidth/2 {
+			t.Errorf("retina is %dx%d", thumbnails.RetinaWidth, thumbnails.RetinaHeight)
+		}
+		if thumbnails.AspectRatio != 2 {
+			t.Errorf("aspect ratio is %v, want 2", thumbnails.AspectRatio)
+		}
+		if thumbnails.DominantColor != "#e01010" {
+			t.Errorf("dominant color is %s, want #e01010", thumbnails.DominantColor)
+		}
+
+		cardBytes, err := os.ReadFile(filepath.Join(postOutDir, thumbnails.Card))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config, format := decodeConfig(t, cardBytes); format != "jpeg" || config.Width != thumbnails.CardWidth {
+			t.Errorf("card is %s %dx%d", format, config.Width, config.Height)
+		}
+
+		config := placeholderConfig(t, thumbnails.Placeholder, "image/jpeg")
+		if config.Width != 16 || config.Height != 8 {
+			t.Errorf("placeholder is %dx%d, want 16x8", config.Width, config.Height)
+		}
+	})
+
+	t.Run("transparent", func(t *testing.T) {
+		postOutDir := t.TempDir()
+
+		thumbnails, err := GenerateThumbnails(postDir, postOutDir, "transparent.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if thumbnails.Card != ThumbnailCardName+".png" || thumbnails.Retina != ThumbnailRetinaName+".png" {
+			t.Errorf("transparent thumbnails are %s and %s, want png", thumbnails.Card, thumbnails.Retina)
+		}
+		// small images aren't scaled up
+		if thumbnails.CardWidth != 100 || thumbnails.RetinaWidth != 100 {
+			t.Errorf("card is %d wide and retina %d, want 100", thumbnails.CardWidth, thumbnails.RetinaWidth)
+		}
+		placeholderConfig(t, thumbnails.Placeholder, "image/png")
+	})
+
+	t.Run("svg", func(t *testing.T) {
+		postOutDir := t.TempDir()
+
+		thumbnails, err := GenerateThumbnails(postDir, postOutDir, "vector.svg")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if thumbnails.Card != "vector.svg" || thumbnails.Retina != "vector.svg" {
+			t.Errorf("svg thumbnails are %s and %s", thumbnails.Card, thumbnails.Retina)
+		}
+		if thumbnails.Width != 300 || thumbnails.Height != 100 || thumbnails.AspectRatio != 3 {
+			t.Errorf("svg is %dx%d with aspect ratio %v", thumbnails.Width, thumbnails.Height, thumbnails.AspectRatio)
+		}
+		if thumbnails.Placeholder != "" || thumbnails.DominantColor != "" {
+			t.Errorf("svg has placeholder %q and dominant color %q", thumbnails.Placeholder, thumbnails.DominantColor)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(postDir, "corrupt.png"), pngSignature, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GenerateThumbnails(postDir, t.TempDir(), "corrupt.png"); err == nil {
+			t.Error("corrupt thumbnail should fail")
+		}
+	})
+}
+
+func TestCompileBlogReusesPreviousBuild(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	savedLinkMode := PreviousBuildLinkMode
+	t.Cleanup(func() { PreviousBuildLinkMode = savedLinkMode })
+	PreviousBuildLinkMode = util.LinkModeHard
+
+	// files are only reused without hooks
+	buildHooksMu.Lock()
+	savedHooks := buildHooks
+	buildHooks = nil
+	buildHooksMu.Unlock()
+	t.Cleanup(func() {
+		buildHooksMu.Lock()
+		buildHooks = savedHooks
+		buildHooksMu.Unlock()
+	})
+
+	writePost(t, postRoot, "post", map[string]string{
+		"index.html":  "<html><body>hi</body></html>",
+		"same.bin":    "same every build",
+		"changed.bin": "first build",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postList, report, err := CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Posts[0].LinkedFiles != 0 {
+		t.Errorf("first build linked %d files", report.Posts[0].LinkedFiles)
+	}
+	firstID := report.Build.ID
+
+	// same size, so only stamps tell it changed
+	writePost(t, postRoot, "post", map[string]string{
+		"changed.bin": "later build",
+	})
+
+	_, report, err = CompileBlog(postRoot, postList, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// index.html gets share metadata so it's written every time
+	if report.Posts[0].LinkedFiles != 1 {
+		t.Errorf("second build linked %d files, want 1", report.Posts[0].LinkedFiles)
+	}
+
+	keptDir := filepath.Join(BuildsPath, firstID, buildOutputDirName, "post")
+	for name, wantSame := range map[string]bool{"same.bin": true, "changed.bin": false} {
+		live, err := os.Stat(filepath.Join(outDir, "post", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept, err := os.Stat(filepath.Join(keptDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(live, kept) != wantSame {
+			t.Errorf("%s linked from previous build is %v, want %v", name, !wantSame, wantSame)
+		}
+	}
+
+	changed, err := os.ReadFile(filepath.Join(outDir, "post", "changed.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(changed) != "later build" {
+		t.Errorf("changed.bin is %q", changed)
+	}
+}
+
+func TestCompileBlogCollectsDiagnostics(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	writePost(t, postRoot, "good", map[string]string{
+		"index.md": "# fine\n",
+	})
+	writePost(t, postRoot, "markdown", map[string]string{
+		"index.md": "# two problems\n\n![missing](missing.png)\n\n<gallery>\n",
+	})
+	writePost(t, postRoot, "thumbnail", map[string]string{
+		"index.md":           "# corrupt thumbnail\n",
+		"post-thumbnail.png": "not a png",
+	})
+	writePost(t, postRoot, "ignore", map[string]string{
+		"index.md": "# bad postignore\n",
+	})
+
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// broken after scanning, scan would fail on it too
+	writePost(t, postRoot, "ignore", map[string]string{
+		postlist.PostIgnoreFileName: "[\n",
+	})
+
+	_, report, err := CompileBlog(postRoot, postList, outDir)
+
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("want *BuildError, got %v", err)
+	}
+	if !slices.Equal(CollectDiagnostics(err), report.Diagnostics) {
+		t.Errorf("error has %v, report has %v", CollectDiagnostics(err), report.Diagnostics)
+	}
+
+	type where struct {
+		Dir  string
+		File string
+		Line int
+		Code string
+	}
+	var got []where
+	for _, diagnostic := range report.Diagnostics {
+		if diagnostic.Severity != SeverityError || diagnostic.Message == "" {
+			t.Errorf("diagnostic %+v", diagnostic)
+		}
+		got = append(got, where{diagnostic.Dir, diagnostic.File, diagnostic.Line, diagnostic.Code})
+	}
+	slices.SortFunc(got, func(a, b where) int {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+
+	want := []where{
+		{"ignore", postlist.PostIgnoreFileName, 0, DiagnosticPostIgnore},
+		{"markdown", "index.md", 3, DiagnosticMarkdown},
+		{"markdown", "index.md", 5, DiagnosticMarkdown},
+		{"thumbnail", "post-thumbnail.png", 0, DiagnosticThumbnail},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("diagnostics are\n%v\nwant\n%v", got, want)
+	}
+
+	for _, diagnostic := range report.Diagnostics {
+		if !strings.Contains(err.Error(), diagnostic.String()) {
+			t.Errorf("error doesn't say %s:\n%v", diagnostic, err)
+		}
+	}
+}
+
+func TestPostDiagnostics(t *testing.T) {
+	post := model.Post{Dir: "post"}
+
+	plain := PostDiagnostics(post, errors.New("something broke"))
+	if len(plain) != 1 || plain[0].Code != DiagnosticCompile || plain[0].File != "" || plain[0].Message != "something broke" {
+		t.Errorf("plain error gives %+v", plain)
+	}
+
+	wrapped := PostDiagnostics(post, fmt.Errorf("wrapped: %w", withDiagnostic(DiagnosticImage, "cat.png", errors.New("too big"))))
+	if len(wrapped) != 1 || wrapped[0].Code != DiagnosticImage || wrapped[0].File != "cat.png" {
+		t.Errorf("wrapped error gives %+v", wrapped)
+	}
+	if got := wrapped[0].String(); !strings.Contains(got, "post/cat.png") || !strings.Contains(got, "too big") {
+		t.Errorf("diagnostic prints as %q", got)
+	}
+
+	if withDiagnostic(DiagnosticImage, "", nil) != nil {
+		t.Error("nil error got wrapped")
+	}
+
+	// warnings aren't errors
+	buildErr := &BuildError{Diagnostics: []Diagnostic{
+		{Dir: "post", Severity: SeverityWarning, Code: DiagnosticSizeBudget, Message: "a bit big"},
+		{Dir: "post", Severity: SeverityError, Code: DiagnosticCompile, Message: "broken"},
+	}}
+	if got := buildErr.Error(); strings.Contains(got, "a bit big") || !strings.Contains(got, "broken") {
+		t.Errorf("build error is %q", got)
+	}
+
+	// markdown errors outside of CompileBlog
+	_, err := markdown.ConvertMarkdown([]byte("text\n\n<gallery>\n"), "", nil)
+	diagnostics := CollectDiagnostics(err)
+	if len(diagnostics) != 1 || diagnostics[0].Line != 3 || diagnostics[0].Code != DiagnosticMarkdown {
+		t.Errorf("markdown error gives %+v", diagnostics)
+	}
+}
+
+// records the stages it ran in, fails in the one named by failIn
+type stageHook struct {
+	NopBuildHook
+	stages []string
+	failIn string
+}
+
+func (h *stageHook) Name() string {
+	return "stages"
+}
+
+func (h *stageHook) stage(stage string) error {
+	h.stages = append(h.stages, stage)
+	if stage == h.failIn {
+		return errors.New("failed on purpose")
+	}
+	return nil
+}
+
+func (h *stageHook) BeforeBuild(postRoot string, postList *model.PostList) error {
+	return h.stage(fmt.Sprintf("before build %d", len(postList.Posts)))
+}
+
+func (h *stageHook) TransformMarkdownHTML(post model.Post, htmlBytes []byte) ([]byte, error) {
+	return htmlBytes, h.stage("transform " + post.Dir)
+}
+
+func (h *stageHook) AfterPost(post *model.Post, postOutDir string) error {
+	if _, err := os.Stat(filepath.Join(postOutDir, "index.html")); err != nil {
+		return err
+	}
+	return h.stage("after post " + post.Dir)
+}
+
+func (h *stageHook) AfterBuild(postList model.PostList, outDir string) error {
+	if _, err := os.Stat(filepath.Join(outDir, "post", "index.html")); err != nil {
+		return err
+	}
+	return h.stage("after build")
+}
+
+func TestBuildHookStages(t *testing.T) {
+	postRoot, outDir := setupCompile(t)
+
+	// only this test's hook
+	buildHooksMu.Lock()
+	savedHooks := buildHooks
+	buildHooksMu.Unlock()
+	t.Cleanup(func() {
+		buildHooksMu.Lock()
+		buildHooks = savedHooks
+		buildHooksMu.Unlock()
+	})
+
+	writePost(t, postRoot, "post", map[string]string{
+		"index.md": "# staged\n",
+	})
+	if _, err := postlist.AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	postList, _, err := postlist.GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("order", func(t *testing.T) {
+		hook := &stageHook{}
+		buildHooksMu.Lock()
+		buildHooks = nil
+		buildHooksMu.Unlock()
+		RegisterBuildHook(hook, 0)
+
+		if _, _, err := CompileBlog(postRoot, postList, outDir); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"before build 1", "transform post", "after post post", "after build"}
+		if !slices.Equal(hook.stages, want) {
+			t.Errorf("stages are %q, want %q", hook.stages, want)
+		}
+	})
+
+	for _, failIn := range []string{"before build 1", "transform post", "after post post", "after build"} {
+		t.Run("fail in "+failIn, func(t *testing.T) {
+			hook := &stageHook{failIn: failIn}
+			buildHooksMu.Lock()
+			buildHooks = nil
+			buildHooksMu.Unlock()
+			RegisterBuildHook(hook, 0)
+
+			_, report, err := CompileBlog(postRoot, postList, outDir)
+			if err == nil {
+				t.Fatal("build didn't fail")
+			}
+			if hook.stages[len(hook.stages)-1] != failIn {
+				t.Errorf("kept going after failing: %q", hook.stages)
+			}
+			if !strings.Contains(err.Error(), "hook stages") || !strings.Contains(err.Error(), "failed on purpose") {
+				t.Errorf("error doesn't name the hook: %v", err)
+			}
+
+			// post stages fail the post, the others fail the whole build
+			diagnostics := CollectDiagnostics(err)
+			if strings.HasPrefix(failIn, "transform") || strings.HasPrefix(failIn, "after post") {
+				if len(diagnostics) != 1 || diagnostics[0].Code != DiagnosticHook || diagnostics[0].Dir != "post" {
+					t.Errorf("diagnostics are %+v", diagnostics)
+				}
+				if !slices.Equal(report.Diagnostics, diagnostics) {
+					t.Errorf("report has %+v", report.Diagnostics)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package compiler
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"blog/postlist"
+	"blog/util"
+)
+
+// how CompileBlog brings over files that didn't change since the previous build,
+// nothing is brought over while build hooks are registered
+var PreviousBuildLinkMode = util.LinkModeNone
+
+// copies files in postDir to outDir except ignored ones
+//
+// files that didn't change since they were copied to previousDir
+// are linked from there instead, see CopyFileReusing
+//
+// stamps remember what files in previousDir were copied from, it can be nil
+//
+// returns how many files got linked
+func CopyPostFiles(
+	postDir string,
+	outDir string,
+	previousDir string,
+	ignore postlist.PostIgnore,
+	stamps *SourceStamps,
+) (int, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return 0, err
+	}
+
+	linked := 0
+
+	err := postlist.WalkPostFiles(postDir, ignore, func(relPath string, d fs.DirEntry) error {
+		outPath := filepath.Join(outDir, filepath.FromSlash(relPath))
+
+		if d.IsDir() {
+			return os.MkdirAll(outPath, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		previousPath := ""
+		if previousDir != "" {
+			previousPath = filepath.Join(previousDir, filepath.FromSlash(relPath))
+		}
+
+		wasLinked, stamp, err := util.CopyFileReusing(
+			filepath.Join(postDir, filepath.FromSlash(relPath)), outPath,
+			previousPath, stamps.Previous(previousPath), PreviousBuildLinkMode,
+		)
+		if err != nil {
+			return err
+		}
+		if wasLinked {
+			linked++
+		}
+
+		// it will be where previousPath is once build is done
+		stamps.Record(previousPath, stamp)
+
+		return nil
+	})
+
+	return linked, err
+}
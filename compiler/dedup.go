@@ -0,0 +1,716 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"blog/util"
+)
+
+// dedup moves files out of posts so it's off by default
+var DedupAssets = false
+
+// files smaller than this are not worth sharing
+var DedupMinSize int64 = 16 * 1024
+
+// where SharedAssetsPath is served from
+const SharedAssetsURL = "/public/assets"
+
+// file in post output that's now shared with other posts
+type DedupedAsset struct {
+	// relative to post output directory
+	File string
+	Size int64
+
+	// url of the shared copy
+	SharedURL string
+
+	// references in html we pointed to the shared copy
+	RewrittenRefs int
+
+	// file got removed from post output
+	// because every reference to it was rewritten
+	Removed bool
+	// something we couldn't rewrite might refer to the file,
+	// or post has scripts that could make references at runtime,
+	// so it's left in post output as a hard link to the shared copy
+	HardLinked bool
+}
+
+type DedupResult struct {
+	// same order as post dirs we were given
+	Posts [][]DedupedAsset
+
+	// hash directories this build uses
+	Assets []string
+	// ones that were not in assets dir yet and got put in staging dir
+	Staged []string
+
+	Saved int64
+}
+
+// file types where we look for references we can't rewrite
+var dedupTextExts = []string{
+	".html", ".htm", ".css", ".js", ".mjs", ".json", ".svg", ".xml", ".txt", ".webmanifest",
+}
+
+type dedupFile struct {
+	Post int
+	File string
+	Size int64
+}
+
+// stores large files that are identical across posts once
+// in <hash>/ directory and points posts to it
+//
+// shared copies already in assetsDir are used as they are,
+// new ones go to stagingDir so that nothing is written to assetsDir
+// before build gets published, see PublishBuild
+func DedupPostAssets(outDir string, postDirs []string, assetsDir string, stagingDir string) (DedupResult, error) {
+	result := DedupResult{
+		Posts: make([][]DedupedAsset, len(postDirs)),
+	}
+
+	// ==========================
+	// find duplicates
+	// ==========================
+	groups := make(map[string][]dedupFile)
+	var hashes []string
+
+	for i, postDir := range postDirs {
+		postOutDir := filepath.Join(outDir, postDir)
+
+		err := filepath.WalkDir(postOutDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			// pages are not assets
+			switch util.ExtLowered(path) {
+			case ".html", ".htm":
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() < DedupMinSize {
+				return nil
+			}
+
+			hash, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(postOutDir, path)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := groups[hash]; !ok {
+				hashes = append(hashes, hash)
+			}
+			groups[hash] = append(groups[hash], dedupFile{
+				Post: i,
+				File: filepath.ToSlash(rel),
+				Size: info.Size(),
+			})
+
+			return nil
+		})
+		if err != nil {
+			return DedupResult{}, err
+		}
+	}
+
+	// ==========================
+	// store shared copies
+	// ==========================
+
+	// post -> file -> shared url
+	sharedURLs := make([]map[string]string, len(postDirs))
+	// shared url -> path of shared copy
+	sharedPaths := make(map[string]string)
+
+	for _, hash := range hashes {
+		group := groups[hash]
+
+		posts := make(map[int]bool)
+		for _, file := range group {
+			posts[file.Post] = true
+		}
+		if len(posts) < 2 {
+			continue
+		}
+
+		first := group[0]
+
+		// shared copy can be there under name some other post gave it
+		name, err := existingSharedName(filepath.Join(assetsDir, hash))
+		if err != nil {
+			return DedupResult{}, err
+		}
+		exists := name != ""
+		if !exists {
+			name = path.Base(first.File)
+		}
+
+		sharedPath := filepath.Join(assetsDir, hash, name)
+
+		if !exists {
+			sharedPath = filepath.Join(stagingDir, hash, name)
+
+			if err := os.MkdirAll(filepath.Dir(sharedPath), 0755); err != nil {
+				return DedupResult{}, err
+			}
+
+			src := filepath.Join(outDir, postDirs[first.Post], filepath.FromSlash(first.File))
+			if err := util.CopyFile(src, sharedPath); err != nil {
+				return DedupResult{}, err
+			}
+
+			result.Staged = append(result.Staged, hash)
+		}
+
+		result.Assets = append(result.Assets, hash)
+
+		sharedURL := (&url.URL{Path: path.Join(SharedAssetsURL, hash, name)}).EscapedPath()
+		sharedPaths[sharedURL] = sharedPath
+
+		for _, file := range group {
+			if sharedURLs[file.Post] == nil {
+				sharedURLs[file.Post] = make(map[string]string)
+			}
+			sharedURLs[file.Post][file.File] = sharedURL
+		}
+
+		// shared copy counts against what we save
+		result.Saved -= first.Size
+	}
+
+	// ==========================
+	// point posts to shared copies
+	// ==========================
+	for i, postDir := range postDirs {
+		if len(sharedURLs[i]) == 0 {
+			continue
+		}
+
+		postOutDir := filepath.Join(outDir, postDir)
+
+		occurrences, err := countFileNameOccurrences(postOutDir, sharedURLs[i])
+		if err != nil {
+			return DedupResult{}, err
+		}
+
+		rewritten, err := rewriteSharedRefs(postOutDir, sharedURLs[i])
+		if err != nil {
+			return DedupResult{}, err
+		}
+
+		// we can't see names scripts put together
+		hasScripts, err := postHasScripts(postOutDir)
+		if err != nil {
+			return DedupResult{}, err
+		}
+
+		files := make([]string, 0, len(sharedURLs[i]))
+		for file := range sharedURLs[i] {
+			files = append(files, file)
+		}
+		slices.Sort(files)
+
+		for _, file := range files {
+			sharedURL := sharedURLs[i][file]
+			filePath := filepath.Join(postOutDir, filepath.FromSlash(file))
+
+			info, err := os.Stat(filePath)
+			if err != nil {
+				return DedupResult{}, err
+			}
+
+			asset := DedupedAsset{
+				File:          file,
+				Size:          info.Size(),
+				SharedURL:     sharedURL,
+				RewrittenRefs: rewritten[file],
+			}
+
+			// every mention of the file was something we rewrote
+			if !hasScripts && rewritten[file] > 0 && occurrences[file] <= rewritten[file] {
+				if err := os.Remove(filePath); err != nil {
+					return DedupResult{}, err
+				}
+				asset.Removed = true
+				result.Saved += asset.Size
+			} else {
+				tmpPath := filePath + ".tmp"
+				if err := os.Link(sharedPaths[sharedURL], tmpPath); err != nil {
+					// probably on different file systems, just keep the copy
+					util.WarnLogger.Printf("can't hard link %s: %v", filePath, err)
+				} else {
+					if err := os.Rename(tmpPath, filePath); err != nil {
+						return DedupResult{}, err
+					}
+					asset.HardLinked = true
+					result.Saved += asset.Size
+				}
+			}
+
+			result.Posts[i] = append(result.Posts[i], asset)
+		}
+	}
+
+	return result, nil
+}
+
+// name of file in hash directory, empty if there is none
+func existingSharedName(hashDir string) (string, error) {
+	dirents, err := os.ReadDir(hashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, dirent := range dirents {
+		if dirent.Type().IsRegular() {
+			return dirent.Name(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// removes hash directories in assetsDir that are not in used
+func RemoveUnusedSharedAssets(assetsDir string, used []string) error {
+	dirents, err := os.ReadDir(assetsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dirent := range dirents {
+		// leave things we didn't make alone
+		if !dirent.IsDir() || !isSha256Hex(dirent.Name()) {
+			continue
+		}
+		if slices.Contains(used, dirent.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(assetsDir, dirent.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hash directories of shared files that text files in postOutDir refer to
+func FindSharedAssetRefs(postOutDir string) ([]string, error) {
+	var refs []string
+
+	prefix := []byte(SharedAssetsURL + "/")
+
+	err := filepath.WalkDir(postOutDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !slices.Contains(dedupTextExts, util.ExtLowered(p)) {
+			return nil
+		}
+
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		for {
+			index := bytes.Index(content, prefix)
+			if index < 0 {
+				break
+			}
+			content = content[index+len(prefix):]
+
+			if len(content) >= sha256.Size*2 && isSha256Hex(string(content[:sha256.Size*2])) {
+				hash := string(content[:sha256.Size*2])
+				if !slices.Contains(refs, hash) {
+					refs = append(refs, hash)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return refs, err
+}
+
+// hash directories in assetsDir
+func ListSharedAssets(assetsDir string) ([]string, error) {
+	dirents, err := os.ReadDir(assetsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var assets []string
+	for _, dirent := range dirents {
+		if dirent.IsDir() && isSha256Hex(dirent.Name()) {
+			assets = append(assets, dirent.Name())
+		}
+	}
+
+	return assets, nil
+}
+
+func isSha256Hex(str string) bool {
+	if len(str) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// counts how many times names of files show up in text files of a post
+//
+// it's a rough guess at how many things refer to them,
+// used to tell if we caught every reference
+func countFileNameOccurrences(postOutDir string, files map[string]string) (map[string]int, error) {
+	occurrences := make(map[string]int)
+
+	err := filepath.WalkDir(postOutDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !slices.Contains(dedupTextExts, util.ExtLowered(p)) {
+			return nil
+		}
+
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		for file := range files {
+			name := path.Base(file)
+			occurrences[file] += bytes.Count(content, []byte(name))
+			if escaped := url.PathEscape(name); escaped != name {
+				occurrences[file] += bytes.Count(content, []byte(escaped))
+			}
+		}
+
+		return nil
+	})
+
+	return occurrences, err
+}
+
+// files that can refer to other files in ways we can't see
+var dedupScriptExts = []string{".js", ".mjs", ".wasm"}
+
+// check if post output has scripts of its own,
+// either as files or inline in html
+//
+// site scripts from /public/ only look at what's in the page
+func postHasScripts(postOutDir string) (bool, error) {
+	hasScripts := false
+
+	err := filepath.WalkDir(postOutDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		ext := util.ExtLowered(p)
+		if slices.Contains(dedupScriptExts, ext) {
+			hasScripts = true
+			return filepath.SkipAll
+		}
+		if ext != ".html" && ext != ".htm" {
+			return nil
+		}
+
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		tokenizer := html.NewTokenizer(bytes.NewReader(content))
+		for {
+			tokenType := tokenizer.Next()
+			if tokenType == html.ErrorToken {
+				break
+			}
+			if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+				continue
+			}
+
+			token := tokenizer.Token()
+			if token.Data != "script" {
+				continue
+			}
+
+			src := ""
+			for _, attr := range token.Attr {
+				if attr.Key == "src" {
+					src = attr.Val
+				}
+			}
+			if !strings.HasPrefix(src, "/public/") {
+				hasScripts = true
+				return filepath.SkipAll
+			}
+		}
+
+		return nil
+	})
+
+	return hasScripts, err
+}
+
+// html attributes that refer to files
+var dedupRefAttrs = []string{"src", "href", "poster"}
+
+// html attributes that refer to files with a list of candidates
+// like "cat.480w.png 480w, cat.png 960w"
+var dedupSrcSetAttrs = []string{"srcset", "imagesrcset"}
+
+// points references in html files of a post to shared copies
+// returns how many references to each file got rewritten
+func rewriteSharedRefs(postOutDir string, sharedURLs map[string]string) (map[string]int, error) {
+	rewritten := make(map[string]int)
+
+	err := filepath.WalkDir(postOutDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		switch util.ExtLowered(p) {
+		case ".html", ".htm":
+		default:
+			return nil
+		}
+
+		rel, err := filepath.Rel(postOutDir, p)
+		if err != nil {
+			return err
+		}
+		htmlDir := path.Dir(filepath.ToSlash(rel))
+
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		var out bytes.Buffer
+		changed := false
+
+		tokenizer := html.NewTokenizer(bytes.NewReader(content))
+
+		for {
+			tokenType := tokenizer.Next()
+			if tokenType == html.ErrorToken {
+				if !errors.Is(tokenizer.Err(), io.EOF) {
+					return tokenizer.Err()
+				}
+				break
+			}
+
+			raw := tokenizer.Raw()
+
+			if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+				out.Write(raw)
+				continue
+			}
+
+			// Raw gets invalidated by Token
+			raw = bytes.Clone(raw)
+			token := tokenizer.Token()
+
+			tokenChanged := false
+			for i, attr := range token.Attr {
+				if slices.Contains(dedupSrcSetAttrs, attr.Key) {
+					val, files := rewriteSrcSet(htmlDir, attr.Val, sharedURLs)
+					if len(files) <= 0 {
+						continue
+					}
+
+					token.Attr[i].Val = val
+					for _, file := range files {
+						rewritten[file]++
+					}
+					tokenChanged = true
+					continue
+				}
+
+				if !slices.Contains(dedupRefAttrs, attr.Key) {
+					continue
+				}
+
+				file, suffix, ok := resolvePostRef(htmlDir, attr.Val)
+				if !ok {
+					continue
+				}
+				sharedURL, ok := sharedURLs[file]
+				if !ok {
+					continue
+				}
+
+				token.Attr[i].Val = sharedURL + suffix
+				rewritten[file]++
+				tokenChanged = true
+			}
+
+			if tokenChanged {
+				out.WriteString(token.String())
+				changed = true
+			} else {
+				out.Write(raw)
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+
+		return util.ReplaceFile(p, out.Bytes(), 0644)
+	})
+
+	return rewritten, err
+}
+
+// resolves relative reference in a html file in htmlDir
+// to a file path relative to post
+//
+// suffix is query and fragment of the reference
+func resolvePostRef(htmlDir string, ref string) (string, string, bool) {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return "", "", false
+	}
+
+	file := path.Join(htmlDir, u.Path)
+	if !filepath.IsLocal(filepath.FromSlash(file)) {
+		return "", "", false
+	}
+
+	suffix := ""
+	if u.RawQuery != "" {
+		suffix += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		suffix += "#" + u.EscapedFragment()
+	}
+
+	return file, suffix, true
+}
+
+// points urls in srcset to shared copies, leaving descriptors as they are
+// returns new srcset and files whose url got rewritten
+//
+// urls are found the way html spec parses srcset,
+// so commas in urls like data: ones are fine
+func rewriteSrcSet(htmlDir string, srcSet string, sharedURLs map[string]string) (string, []string) {
+	var out strings.Builder
+	var files []string
+
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+	}
+
+	i := 0
+	for i < len(srcSet) {
+		// separators between candidates
+		start := i
+		for i < len(srcSet) && (isSpace(srcSet[i]) || srcSet[i] == ',') {
+			i++
+		}
+		out.WriteString(srcSet[start:i])
+		if i >= len(srcSet) {
+			break
+		}
+
+		// url runs until whitespace, commas at end of it are separators
+		urlStart := i
+		for i < len(srcSet) && !isSpace(srcSet[i]) {
+			i++
+		}
+		urlEnd := i
+		for urlEnd > urlStart && srcSet[urlEnd-1] == ',' {
+			urlEnd--
+		}
+
+		ref := srcSet[urlStart:urlEnd]
+		if file, suffix, ok := resolvePostRef(htmlDir, ref); ok {
+			if sharedURL, ok := sharedURLs[file]; ok {
+				ref = sharedURL + suffix
+				files = append(files, file)
+			}
+		}
+		out.WriteString(ref)
+		out.WriteString(srcSet[urlEnd:i])
+
+		if urlEnd < i {
+			// url ended with commas, there are no descriptors
+			continue
+		}
+
+		// descriptors run until comma that's not in parentheses
+		start = i
+		inParens := false
+		for i < len(srcSet) && (inParens || srcSet[i] != ',') {
+			switch srcSet[i] {
+			case '(':
+				inParens = true
+			case ')':
+				inParens = false
+			}
+			i++
+		}
+		out.WriteString(srcSet[start:i])
+	}
+
+	return out.String(), files
+}
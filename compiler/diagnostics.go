@@ -0,0 +1,189 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"blog/markdown"
+	"blog/model"
+	"blog/postlist"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// what a Diagnostic is about
+const (
+	// anything we don't have a better code for
+	DiagnosticCompile = "compile"
+
+	DiagnosticMissingUUID   = "missing-uuid"
+	DiagnosticUUIDMismatch  = "uuid-mismatch"
+	DiagnosticDuplicateUUID = "duplicate-uuid"
+	DiagnosticTypeMismatch  = "type-mismatch"
+	DiagnosticPostIgnore    = "postignore"
+	DiagnosticMarkdown      = "markdown"
+	DiagnosticImage         = "image"
+	DiagnosticThumbnail     = "thumbnail"
+	DiagnosticShareImage    = "share-image"
+	DiagnosticMetadata      = "metadata"
+	DiagnosticOptimize      = "optimize"
+	DiagnosticDedup         = "dedup"
+	DiagnosticSizeBudget    = "size-budget"
+	DiagnosticHook          = "hook"
+)
+
+// problem found while compiling
+type Diagnostic struct {
+	// zero if it's not about a post
+	UUID uuid.UUID
+	Dir  string
+
+	// relative to post directory, empty if we don't know
+	File string
+	// starts from 1, 0 if we don't know
+	Line int
+
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	where := d.Dir
+	if d.File != "" {
+		where = path.Join(where, d.File)
+	}
+	if d.Line > 0 {
+		where = fmt.Sprintf("%s:%d", where, d.Line)
+	}
+
+	if where == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", where, d.Severity, d.Message)
+}
+
+// error that knows what kind of Diagnostic it is
+type DiagnosticError struct {
+	Code string
+	// relative to post directory, can be empty
+	File string
+	Err  error
+}
+
+func (de *DiagnosticError) Error() string {
+	return de.Err.Error()
+}
+
+func (de *DiagnosticError) Unwrap() error {
+	return de.Err
+}
+
+// wraps err in DiagnosticError, nil stays nil
+func withDiagnostic(code string, file string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DiagnosticError{Code: code, File: file, Err: err}
+}
+
+// turns error from compiling post into diagnostics
+func PostDiagnostics(post model.Post, err error) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, md := range markdown.CollectMarkdownDiagnostics(err) {
+		diagnostics = append(diagnostics, Diagnostic{
+			UUID:     post.UUID,
+			Dir:      post.Dir,
+			File:     "index.md",
+			Line:     md.Line,
+			Severity: SeverityError,
+			Code:     DiagnosticMarkdown,
+			Message:  md.Message,
+		})
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	diagnostic := Diagnostic{
+		UUID:     post.UUID,
+		Dir:      post.Dir,
+		Severity: SeverityError,
+		Code:     DiagnosticCompile,
+		Message:  err.Error(),
+	}
+
+	var de *DiagnosticError
+	if errors.As(err, &de) {
+		diagnostic.Code = de.Code
+		diagnostic.File = de.File
+	}
+
+	return append(diagnostics, diagnostic)
+}
+
+// CompileBlog failed, Diagnostics say why
+type BuildError struct {
+	// has at least one error, may have warnings
+	Diagnostics []Diagnostic
+}
+
+func (be *BuildError) Error() string {
+	var lines []string
+	for _, d := range be.Diagnostics {
+		if d.Severity == SeverityError {
+			lines = append(lines, d.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// gets diagnostics out of error from CompileBlog or ConvertMarkdown
+func CollectDiagnostics(err error) []Diagnostic {
+	var be *BuildError
+	if errors.As(err, &be) {
+		return be.Diagnostics
+	}
+
+	var diagnostics []Diagnostic
+	for _, md := range markdown.CollectMarkdownDiagnostics(err) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Line:     md.Line,
+			Severity: SeverityError,
+			Code:     DiagnosticMarkdown,
+			Message:  md.Message,
+		})
+	}
+
+	return diagnostics
+}
+
+// diagnostics for post directories sharing a uuid, see postlist.DuplicateUUID
+func duplicateUUIDDiagnostics(duplicates []postlist.DuplicateUUID) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, duplicate := range duplicates {
+		for _, dir := range duplicate.Copies {
+			diagnostics = append(diagnostics, Diagnostic{
+				UUID:     duplicate.UUID,
+				Dir:      dir,
+				File:     postlist.PostUUIDFileName,
+				Severity: SeverityError,
+				Code:     DiagnosticDuplicateUUID,
+				Message:  fmt.Sprintf("same uuid as %s, re-key the copy", duplicate.Original),
+			})
+		}
+	}
+
+	return diagnostics
+}
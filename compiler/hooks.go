@@ -0,0 +1,136 @@
+package compiler
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"blog/model"
+)
+
+// custom step in CompileBlog, see RegisterBuildHook
+//
+// embed NopBuildHook to only implement the callbacks you need
+type BuildHook interface {
+	// shows up in errors
+	Name() string
+
+	// called before any post is compiled, hook can change postList
+	BeforeBuild(postRoot string, postList *model.PostList) error
+
+	// called for markdown posts with html page their markdown got converted to,
+	// returns html that gets written to index.html
+	TransformMarkdownHTML(post model.Post, htmlBytes []byte) ([]byte, error)
+
+	// called after post got compiled into postOutDir,
+	// hook can change post and files in postOutDir
+	//
+	// files there aren't hard linked to anything, so they can be written in place
+	AfterPost(post *model.Post, postOutDir string) error
+
+	// called after every post got compiled but before output goes live,
+	// outDir is where output is for now
+	//
+	// runs before images get optimized and assets deduped,
+	// so files in outDir can be written in place too
+	AfterBuild(postList model.PostList, outDir string) error
+}
+
+// BuildHook that does nothing
+type NopBuildHook struct{}
+
+func (NopBuildHook) BeforeBuild(postRoot string, postList *model.PostList) error {
+	return nil
+}
+
+func (NopBuildHook) TransformMarkdownHTML(post model.Post, htmlBytes []byte) ([]byte, error) {
+	return htmlBytes, nil
+}
+
+func (NopBuildHook) AfterPost(post *model.Post, postOutDir string) error {
+	return nil
+}
+
+func (NopBuildHook) AfterBuild(postList model.PostList, outDir string) error {
+	return nil
+}
+
+type prioritizedBuildHook struct {
+	Hook     BuildHook
+	Priority int
+}
+
+var (
+	buildHooksMu sync.Mutex
+	buildHooks   []prioritizedBuildHook
+)
+
+// adds hook to every CompileBlog after this
+//
+// hooks with lower priority run first,
+// ones with the same priority run in order they were registered
+func RegisterBuildHook(hook BuildHook, priority int) {
+	buildHooksMu.Lock()
+	defer buildHooksMu.Unlock()
+
+	buildHooks = append(buildHooks, prioritizedBuildHook{Hook: hook, Priority: priority})
+
+	slices.SortStableFunc(buildHooks, func(a, b prioritizedBuildHook) int {
+		return a.Priority - b.Priority
+	})
+}
+
+// registered hooks in order they run
+func BuildHooks() []BuildHook {
+	buildHooksMu.Lock()
+	defer buildHooksMu.Unlock()
+
+	hooks := make([]BuildHook, len(buildHooks))
+	for i, prioritized := range buildHooks {
+		hooks[i] = prioritized.Hook
+	}
+
+	return hooks
+}
+
+func hookError(hook BuildHook, stage string, err error) error {
+	return withDiagnostic(DiagnosticHook, "", fmt.Errorf("hook %s: %s: %w", hook.Name(), stage, err))
+}
+
+func runBeforeBuildHooks(hooks []BuildHook, postRoot string, postList *model.PostList) error {
+	for _, hook := range hooks {
+		if err := hook.BeforeBuild(postRoot, postList); err != nil {
+			return hookError(hook, "before build", err)
+		}
+	}
+	return nil
+}
+
+func runTransformMarkdownHTMLHooks(hooks []BuildHook, post model.Post, htmlBytes []byte) ([]byte, error) {
+	for _, hook := range hooks {
+		var err error
+		htmlBytes, err = hook.TransformMarkdownHTML(post, htmlBytes)
+		if err != nil {
+			return nil, hookError(hook, "transform markdown html", err)
+		}
+	}
+	return htmlBytes, nil
+}
+
+func runAfterPostHooks(hooks []BuildHook, post *model.Post, postOutDir string) error {
+	for _, hook := range hooks {
+		if err := hook.AfterPost(post, postOutDir); err != nil {
+			return hookError(hook, "after post", err)
+		}
+	}
+	return nil
+}
+
+func runAfterBuildHooks(hooks []BuildHook, postList model.PostList, outDir string) error {
+	for _, hook := range hooks {
+		if err := hook.AfterBuild(postList, outDir); err != nil {
+			return hookError(hook, "after build", err)
+		}
+	}
+	return nil
+}
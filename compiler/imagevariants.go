@@ -0,0 +1,244 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+
+	"blog/markdown"
+	"blog/util"
+)
+
+// widths that we generate downscaled images at
+var ResponsiveImageWidths = []int{480, 960, 1600}
+
+// bump this when we change how variants are generated
+// so that cached variants get invalidated
+const imageVariantVersion = 1
+
+const imageVariantJpegQuality = 85
+
+// generate downscaled variants of every local image markdown refers to
+//
+// variants are written next to where the image would be in postOutDir,
+// and cached in cacheDir if it's not empty
+func GenerateMarkdownImageVariants(
+	markdownBytes []byte,
+	postDir string,
+	postOutDir string,
+	cacheDir string,
+) (markdown.ImageVariants, error) {
+	images, err := markdown.FindMarkdownImages(markdownBytes, postDir)
+	if err != nil {
+		return nil, err
+	}
+
+	imageVariants := make(markdown.ImageVariants)
+
+	// same image could be referred multiple times
+	generated := make(map[string][]markdown.ImageVariant)
+
+	for _, src := range images {
+		if _, ok := imageVariants[src]; ok {
+			continue
+		}
+
+		localPath, isLocal := markdown.LocalImagePath(src)
+		if !isLocal {
+			continue
+		}
+
+		variants, ok := generated[localPath]
+		if !ok {
+			variants, err = GenerateImageVariants(postDir, postOutDir, localPath, cacheDir)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", src, err)
+			}
+			generated[localPath] = variants
+		}
+
+		if len(variants) > 0 {
+			imageVariants[src] = variants
+		}
+	}
+
+	return imageVariants, nil
+}
+
+// generate downscaled variants of a image
+//
+// returned variants include the original image if any variant was generated
+// returns nil if image is not something we can resize or is already small
+func GenerateImageVariants(
+	postDir string,
+	postOutDir string,
+	imagePath string,
+	cacheDir string,
+) ([]markdown.ImageVariant, error) {
+	srcPath := filepath.Join(postDir, filepath.FromSlash(imagePath))
+
+	srcBytes, err := os.ReadFile(srcPath)
+	if err != nil {
+		// reporting missing image is not our job
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(srcBytes))
+	if err != nil {
+		return nil, nil
+	}
+
+	if format != "jpeg" && format != "png" {
+		return nil, nil
+	}
+
+	// browsers show the original upright,
+	// variants don't keep EXIF so they are turned upright when encoding
+	orientation := util.ImageOrientation(srcBytes)
+
+	width, height := config.Width, config.Height
+	if util.OrientationSwapsSize(orientation) {
+		width, height = height, width
+	}
+
+	var widths []int
+	for _, w := range ResponsiveImageWidths {
+		// variant that is almost as big as the original isn't worth it
+		if w*5 <= width*4 {
+			widths = append(widths, w)
+		}
+	}
+
+	if len(widths) <= 0 {
+		return nil, nil
+	}
+
+	srcHash := imageVariantHash(srcBytes, orientation)
+
+	ext := path.Ext(imagePath)
+	noExt := strings.TrimSuffix(imagePath, ext)
+
+	var variants []markdown.ImageVariant
+
+	// we decode lazily since every variant could be cached
+	var srcImage image.Image
+
+	for _, w := range widths {
+		variant := markdown.ImageVariant{
+			Source: fmt.Sprintf("%s.%dw%s", noExt, w, ext),
+			Width:  w,
+			Height: max(1, (height*w+width/2)/width),
+		}
+
+		var cachePath string
+		var encoded []byte
+
+		if cacheDir != "" {
+			cachePath = filepath.Join(cacheDir, fmt.Sprintf("%s-%d.%s", srcHash, w, format))
+
+			encoded, err = os.ReadFile(cachePath)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		if encoded == nil {
+			if srcImage == nil {
+				srcImage, _, err = image.Decode(bytes.NewReader(srcBytes))
+				if err != nil {
+					return nil, err
+				}
+				srcImage = util.OrientImage(srcImage, orientation)
+			}
+
+			var buf bytes.Buffer
+			if err := encodeImage(&buf, resizeImage(srcImage, variant.Width, variant.Height), format); err != nil {
+				return nil, err
+			}
+			encoded = buf.Bytes()
+
+			if cachePath != "" {
+				if err := os.MkdirAll(cacheDir, 0755); err != nil {
+					return nil, err
+				}
+				if err := os.WriteFile(cachePath, encoded, 0644); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// smaller image can still be bigger in bytes
+		// if original was compressed well
+		if len(encoded) >= len(srcBytes) {
+			continue
+		}
+
+		outPath := filepath.Join(postOutDir, filepath.FromSlash(variant.Source))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return nil, err
+		}
+
+		if err := util.ReplaceFile(outPath, encoded, 0644); err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, variant)
+	}
+
+	if len(variants) <= 0 {
+		return nil, nil
+	}
+
+	variants = append(variants, markdown.ImageVariant{
+		Source: imagePath,
+		Width:  width,
+		Height: height,
+	})
+
+	return variants, nil
+}
+
+// variants cached before orientation was applied are sideways,
+// so orientation is part of the key
+func imageVariantHash(srcBytes []byte, orientation int) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "v%d-q%d-o%d\n", imageVariantVersion, imageVariantJpegQuality, orientation)
+	hash.Write(srcBytes)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func resizeImage(src image.Image, width, height int) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: imageVariantJpegQuality})
+	case "png":
+		return png.Encode(w, img)
+	}
+
+	return fmt.Errorf("can't encode image to %s", format)
+}
@@ -0,0 +1,334 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"blog/util"
+)
+
+// metadata we removed from an image
+type StrippedMetadata struct {
+	// relative to post output directory
+	File string
+	// like "EXIF", "XMP", "comment"
+	Kinds []string
+	// how many bytes got removed
+	Bytes int
+}
+
+// strips metadata from every jpeg and png in dir
+func StripImageMetadataInDir(dir string) ([]StrippedMetadata, error) {
+	var stripped []StrippedMetadata
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		switch util.ExtLowered(path) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		strippedData, kinds, err := StripImageMetadata(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(kinds) == 0 {
+			return nil
+		}
+
+		if err := util.ReplaceFile(path, strippedData, 0644); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		stripped = append(stripped, StrippedMetadata{
+			File:  filepath.ToSlash(rel),
+			Kinds: kinds,
+			Bytes: len(data) - len(strippedData),
+		})
+
+		return nil
+	})
+
+	return stripped, err
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// removes metadata from jpeg or png without touching pixels
+// data that isn't jpeg or png is returned as is
+//
+// returns kinds of metadata that got removed
+func StripImageMetadata(data []byte) ([]byte, []string, error) {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}) {
+		return stripJpegMetadata(data)
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		return stripPngMetadata(data)
+	}
+	return data, nil, nil
+}
+
+func appendKind(kinds []string, kind string) []string {
+	if slices.Contains(kinds, kind) {
+		return kinds
+	}
+	return append(kinds, kind)
+}
+
+// ======================
+// jpeg
+// ======================
+
+var (
+	jpegExifPrefix         = []byte("Exif\x00\x00")
+	jpegXmpPrefix          = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegExtendedXmpPrefix  = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	jpegPhotoshopPrefix    = []byte("Photoshop 3.0\x00")
+	jpegICCProfilePrefix   = []byte("ICC_PROFILE\x00")
+	jpegMultiPicturePrefix = []byte("MPF\x00")
+)
+
+// returns what kind of metadata segment is
+// and false if we should keep it
+func jpegMetadataKind(marker byte, segment []byte) (string, bool) {
+	switch {
+	case marker == 0xe1: // APP1
+		if bytes.HasPrefix(segment, jpegExifPrefix) {
+			return "EXIF", true
+		}
+		if bytes.HasPrefix(segment, jpegXmpPrefix) || bytes.HasPrefix(segment, jpegExtendedXmpPrefix) {
+			return "XMP", true
+		}
+		return "APP1", true
+	case marker == 0xe2: // APP2
+		// color profile changes how image looks
+		// and MPF points to images after the end of this one
+		if bytes.HasPrefix(segment, jpegICCProfilePrefix) || bytes.HasPrefix(segment, jpegMultiPicturePrefix) {
+			return "", false
+		}
+		return "APP2", true
+	case marker == 0xed: // APP13
+		if bytes.HasPrefix(segment, jpegPhotoshopPrefix) {
+			return "IPTC", true
+		}
+		return "APP13", true
+	case marker == 0xfe:
+		return "comment", true
+	case marker == 0xe0 || marker == 0xee:
+		// JFIF and Adobe segments are needed to decode colors correctly
+		return "", false
+	case 0xe3 <= marker && marker <= 0xef:
+		return fmt.Sprintf("APP%d", marker-0xe0), true
+	}
+
+	return "", false
+}
+
+func stripJpegMetadata(data []byte) ([]byte, []string, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...) // SOI
+
+	var kinds []string
+
+	pos := 2
+
+	for {
+		if pos >= len(data) || data[pos] != 0xff {
+			return nil, nil, fmt.Errorf("jpeg: expected a marker at %d", pos)
+		}
+		// markers can be padded with any number of 0xff
+		for pos < len(data) && data[pos] == 0xff {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, nil, fmt.Errorf("jpeg: unexpected end of file")
+		}
+
+		marker := data[pos]
+		pos++
+
+		// markers without a segment
+		if marker == 0x01 || (0xd0 <= marker && marker <= 0xd9) {
+			out = append(out, 0xff, marker)
+			if marker == 0xd9 { // EOI
+				out = append(out, data[pos:]...)
+				break
+			}
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return nil, nil, fmt.Errorf("jpeg: unexpected end of file")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, nil, fmt.Errorf("jpeg: invalid segment length at %d", pos)
+		}
+
+		segment := data[pos+2 : pos+length]
+		pos += length
+
+		// everything after the start of scan is image data,
+		// metadata doesn't live there so just copy the rest
+		if marker == 0xda {
+			out = append(out, 0xff, marker)
+			out = binary.BigEndian.AppendUint16(out, uint16(length))
+			out = append(out, segment...)
+			out = append(out, data[pos:]...)
+			break
+		}
+
+		kind, strip := jpegMetadataKind(marker, segment)
+		if !strip {
+			out = append(out, 0xff, marker)
+			out = binary.BigEndian.AppendUint16(out, uint16(length))
+			out = append(out, segment...)
+			continue
+		}
+
+		kinds = appendKind(kinds, kind)
+
+		// browsers rotate images with EXIF orientation,
+		// keep just that so photos don't end up sideways
+		if kind == "EXIF" {
+			orientation := util.ExifOrientation(segment[len(jpegExifPrefix):])
+			if orientation > 1 {
+				exif := append(slices.Clone(jpegExifPrefix), minimalExif(orientation)...)
+				out = append(out, 0xff, marker)
+				out = binary.BigEndian.AppendUint16(out, uint16(len(exif)+2))
+				out = append(out, exif...)
+			}
+		}
+	}
+
+	if len(kinds) == 0 {
+		return data, nil, nil
+	}
+
+	return out, kinds, nil
+}
+
+// ======================
+// png
+// ======================
+
+// chunks that only carry metadata
+var pngMetadataChunks = map[string]string{
+	"eXIf": "EXIF",
+	"tEXt": "text",
+	"zTXt": "text",
+	"iTXt": "text",
+	"tIME": "time",
+}
+
+func stripPngMetadata(data []byte) ([]byte, []string, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	var kinds []string
+
+	pos := len(pngSignature)
+
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, nil, fmt.Errorf("png: unexpected end of file")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+
+		end := pos + 8 + length + 4 // length, type, data, crc
+		if length < 0 || end > len(data) || end < pos {
+			return nil, nil, fmt.Errorf("png: invalid chunk length at %d", pos)
+		}
+
+		chunkData := data[pos+8 : pos+8+length]
+		chunk := data[pos:end]
+		pos = end
+
+		kind, isMetadata := pngMetadataChunks[chunkType]
+		if !isMetadata {
+			out = append(out, chunk...)
+			if chunkType == "IEND" {
+				out = append(out, data[pos:]...)
+				break
+			}
+			continue
+		}
+
+		if chunkType == "iTXt" && bytes.HasPrefix(chunkData, []byte("XML:com.adobe.xmp\x00")) {
+			kind = "XMP"
+		}
+		kinds = appendKind(kinds, kind)
+
+		if chunkType == "eXIf" {
+			orientation := util.ExifOrientation(chunkData)
+			if orientation > 1 {
+				out = appendPngChunk(out, "eXIf", minimalExif(orientation))
+			}
+		}
+	}
+
+	if len(kinds) == 0 {
+		return data, nil, nil
+	}
+
+	return out, kinds, nil
+}
+
+func appendPngChunk(out []byte, chunkType string, chunkData []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(chunkData)))
+
+	start := len(out)
+	out = append(out, chunkType...)
+	out = append(out, chunkData...)
+
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// ======================
+// exif
+// ======================
+
+// tiff structure with nothing but orientation in it
+func minimalExif(orientation int) []byte {
+	var tiff []byte
+
+	tiff = append(tiff, "MM"...)
+	tiff = binary.BigEndian.AppendUint16(tiff, 42)
+	tiff = binary.BigEndian.AppendUint32(tiff, 8) // first IFD
+
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // entry count
+
+	tiff = binary.BigEndian.AppendUint16(tiff, util.ExifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1) // value count
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = binary.BigEndian.AppendUint16(tiff, 0) // padding
+
+	tiff = binary.BigEndian.AppendUint32(tiff, 0) // no next IFD
+
+	return tiff
+}
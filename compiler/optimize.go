@@ -0,0 +1,820 @@
+package compiler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"blog/util"
+)
+
+// optimization can take a while so it's off by default
+var OptimizeImages = false
+
+const imageOptimizeVersion = 2
+
+// image in output we made smaller
+type OptimizedImage struct {
+	// relative to post output directory
+	File string
+
+	Before int
+	After  int
+}
+
+// losslessly recompresses every jpeg and png in dir
+// files are only replaced when they get smaller
+//
+// results are cached in cacheDir if it's not empty
+func OptimizeImagesInDir(dir string, cacheDir string) ([]OptimizedImage, error) {
+	var optimized []OptimizedImage
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		switch util.ExtLowered(path) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		smaller, err := optimizeImageCached(data, cacheDir)
+		if err != nil {
+			util.WarnLogger.Printf("can't optimize %s: %v", path, err)
+			return nil
+		}
+		if smaller == nil {
+			return nil
+		}
+
+		if err := util.ReplaceFile(path, smaller, 0644); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		optimized = append(optimized, OptimizedImage{
+			File:   filepath.ToSlash(rel),
+			Before: len(data),
+			After:  len(smaller),
+		})
+
+		return nil
+	})
+
+	return optimized, err
+}
+
+// returns nil if image couldn't get any smaller
+func optimizeImageCached(data []byte, cacheDir string) ([]byte, error) {
+	var cachePath string
+
+	if cacheDir != "" {
+		hash := sha256.New()
+		fmt.Fprintf(hash, "optimize-v%d\n", imageOptimizeVersion)
+		hash.Write(data)
+
+		cachePath = filepath.Join(cacheDir, hex.EncodeToString(hash.Sum(nil)))
+
+		// empty file means we tried and it didn't get smaller
+		cached, err := os.ReadFile(cachePath)
+		if err == nil {
+			if len(cached) == 0 {
+				return nil, nil
+			}
+			return cached, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	var smaller []byte
+	var err error
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		smaller, err = optimizeJpeg(data)
+	case bytes.HasPrefix(data, pngSignature):
+		smaller, err = optimizePng(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(smaller) >= len(data) {
+		smaller = nil
+	}
+
+	if cachePath != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(cachePath, smaller, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return smaller, nil
+}
+
+// ======================
+// png
+// ======================
+
+// recompresses image data with the best zlib compression
+// and merges IDAT chunks into one
+//
+// pixels and other chunks are left alone
+func optimizePng(data []byte) ([]byte, error) {
+	type chunk struct {
+		Type string
+		Raw  []byte
+	}
+
+	var chunks []chunk
+	var idat []byte
+	var trailing []byte
+
+	pos := len(pngSignature)
+
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("png: unexpected end of file")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+
+		end := pos + 8 + length + 4
+		if end > len(data) || end < pos {
+			return nil, fmt.Errorf("png: invalid chunk length at %d", pos)
+		}
+
+		if chunkType == "IDAT" {
+			idat = append(idat, data[pos+8:pos+8+length]...)
+		}
+
+		chunks = append(chunks, chunk{Type: chunkType, Raw: data[pos:end]})
+		pos = end
+
+		if chunkType == "IEND" {
+			trailing = data[pos:]
+			break
+		}
+	}
+
+	if len(idat) == 0 {
+		return nil, fmt.Errorf("png: no image data")
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(idat))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	writer, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	wroteIdat := false
+	for _, c := range chunks {
+		if c.Type != "IDAT" {
+			out = append(out, c.Raw...)
+			continue
+		}
+		if !wroteIdat {
+			out = appendPngChunk(out, "IDAT", compressed.Bytes())
+			wroteIdat = true
+		}
+	}
+
+	out = append(out, trailing...)
+
+	return out, nil
+}
+
+// ======================
+// jpeg
+// ======================
+
+type jpegHuffmanTable struct {
+	// number of codes of each length, Bits[0] is unused
+	Bits   [17]int
+	Values []byte
+}
+
+// huffman table ready for decoding, see JPEG spec F.2.2.3
+type jpegHuffmanDecoder struct {
+	maxCode  [18]int
+	valPtr   [17]int
+	minCode  [17]int
+	values   []byte
+	hasCodes bool
+}
+
+func newJpegHuffmanDecoder(table jpegHuffmanTable) jpegHuffmanDecoder {
+	dec := jpegHuffmanDecoder{values: table.Values}
+
+	code := 0
+	k := 0
+	for l := 1; l <= 16; l++ {
+		if table.Bits[l] == 0 {
+			dec.maxCode[l] = -1
+		} else {
+			dec.valPtr[l] = k
+			dec.minCode[l] = code
+			code += table.Bits[l]
+			k += table.Bits[l]
+			dec.maxCode[l] = code - 1
+			dec.hasCodes = true
+		}
+		code <<= 1
+	}
+	dec.maxCode[17] = 1 << 30
+
+	return dec
+}
+
+type jpegHuffmanEncoder struct {
+	codes [256]uint16
+	sizes [256]uint8
+}
+
+func newJpegHuffmanEncoder(table jpegHuffmanTable) jpegHuffmanEncoder {
+	var enc jpegHuffmanEncoder
+
+	code := 0
+	k := 0
+	for l := 1; l <= 16; l++ {
+		for range table.Bits[l] {
+			enc.codes[table.Values[k]] = uint16(code)
+			enc.sizes[table.Values[k]] = uint8(l)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+
+	return enc
+}
+
+// builds huffman table from symbol frequencies, see JPEG spec K.2
+func optimalJpegHuffmanTable(freq [256]int) jpegHuffmanTable {
+	var f [257]int
+	copy(f[:], freq[:])
+	// reserved symbol so that no code is all 1s
+	f[256] = 1
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		// two least frequent symbols, ties go to the bigger symbol
+		v1, v2 := -1, -1
+		for i := range f {
+			if f[i] > 0 && (v1 < 0 || f[i] <= f[v1]) {
+				v1 = i
+			}
+		}
+		for i := range f {
+			if f[i] > 0 && i != v1 && (v2 < 0 || f[i] <= f[v2]) {
+				v2 = i
+			}
+		}
+		if v2 < 0 {
+			break
+		}
+
+		f[v1] += f[v2]
+		f[v2] = 0
+
+		codeSize[v1]++
+		for others[v1] >= 0 {
+			v1 = others[v1]
+			codeSize[v1]++
+		}
+		others[v1] = v2
+
+		codeSize[v2]++
+		for others[v2] >= 0 {
+			v2 = others[v2]
+			codeSize[v2]++
+		}
+	}
+
+	// tree of 257 symbols can't be deeper than 256
+	var bits [257]int
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[size]++
+		}
+	}
+
+	// codes can't be longer than 16 bits
+	for i := len(bits) - 1; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+
+	// remove reserved symbol
+	for i := 16; i > 0; i-- {
+		if bits[i] > 0 {
+			bits[i]--
+			break
+		}
+	}
+
+	var table jpegHuffmanTable
+	copy(table.Bits[1:], bits[1:17])
+
+	for size := 1; size < len(bits); size++ {
+		for symbol := range 256 {
+			if codeSize[symbol] == size {
+				table.Values = append(table.Values, byte(symbol))
+			}
+		}
+	}
+
+	return table
+}
+
+type jpegBitReader struct {
+	data []byte
+	pos  int
+
+	bits  uint32
+	nBits int
+}
+
+func (br *jpegBitReader) readBit() (uint32, error) {
+	if br.nBits == 0 {
+		if br.pos >= len(br.data) {
+			return 0, fmt.Errorf("jpeg: unexpected end of scan")
+		}
+
+		b := br.data[br.pos]
+		if b == 0xff {
+			if br.pos+1 >= len(br.data) || br.data[br.pos+1] != 0x00 {
+				return 0, fmt.Errorf("jpeg: unexpected marker in scan at %d", br.pos)
+			}
+			br.pos += 2
+		} else {
+			br.pos++
+		}
+
+		br.bits = uint32(b)
+		br.nBits = 8
+	}
+
+	br.nBits--
+	return (br.bits >> br.nBits) & 1, nil
+}
+
+func (br *jpegBitReader) readBits(n int) (uint32, error) {
+	var value uint32
+	for range n {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+func (br *jpegBitReader) decode(dec *jpegHuffmanDecoder) (byte, error) {
+	if !dec.hasCodes {
+		return 0, fmt.Errorf("jpeg: empty huffman table")
+	}
+
+	code := 0
+	for l := 1; l <= 16; l++ {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int(bit)
+		if dec.maxCode[l] >= 0 && code <= dec.maxCode[l] {
+			return dec.values[dec.valPtr[l]+code-dec.minCode[l]], nil
+		}
+	}
+
+	return 0, fmt.Errorf("jpeg: invalid huffman code")
+}
+
+type jpegBitWriter struct {
+	out []byte
+
+	bits  uint32
+	nBits int
+}
+
+func (bw *jpegBitWriter) writeBits(value uint32, n int) {
+	for n > 0 {
+		take := min(n, 8)
+		n -= take
+
+		bw.bits = bw.bits<<take | (value>>n)&(1<<take-1)
+		bw.nBits += take
+
+		for bw.nBits >= 8 {
+			bw.nBits -= 8
+			b := byte(bw.bits >> bw.nBits)
+			bw.out = append(bw.out, b)
+			if b == 0xff {
+				bw.out = append(bw.out, 0x00)
+			}
+		}
+		bw.bits &= 1<<bw.nBits - 1
+	}
+}
+
+// pads last byte with 1s
+func (bw *jpegBitWriter) flush() {
+	if bw.nBits > 0 {
+		bw.writeBits(1<<(8-bw.nBits)-1, 8-bw.nBits)
+	}
+}
+
+// symbol in a scan, table is class*4 + id
+type jpegScanSymbol struct {
+	Table  int
+	Symbol byte
+
+	Extra  uint32
+	NExtra int
+}
+
+type jpegScanComponent struct {
+	H, V   int
+	DC, AC int
+}
+
+// goes through every huffman coded symbol in a baseline scan
+// without restart markers
+func walkJpegScan(
+	data []byte,
+	start int,
+	components []jpegScanComponent,
+	mcusX, mcusY int,
+	decoders *[8]jpegHuffmanDecoder,
+	onSymbol func(symbol jpegScanSymbol),
+) (int, error) {
+	br := jpegBitReader{data: data, pos: start}
+
+	readSymbol := func(table int) (byte, error) {
+		symbol, err := br.decode(&decoders[table])
+		if err != nil {
+			return 0, err
+		}
+
+		nExtra := int(symbol & 0x0f)
+		if table < 4 {
+			nExtra = int(symbol)
+		}
+		if nExtra > 16 {
+			return 0, fmt.Errorf("jpeg: invalid symbol %d", symbol)
+		}
+
+		extra, err := br.readBits(nExtra)
+		if err != nil {
+			return 0, err
+		}
+
+		onSymbol(jpegScanSymbol{Table: table, Symbol: symbol, Extra: extra, NExtra: nExtra})
+
+		return symbol, nil
+	}
+
+	for range mcusX * mcusY {
+		for _, c := range components {
+			for range c.H * c.V {
+				if _, err := readSymbol(c.DC); err != nil {
+					return 0, err
+				}
+
+				for k := 1; k < 64; {
+					symbol, err := readSymbol(4 + c.AC)
+					if err != nil {
+						return 0, err
+					}
+
+					run, size := int(symbol>>4), symbol&0x0f
+					if size == 0 {
+						if run == 15 { // ZRL
+							k += 16
+							continue
+						}
+						break // EOB
+					}
+					k += run + 1
+				}
+			}
+		}
+	}
+
+	return br.pos, nil
+}
+
+// rebuilds huffman tables of baseline jpeg for this image
+// like jpegtran -optimize
+//
+// returns nil if jpeg is not something we can optimize
+func optimizeJpeg(data []byte) ([]byte, error) {
+	var tables [8]jpegHuffmanTable
+	var hasTable [8]bool
+
+	type frameComponent struct {
+		ID   byte
+		H, V int
+	}
+
+	var frame []frameComponent
+	var width, height int
+
+	var sos, sosRaw []byte
+
+	// segments before start of scan except huffman tables
+	var header []byte
+	header = append(header, data[:2]...)
+
+	pos := 2
+
+	for {
+		for pos < len(data) && data[pos] == 0xff && pos+1 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, fmt.Errorf("jpeg: expected a marker at %d", pos)
+		}
+
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("jpeg: invalid segment length at %d", pos)
+		}
+		segment := data[pos+4 : pos+2+length]
+		raw := data[pos : pos+2+length]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xc4: // DHT
+			for len(segment) > 0 {
+				if len(segment) < 17 {
+					return nil, fmt.Errorf("jpeg: invalid huffman table")
+				}
+				class, id := int(segment[0]>>4), int(segment[0]&0x0f)
+				if class > 1 || id > 3 {
+					return nil, fmt.Errorf("jpeg: invalid huffman table")
+				}
+
+				var table jpegHuffmanTable
+				total := 0
+				for l := 1; l <= 16; l++ {
+					table.Bits[l] = int(segment[l])
+					total += table.Bits[l]
+				}
+				if len(segment) < 17+total || total > 256 {
+					return nil, fmt.Errorf("jpeg: invalid huffman table")
+				}
+				table.Values = segment[17 : 17+total]
+
+				tables[class*4+id] = table
+				hasTable[class*4+id] = true
+
+				segment = segment[17+total:]
+			}
+			continue
+		case marker == 0xc0 || marker == 0xc1: // baseline and extended huffman
+			if len(segment) < 6 {
+				return nil, fmt.Errorf("jpeg: invalid frame header")
+			}
+			height = int(binary.BigEndian.Uint16(segment[1:]))
+			width = int(binary.BigEndian.Uint16(segment[3:]))
+			count := int(segment[5])
+			if len(segment) < 6+count*3 {
+				return nil, fmt.Errorf("jpeg: invalid frame header")
+			}
+			// cmyk
+			if count == 4 {
+				return nil, nil
+			}
+			for i := range count {
+				c := segment[6+i*3:]
+				frame = append(frame, frameComponent{ID: c[0], H: int(c[1] >> 4), V: int(c[1] & 0x0f)})
+			}
+		case 0xc2 <= marker && marker <= 0xcf && marker != 0xc8 && marker != 0xcc:
+			// progressive, lossless and arithmetic coded jpegs
+			return nil, nil
+		case marker == 0xdd: // DRI
+			if len(segment) < 2 {
+				return nil, fmt.Errorf("jpeg: invalid restart interval")
+			}
+			// scans with restart markers are left alone
+			if binary.BigEndian.Uint16(segment) != 0 {
+				return nil, nil
+			}
+		case marker == 0xee && bytes.HasPrefix(segment, []byte("Adobe")):
+			// adobe segment can make components cmyk or ycck, those are left alone
+			return nil, nil
+		}
+
+		if marker == 0xda { // SOS
+			sos = segment
+			sosRaw = raw
+			break
+		}
+
+		header = append(header, raw...)
+	}
+
+	if len(frame) == 0 || width == 0 || height == 0 {
+		return nil, fmt.Errorf("jpeg: no frame header before scan")
+	}
+
+	// ===========================
+	// scan header
+	// ===========================
+	if len(sos) < 1 || len(sos) < 1+int(sos[0])*2+3 {
+		return nil, fmt.Errorf("jpeg: invalid scan header")
+	}
+
+	// we only handle a single scan with every component in it
+	if int(sos[0]) != len(frame) {
+		return nil, nil
+	}
+
+	hMax, vMax := 1, 1
+	for _, c := range frame {
+		if c.H < 1 || c.V < 1 {
+			return nil, fmt.Errorf("jpeg: invalid sampling factor")
+		}
+		hMax = max(hMax, c.H)
+		vMax = max(vMax, c.V)
+	}
+
+	var components []jpegScanComponent
+
+	for i := range int(sos[0]) {
+		id := sos[1+i*2]
+		selector := sos[2+i*2]
+
+		index := slices.IndexFunc(frame, func(c frameComponent) bool { return c.ID == id })
+		if index < 0 {
+			return nil, fmt.Errorf("jpeg: scan refers to unknown component %d", id)
+		}
+
+		c := jpegScanComponent{
+			H:  frame[index].H,
+			V:  frame[index].V,
+			DC: int(selector >> 4),
+			AC: int(selector & 0x0f),
+		}
+		if c.DC > 3 || c.AC > 3 || !hasTable[c.DC] || !hasTable[4+c.AC] {
+			return nil, fmt.Errorf("jpeg: scan refers to missing huffman table")
+		}
+
+		components = append(components, c)
+	}
+
+	mcusX := (width + 8*hMax - 1) / (8 * hMax)
+	mcusY := (height + 8*vMax - 1) / (8 * vMax)
+
+	// single component scan is not interleaved,
+	// each block is a MCU
+	if len(components) == 1 {
+		c := components[0]
+		mcusX = ((width*c.H+hMax-1)/hMax + 7) / 8
+		mcusY = ((height*c.V+vMax-1)/vMax + 7) / 8
+		components[0].H, components[0].V = 1, 1
+	}
+
+	var decoders [8]jpegHuffmanDecoder
+	for i, table := range tables {
+		if hasTable[i] {
+			decoders[i] = newJpegHuffmanDecoder(table)
+		}
+	}
+
+	// ===========================
+	// count symbols
+	// ===========================
+	var freqs [8][256]int
+	var used [8]bool
+
+	scanEnd, err := walkJpegScan(
+		data, pos, components, mcusX, mcusY, &decoders,
+		func(symbol jpegScanSymbol) {
+			freqs[symbol.Table][symbol.Symbol]++
+			used[symbol.Table] = true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the end of image should come after the scan,
+	// anything else means there are more scans
+	for scanEnd < len(data) && !(data[scanEnd] == 0xff && scanEnd+1 < len(data) && data[scanEnd+1] != 0x00 && data[scanEnd+1] != 0xff) {
+		scanEnd++
+	}
+	if scanEnd+1 >= len(data) || data[scanEnd+1] != 0xd9 {
+		return nil, nil
+	}
+
+	// ===========================
+	// write it back with new tables
+	// ===========================
+	var encoders [8]jpegHuffmanEncoder
+
+	out := make([]byte, 0, len(data))
+	out = append(out, header...)
+
+	var dht []byte
+	for i := range 8 {
+		if !used[i] {
+			continue
+		}
+		table := optimalJpegHuffmanTable(freqs[i])
+		encoders[i] = newJpegHuffmanEncoder(table)
+
+		dht = append(dht, byte(i/4)<<4|byte(i%4))
+		for l := 1; l <= 16; l++ {
+			dht = append(dht, byte(table.Bits[l]))
+		}
+		dht = append(dht, table.Values...)
+	}
+
+	out = append(out, 0xff, 0xc4)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(dht)+2))
+	out = append(out, dht...)
+
+	out = append(out, sosRaw...)
+
+	bw := jpegBitWriter{out: out}
+
+	_, err = walkJpegScan(
+		data, pos, components, mcusX, mcusY, &decoders,
+		func(symbol jpegScanSymbol) {
+			enc := &encoders[symbol.Table]
+			bw.writeBits(uint32(enc.codes[symbol.Symbol]), int(enc.sizes[symbol.Symbol]))
+			bw.writeBits(symbol.Extra, symbol.NExtra)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	bw.flush()
+
+	out = append(bw.out, data[scanEnd:]...)
+
+	return out, nil
+}
@@ -0,0 +1,153 @@
+package compiler
+
+import (
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// what CompileBlog did to posts
+type BuildReport struct {
+	// see PublishBuild
+	Build BuildInfo
+
+	Posts []PostBuildReport
+
+	// bytes saved by sharing files between posts
+	DedupSaved int64
+
+	// how big compiled posts are
+	Sizes SizeReport
+
+	// posts that failed to compile, see KeepFailedPosts
+	Failed []FailedPost
+
+	// every error and warning we found
+	Diagnostics []Diagnostic
+}
+
+type FailedPost struct {
+	UUID uuid.UUID
+	Name string
+	Dir  string
+
+	// see BuildReport.Diagnostics for details
+	Error string
+
+	// output from previous build is still published,
+	// otherwise post was left out
+	KeptPrevious bool
+}
+
+// some posts failed to compile but we published the rest
+func (br *BuildReport) Partial() bool {
+	return len(br.Failed) > 0
+}
+
+type PostBuildReport struct {
+	UUID uuid.UUID
+	Name string
+	Dir  string
+
+	// files linked from previous build instead of copied
+	LinkedFiles int
+
+	// thumbnail file we left out of output,
+	// only thumbnails we generated from it are used
+	LeftOutThumbnail string
+
+	// images in output we removed metadata from
+	StrippedMetadata []StrippedMetadata
+
+	// images in output we made smaller
+	OptimizedImages []OptimizedImage
+
+	// files now shared with other posts
+	DedupedAssets []DedupedAsset
+}
+
+// prints things worth knowing about
+func (br *BuildReport) Log(logger *log.Logger) {
+	linked := 0
+	for _, post := range br.Posts {
+		linked += post.LinkedFiles
+	}
+	if linked > 0 {
+		logger.Printf("linked %d unchanged files from previous build", linked)
+	}
+
+	for _, post := range br.Posts {
+		if post.LeftOutThumbnail != "" {
+			logger.Printf(
+				"post \"%s\": left %s out, only thumbnails generated from it are used",
+				post.Name, post.LeftOutThumbnail,
+			)
+		}
+
+		if len(post.StrippedMetadata) > 0 {
+			total := 0
+			for _, stripped := range post.StrippedMetadata {
+				total += stripped.Bytes
+			}
+
+			logger.Printf(
+				"post \"%s\": stripped metadata from %d images (%d bytes)",
+				post.Name, len(post.StrippedMetadata), total,
+			)
+			for _, stripped := range post.StrippedMetadata {
+				logger.Printf(
+					"    %s: %s", stripped.File, strings.Join(stripped.Kinds, ", "),
+				)
+			}
+		}
+
+		if len(post.OptimizedImages) > 0 {
+			saved := 0
+			for _, optimized := range post.OptimizedImages {
+				saved += optimized.Before - optimized.After
+			}
+
+			logger.Printf(
+				"post \"%s\": optimized %d images, saved %d bytes",
+				post.Name, len(post.OptimizedImages), saved,
+			)
+		}
+
+		for _, asset := range post.DedupedAssets {
+			how := "removed"
+			if asset.HardLinked {
+				how = "hard linked"
+			} else if !asset.Removed {
+				how = "kept"
+			}
+
+			logger.Printf(
+				"post \"%s\": %s is shared as %s (%s)",
+				post.Name, asset.File, asset.SharedURL, how,
+			)
+		}
+	}
+
+	if br.DedupSaved != 0 {
+		logger.Printf("sharing files between posts saved %d bytes", br.DedupSaved)
+	}
+
+	br.Sizes.Log(logger)
+
+	for _, failed := range br.Failed {
+		how := "left out"
+		if failed.KeptPrevious {
+			how = "kept previous output"
+		}
+		logger.Printf("post \"%s\" failed to compile, %s", failed.Name, how)
+	}
+
+	for _, diagnostic := range br.Diagnostics {
+		// already printed with sizes
+		if diagnostic.Code == DiagnosticSizeBudget {
+			continue
+		}
+		logger.Print(diagnostic.String())
+	}
+}
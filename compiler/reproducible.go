@@ -0,0 +1,417 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// ===========================
+// normalizing output
+// ===========================
+
+// modification time of every file in compiled output
+//
+// it's unix epoch unless SOURCE_DATE_EPOCH is set
+var OutputModTime = sourceDateEpoch()
+
+func sourceDateEpoch() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0).UTC()
+		}
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// gives everything in dir the same permission and modification time
+// so that output only depends on what's in it
+func NormalizeOutput(dir string) error {
+	var dirs []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			// touching files changes directory times,
+			// so directories are done after
+			dirs = append(dirs, path)
+			return os.Chmod(path, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if err := os.Chmod(path, 0644); err != nil {
+			return err
+		}
+		return os.Chtimes(path, OutputModTime, OutputModTime)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dirPath := range slices.Backward(dirs) {
+		if err := os.Chtimes(dirPath, OutputModTime, OutputModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ===========================
+// source stamps
+// ===========================
+
+// remembers where files in output were copied from,
+// keyed by their path once the build is done
+//
+// it can be deleted any time, files just get copied again
+type SourceStamps struct {
+	mu sync.Mutex
+
+	previous map[string]util.SourceStamp
+	current  map[string]util.SourceStamp
+}
+
+// loads stamps of previous build from name
+// missing or broken file gives empty stamps
+func LoadSourceStamps(name string) *SourceStamps {
+	stamps := &SourceStamps{
+		previous: make(map[string]util.SourceStamp),
+		current:  make(map[string]util.SourceStamp),
+	}
+
+	if name == "" {
+		return stamps
+	}
+
+	jsonBytes, err := os.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			util.WarnLogger.Printf("failed to read source stamps %s: %v", name, err)
+		}
+		return stamps
+	}
+
+	if err := json.Unmarshal(jsonBytes, &stamps.previous); err != nil {
+		util.WarnLogger.Printf("ignoring broken source stamps %s: %v", name, err)
+		stamps.previous = make(map[string]util.SourceStamp)
+	}
+
+	return stamps
+}
+
+func stampKey(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// returns stamp of file at path from previous build,
+// zero if we don't know
+func (ss *SourceStamps) Previous(path string) util.SourceStamp {
+	if ss == nil || path == "" {
+		return util.SourceStamp{}
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.previous[stampKey(path)]
+}
+
+// remembers that file that ends up at path was copied from a file that looked like stamp
+func (ss *SourceStamps) Record(path string, stamp util.SourceStamp) {
+	if ss == nil || path == "" {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.current[stampKey(path)] = stamp
+}
+
+// saves stamps recorded in this build
+func (ss *SourceStamps) Save(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	jsonBytes, err := json.Marshal(ss.current)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	return util.ReplaceFile(name, jsonBytes, 0644)
+}
+
+// ===========================
+// checking output
+// ===========================
+
+// difference between committed and rebuilt output
+type OutputDiff struct {
+	// starts with name of output directory
+	File    string
+	Problem string
+}
+
+func (od OutputDiff) String() string {
+	return fmt.Sprintf("%s: %s", od.File, od.Problem)
+}
+
+// rebuilds posts in postRoot from post list in postListPath
+// into a temporary directory and compares it with outDir and assetsDir
+//
+// returns what's different, nothing means output is up to date
+func CheckBuild(postRoot string, postListPath string, outDir string, assetsDir string) ([]OutputDiff, error) {
+	postList, err := postlist.LoadPostList(postListPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "blog_check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	checkOutDir := filepath.Join(tmpDir, "posts")
+	checkAssetsDir := filepath.Join(tmpDir, "assets")
+
+	// build has to leave real output and things about it alone,
+	// caches too so it doesn't get fooled by what's in them
+	opts := compileOptions{
+		builds:                  buildStore{AssetsPath: checkAssetsDir},
+		imageCachePath:          filepath.Join(tmpDir, "cache", "images"),
+		optimizedImageCachePath: filepath.Join(tmpDir, "cache", "optimized"),
+	}
+
+	rebuiltList, _, err := compileBlog(postRoot, postList, checkOutDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []OutputDiff
+
+	for _, post := range postList.Posts {
+		postDirPath := filepath.Join(postRoot, post.Dir)
+
+		ignore, err := postlist.LoadPostIgnore(postRoot, postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		fileHash, err := postlist.GetPostFileHashFromDir(postDirPath, ignore, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if fileHash != post.FileHash {
+			diffs = append(diffs, OutputDiff{
+				File:    filepath.ToSlash(postDirPath),
+				Problem: "changed since post list was updated",
+			})
+		}
+	}
+
+	if !postListsEqual(postList, rebuiltList) {
+		diffs = append(diffs, OutputDiff{
+			File:    filepath.ToSlash(postListPath),
+			Problem: "compiling gives different post list",
+		})
+	}
+
+	postDiffs, err := compareDirs(checkOutDir, outDir, filepath.Base(outDir), nil)
+	if err != nil {
+		return nil, err
+	}
+	diffs = append(diffs, postDiffs...)
+
+	// only hash directories are ours
+	assetDiffs, err := compareDirs(checkAssetsDir, assetsDir, filepath.Base(assetsDir), func(relPath string) bool {
+		first, _, _ := strings.Cut(relPath, "/")
+		return isSha256Hex(first)
+	})
+	if err != nil {
+		return nil, err
+	}
+	diffs = append(diffs, assetDiffs...)
+
+	return diffs, nil
+}
+
+func postListsEqual(a, b model.PostList) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
+
+// compares files in want and got
+//
+// modification times are not compared because git doesn't keep them,
+// permissions are only compared for whether they are executable
+//
+// files that include returns false for are skipped, include can be nil
+func compareDirs(want string, got string, prefix string, include func(relPath string) bool) ([]OutputDiff, error) {
+	list := func(dir string) (map[string]fs.FileInfo, error) {
+		files := make(map[string]fs.FileInfo)
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			if include != nil && !include(rel) {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files[rel] = info
+
+			return nil
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			return files, nil
+		}
+
+		return files, err
+	}
+
+	wantFiles, err := list(want)
+	if err != nil {
+		return nil, err
+	}
+	gotFiles, err := list(got)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range wantFiles {
+		names = append(names, name)
+	}
+	for name := range gotFiles {
+		if _, ok := wantFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var diffs []OutputDiff
+
+	for _, name := range names {
+		wantInfo, inWant := wantFiles[name]
+		gotInfo, inGot := gotFiles[name]
+
+		diff := OutputDiff{File: prefix + "/" + name}
+
+		switch {
+		case !inGot:
+			diff.Problem = "missing"
+		case !inWant:
+			diff.Problem = "should not be there"
+		case !wantInfo.Mode().IsRegular() || !gotInfo.Mode().IsRegular():
+			if wantInfo.Mode().Type() != gotInfo.Mode().Type() {
+				diff.Problem = fmt.Sprintf("is %v, should be %v", gotInfo.Mode().Type(), wantInfo.Mode().Type())
+			}
+		case wantInfo.Size() != gotInfo.Size():
+			diff.Problem = fmt.Sprintf("is %d bytes, should be %d", gotInfo.Size(), wantInfo.Size())
+		default:
+			same, err := sameContent(filepath.Join(want, name), filepath.Join(got, name))
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				diff.Problem = "content differs"
+			} else if wantInfo.Mode().Perm()&0111 != gotInfo.Mode().Perm()&0111 {
+				diff.Problem = fmt.Sprintf("mode is %v, should be %v", gotInfo.Mode().Perm(), wantInfo.Mode().Perm())
+			}
+		}
+
+		if diff.Problem != "" {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+func sameContent(a string, b string) (bool, error) {
+	aFile, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+
+	bFile, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	aBuf := make([]byte, 64*1024)
+	bBuf := make([]byte, 64*1024)
+
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		bN, bErr := io.ReadFull(bFile, bBuf)
+
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+
+		aDone := errors.Is(aErr, io.EOF) || errors.Is(aErr, io.ErrUnexpectedEOF)
+		bDone := errors.Is(bErr, io.EOF) || errors.Is(bErr, io.ErrUnexpectedEOF)
+
+		if aErr != nil && !aDone {
+			return false, aErr
+		}
+		if bErr != nil && !bDone {
+			return false, bErr
+		}
+		if aDone || bDone {
+			return aDone == bDone, nil
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"blog/assets"
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// size recommended for og:image
+const (
+	ShareImageWidth  = 1200
+	ShareImageHeight = 630
+)
+
+const ShareImageName = "post-share.png"
+
+const shareImagePadding = 80
+
+// title gets smaller until it fits in shareImageMaxTitleLines
+var shareImageTitleSizes = []float64{72, 60, 48}
+
+const shareImageMaxTitleLines = 4
+
+type ShareImageConfig struct {
+	SiteName string
+	// prepended to urls in page metadata,
+	// link previews usually want absolute urls
+	// so set this to something like https://example.com
+	SiteURL string
+
+	Background color.RGBA
+	Foreground color.RGBA
+}
+
+var ShareImageSettings = ShareImageConfig{
+	SiteName:   "Kewl Blog",
+	Background: color.RGBA{0x1e, 0x1e, 0x2e, 0xff},
+	Foreground: color.RGBA{0xf5, 0xf5, 0xf5, 0xff},
+}
+
+// parses colors like #rrggbb or #rgb
+func ParseHexColor(str string) (color.RGBA, error) {
+	hex, ok := strings.CutPrefix(str, "#")
+	if !ok {
+		return color.RGBA{}, fmt.Errorf("color %q doesn't start with #", str)
+	}
+
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("color %q is not #rrggbb or #rgb", str)
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("color %q is not #rrggbb or #rgb", str)
+	}
+
+	return color.RGBA{
+		R: uint8(value >> 16),
+		G: uint8(value >> 8),
+		B: uint8(value),
+		A: 0xff,
+	}, nil
+}
+
+var shareImageFonts = sync.OnceValues(func() ([2]*opentype.Font, error) {
+	var fonts [2]*opentype.Font
+
+	bold, err := opentype.Parse(assets.RobotoMonoBold)
+	if err != nil {
+		return fonts, err
+	}
+	regular, err := opentype.Parse(assets.RobotoMonoRegular)
+	if err != nil {
+		return fonts, err
+	}
+
+	fonts[0], fonts[1] = bold, regular
+
+	return fonts, nil
+})
+
+// renders share image for post to postOutDir
+// returns the file name of the image
+func GenerateShareImage(post model.Post, postOutDir string) (string, error) {
+	fonts, err := shareImageFonts()
+	if err != nil {
+		return "", err
+	}
+	bold, regular := fonts[0], fonts[1]
+
+	newFace := func(f *opentype.Font, size float64) (font.Face, error) {
+		return opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+	}
+
+	settings := ShareImageSettings
+
+	img := image.NewRGBA(image.Rect(0, 0, ShareImageWidth, ShareImageHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(settings.Background), image.Point{}, draw.Src)
+
+	muted := mixColor(settings.Foreground, settings.Background, 0.6)
+
+	maxWidth := fixed.I(ShareImageWidth - shareImagePadding*2)
+
+	drawText := func(face font.Face, col color.Color, text string, x, y int) {
+		drawer := font.Drawer{
+			Dst:  img,
+			Src:  image.NewUniform(col),
+			Face: face,
+			Dot:  fixed.P(x, y),
+		}
+		drawer.DrawString(text)
+	}
+
+	// ======================
+	// site name
+	// ======================
+	siteFace, err := newFace(regular, 32)
+	if err != nil {
+		return "", err
+	}
+	defer siteFace.Close()
+
+	siteY := shareImagePadding + siteFace.Metrics().Ascent.Ceil()
+	drawText(siteFace, muted, settings.SiteName, shareImagePadding, siteY)
+
+	// ======================
+	// date
+	// ======================
+	dateFace, err := newFace(regular, 36)
+	if err != nil {
+		return "", err
+	}
+	defer dateFace.Close()
+
+	dateY := ShareImageHeight - shareImagePadding
+	drawText(dateFace, muted, post.Date.Format("January 2, 2006"), shareImagePadding, dateY)
+
+	// ======================
+	// title
+	// ======================
+	var titleFace font.Face
+	var titleLines []string
+
+	for _, size := range shareImageTitleSizes {
+		if titleFace != nil {
+			titleFace.Close()
+		}
+		titleFace, err = newFace(bold, size)
+		if err != nil {
+			return "", err
+		}
+		titleLines = wrapText(titleFace, post.Name, maxWidth)
+		if len(titleLines) <= shareImageMaxTitleLines {
+			break
+		}
+	}
+	defer titleFace.Close()
+
+	if len(titleLines) > shareImageMaxTitleLines {
+		titleLines = titleLines[:shareImageMaxTitleLines]
+		last := titleLines[len(titleLines)-1] + "..."
+		for font.MeasureString(titleFace, last) > maxWidth && len(last) > len("...") {
+			_, size := utf8.DecodeLastRuneInString(strings.TrimSuffix(last, "..."))
+			last = last[:len(last)-len("...")-size] + "..."
+		}
+		titleLines[len(titleLines)-1] = last
+	}
+
+	// center title between site name and date
+	lineHeight := titleFace.Metrics().Height.Ceil()
+	titleHeight := lineHeight * len(titleLines)
+	titleTop := siteY + (dateY-dateFace.Metrics().Ascent.Ceil()-siteY-titleHeight)/2
+
+	for i, line := range titleLines {
+		y := titleTop + lineHeight*i + titleFace.Metrics().Ascent.Ceil()
+		drawText(titleFace, settings.Foreground, line, shareImagePadding, y)
+	}
+
+	// accent bar at the bottom
+	draw.Draw(
+		img,
+		image.Rect(0, ShareImageHeight-12, ShareImageWidth, ShareImageHeight),
+		image.NewUniform(settings.Foreground),
+		image.Point{},
+		draw.Src,
+	)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	err = util.ReplaceFile(filepath.Join(postOutDir, ShareImageName), buf.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return ShareImageName, nil
+}
+
+// breaks text into lines that fit in maxWidth
+// words that are too long on their own are broken between characters
+func wrapText(face font.Face, text string, maxWidth fixed.Int26_6) []string {
+	var lines []string
+	line := ""
+
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if font.MeasureString(face, candidate) <= maxWidth {
+			line = candidate
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		for font.MeasureString(face, word) > maxWidth {
+			cut := 0
+			for i, r := range word {
+				if cut > 0 && font.MeasureString(face, word[:i+utf8.RuneLen(r)]) > maxWidth {
+					break
+				}
+				cut = i + utf8.RuneLen(r)
+			}
+			lines = append(lines, word[:cut])
+			word = word[cut:]
+		}
+
+		line = word
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// t is how much of a we want
+func mixColor(a, b color.RGBA, t float64) color.RGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x)*t + float64(y)*(1-t) + 0.5)
+	}
+	return color.RGBA{
+		R: mix(a.R, b.R),
+		G: mix(a.G, b.G),
+		B: mix(a.B, b.B),
+		A: 0xff,
+	}
+}
+
+// picks thumbnail file link previews can show for post
+// returns empty string if there is none and share image has to be generated
+//
+// link previews only reliably show jpeg and png,
+// other raster formats use thumbnail we converted for cards
+func pickShareImage(postDir string, post model.Post) (string, error) {
+	if !post.HasThumbnail {
+		return "", nil
+	}
+
+	thumbnailBytes, err := os.ReadFile(filepath.Join(postDir, filepath.FromSlash(post.Thumbnail)))
+	if err != nil {
+		return "", err
+	}
+
+	format, err := postlist.SniffThumbnailFormat(thumbnailBytes)
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case "jpeg", "png":
+		return post.Thumbnail, nil
+	case "svg":
+		return "", nil
+	}
+
+	return post.ThumbnailRetina, nil
+}
+
+// url of a file in post output that page metadata can refer to
+//
+// postsURLPath is where posts are served from in the site (like "posts")
+func SharedFileURL(postsURLPath string, post model.Post, file string) string {
+	u := url.URL{Path: "/" + path.Join(postsURLPath, post.Dir, filepath.ToSlash(file))}
+	return strings.TrimSuffix(ShareImageSettings.SiteURL, "/") + u.EscapedPath()
+}
+
+// adds open graph tags to <head> that html doesn't have already
+func InjectShareMeta(htmlBytes []byte, title string, imageURL string) []byte {
+	tokenizer := html.NewTokenizer(bytes.NewReader(htmlBytes))
+
+	offset := 0
+	headEnd := -1
+
+	// <head> is optional, without it tags go right before the content
+	// and browsers put them in a head they make up
+	contentStart := -1
+
+	existing := make(map[string]bool)
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		start := offset
+		offset += len(tokenizer.Raw())
+
+		if tokenType == html.TextToken {
+			if contentStart < 0 && len(bytes.TrimSpace(tokenizer.Raw())) > 0 {
+				contentStart = start
+			}
+			continue
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		if token.DataAtom == atom.Body {
+			if contentStart < 0 {
+				contentStart = start
+			}
+			break
+		}
+
+		if token.DataAtom == atom.Head && headEnd < 0 {
+			headEnd = offset
+		}
+
+		if token.DataAtom != atom.Html && contentStart < 0 && headEnd < 0 {
+			contentStart = start
+		}
+
+		if token.DataAtom == atom.Meta {
+			for _, attr := range token.Attr {
+				if attr.Key == "property" || attr.Key == "name" {
+					existing[strings.ToLower(attr.Val)] = true
+				}
+			}
+		}
+	}
+
+	insertAt := headEnd
+	if insertAt < 0 {
+		insertAt = contentStart
+	}
+	if insertAt < 0 {
+		insertAt = len(htmlBytes)
+	}
+
+	var tags strings.Builder
+
+	addTag := func(key, property, content string) {
+		if existing[property] || content == "" {
+			return
+		}
+		fmt.Fprintf(
+			&tags, "\n    <meta %s=\"%s\" content=\"%s\">",
+			key, property, html.EscapeString(content),
+		)
+	}
+
+	addTag("property", "og:title", title)
+	addTag("property", "og:image", imageURL)
+	addTag("name", "twitter:card", "summary_large_image")
+
+	if tags.Len() == 0 {
+		return htmlBytes
+	}
+
+	injected := make([]byte, 0, len(htmlBytes)+tags.Len())
+	injected = append(injected, htmlBytes[:insertAt]...)
+	injected = append(injected, tags.String()...)
+	injected = append(injected, htmlBytes[insertAt:]...)
+
+	return injected
+}
@@ -0,0 +1,333 @@
+package compiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// how many of the largest files we list per post
+const SizeReportLargestCount = 5
+
+type FileSize struct {
+	// relative to post output directory
+	File string
+	Size int64
+}
+
+type TypeSize struct {
+	// lowercased extension without the dot, "other" if there is none
+	Type  string
+	Size  int64
+	Files int
+}
+
+type PostSizeReport struct {
+	UUID uuid.UUID
+	Name string
+	Dir  string
+
+	Total int64
+	Files int
+
+	// biggest first
+	Largest []FileSize
+	// biggest first
+	ByType []TypeSize
+}
+
+// how big compiled posts are
+type SizeReport struct {
+	// every post and shared assets they use
+	Total int64
+
+	// see DedupPostAssets
+	SharedAssets int64
+
+	Posts []PostSizeReport
+
+	// budgets that got exceeded, see SizeBudget
+	Warnings []string
+	Failures []string
+}
+
+// measures compiled posts in outDir
+//
+// sharedAssetDirs are directories of shared files posts use
+func ComputeSizeReport(outDir string, postList model.PostList, sharedAssetDirs []string) (SizeReport, error) {
+	var report SizeReport
+
+	for _, post := range postList.Posts {
+		postReport, err := computePostSize(filepath.Join(outDir, post.Dir))
+		if err != nil {
+			return SizeReport{}, err
+		}
+
+		postReport.UUID = post.UUID
+		postReport.Name = post.Name
+		postReport.Dir = post.Dir
+
+		report.Total += postReport.Total
+		report.Posts = append(report.Posts, postReport)
+	}
+
+	for _, dir := range sharedAssetDirs {
+		size, err := computePostSize(dir)
+		if err != nil {
+			return SizeReport{}, err
+		}
+		report.SharedAssets += size.Total
+	}
+	report.Total += report.SharedAssets
+
+	return report, nil
+}
+
+// size report of what's currently in outDir,
+// checked against budget in SizeBudgetPath
+func CurrentSizeReport(outDir string) (SizeReport, error) {
+	postList, err := postlist.LoadPostList(postlist.PostListPath)
+	if err != nil {
+		return SizeReport{}, err
+	}
+
+	// build removes shared assets it doesn't use
+	sharedAssets, err := ListSharedAssets(SharedAssetsPath)
+	if err != nil {
+		return SizeReport{}, err
+	}
+
+	var sharedAssetDirs []string
+	for _, hash := range sharedAssets {
+		sharedAssetDirs = append(sharedAssetDirs, filepath.Join(SharedAssetsPath, hash))
+	}
+
+	report, err := ComputeSizeReport(outDir, postList, sharedAssetDirs)
+	if err != nil {
+		return SizeReport{}, err
+	}
+
+	budget, err := LoadSizeBudget(SizeBudgetPath)
+	if err != nil {
+		return SizeReport{}, err
+	}
+	budget.Check(&report)
+
+	return report, nil
+}
+
+func computePostSize(dir string) (PostSizeReport, error) {
+	var report PostSizeReport
+
+	var files []FileSize
+	types := make(map[string]*TypeSize)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		report.Total += info.Size()
+		report.Files++
+
+		files = append(files, FileSize{File: filepath.ToSlash(rel), Size: info.Size()})
+
+		fileType := strings.TrimPrefix(util.ExtLowered(path), ".")
+		if fileType == "" {
+			fileType = "other"
+		}
+		if types[fileType] == nil {
+			types[fileType] = &TypeSize{Type: fileType}
+		}
+		types[fileType].Size += info.Size()
+		types[fileType].Files++
+
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return PostSizeReport{}, err
+	}
+
+	slices.SortStableFunc(files, func(a, b FileSize) int {
+		return compareSizeDesc(a.Size, b.Size)
+	})
+	report.Largest = files[:min(len(files), SizeReportLargestCount)]
+
+	for _, typeSize := range types {
+		report.ByType = append(report.ByType, *typeSize)
+	}
+	slices.SortFunc(report.ByType, func(a, b TypeSize) int {
+		if c := compareSizeDesc(a.Size, b.Size); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Type, b.Type)
+	})
+
+	return report, nil
+}
+
+func compareSizeDesc(a, b int64) int {
+	switch {
+	case a > b:
+		return -1
+	case a < b:
+		return 1
+	}
+	return 0
+}
+
+// prints summary of report
+func (sr *SizeReport) Log(logger *log.Logger) {
+	logger.Printf(
+		"%s in %d posts (shared assets %s)",
+		util.FormatByteSize(sr.Total), len(sr.Posts), util.FormatByteSize(sr.SharedAssets),
+	)
+
+	posts := slices.Clone(sr.Posts)
+	slices.SortStableFunc(posts, func(a, b PostSizeReport) int {
+		return compareSizeDesc(a.Total, b.Total)
+	})
+
+	for _, post := range posts {
+		var types []string
+		for _, typeSize := range post.ByType[:min(len(post.ByType), 3)] {
+			types = append(types, fmt.Sprintf("%s %s", typeSize.Type, util.FormatByteSize(typeSize.Size)))
+		}
+
+		logger.Printf(
+			"    %-24s %10s  %s",
+			post.Dir, util.FormatByteSize(post.Total), strings.Join(types, ", "),
+		)
+		for _, file := range post.Largest {
+			logger.Printf("        %10s  %s", util.FormatByteSize(file.Size), file.File)
+		}
+	}
+
+	for _, warning := range sr.Warnings {
+		logger.Printf("warning: %s", warning)
+	}
+	for _, failure := range sr.Failures {
+		logger.Printf("over budget: %s", failure)
+	}
+}
+
+// ===========================
+// budgets
+// ===========================
+
+// 0 means no limit
+type SizeLimit struct {
+	// exceeding it gives a warning
+	Warn util.ByteSize
+	// exceeding it fails the build
+	Max util.ByteSize
+}
+
+type SizeBudget struct {
+	// every post and shared assets together
+	Site SizeLimit
+
+	// applies to posts that are not in Posts
+	Post SizeLimit
+
+	// by post directory
+	Posts map[string]SizeLimit
+}
+
+// loads budget from json file
+// missing file means no budget
+func LoadSizeBudget(name string) (SizeBudget, error) {
+	if name == "" {
+		return SizeBudget{}, nil
+	}
+
+	jsonBytes, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return SizeBudget{}, nil
+	}
+	if err != nil {
+		return SizeBudget{}, err
+	}
+
+	var budget SizeBudget
+	if err := json.Unmarshal(jsonBytes, &budget); err != nil {
+		return SizeBudget{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return budget, nil
+}
+
+// fills in Warnings and Failures of report
+// and returns them as diagnostics
+func (sb *SizeBudget) Check(report *SizeReport) []Diagnostic {
+	report.Warnings = nil
+	report.Failures = nil
+
+	var diagnostics []Diagnostic
+
+	check := func(what string, post *PostSizeReport, size int64, limit SizeLimit) {
+		diagnostic := Diagnostic{Code: DiagnosticSizeBudget}
+		if post != nil {
+			diagnostic.UUID = post.UUID
+			diagnostic.Dir = post.Dir
+		}
+
+		if limit.Max > 0 && size > int64(limit.Max) {
+			diagnostic.Severity = SeverityError
+			diagnostic.Message = fmt.Sprintf(
+				"%s is %s, more than %s", what, util.FormatByteSize(size), util.FormatByteSize(int64(limit.Max)),
+			)
+			report.Failures = append(report.Failures, diagnostic.Message)
+		} else if limit.Warn > 0 && size > int64(limit.Warn) {
+			diagnostic.Severity = SeverityWarning
+			diagnostic.Message = fmt.Sprintf(
+				"%s is %s, more than %s", what, util.FormatByteSize(size), util.FormatByteSize(int64(limit.Warn)),
+			)
+			report.Warnings = append(report.Warnings, diagnostic.Message)
+		} else {
+			return
+		}
+
+		diagnostics = append(diagnostics, diagnostic)
+	}
+
+	check("site", nil, report.Total, sb.Site)
+
+	for i, post := range report.Posts {
+		limit, ok := sb.Posts[post.Dir]
+		if !ok {
+			limit = sb.Post
+		}
+		check(fmt.Sprintf("post \"%s\" in \"%s\"", post.Name, post.Dir), &report.Posts[i], post.Total, limit)
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,290 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+// width of post box in /public/main-page/style.css
+const ThumbnailCardWidth = 350
+
+// thumbnail for high dpi screens
+const ThumbnailRetinaWidth = ThumbnailCardWidth * 2
+
+const thumbnailJpegQuality = 85
+
+// placeholder is meant to be stretched and blurred,
+// so it can be really tiny
+const (
+	thumbnailPlaceholderWidth       = 16
+	thumbnailPlaceholderJpegQuality = 50
+)
+
+const (
+	ThumbnailCardName   = "post-thumbnail.card"
+	ThumbnailRetinaName = "post-thumbnail.card@2x"
+)
+
+// generate card sized and retina sized thumbnails in postOutDir
+//
+// thumbnailPath is relative to postDir
+func GenerateThumbnails(postDir, postOutDir, thumbnailPath string) (model.GeneratedThumbnails, error) {
+	thumbnailBytes, err := os.ReadFile(filepath.Join(postDir, filepath.FromSlash(thumbnailPath)))
+	if err != nil {
+		return model.GeneratedThumbnails{}, err
+	}
+
+	format, err := postlist.SniffThumbnailFormat(thumbnailBytes)
+	if err != nil {
+		return model.GeneratedThumbnails{}, fmt.Errorf("thumbnail %s: %w", thumbnailPath, err)
+	}
+
+	// svg is already web friendly and scales however we want
+	if format == "svg" {
+		width, height := postlist.SVGDimension(thumbnailBytes)
+
+		var aspectRatio float64
+		if width > 0 && height > 0 {
+			aspectRatio = float64(width) / float64(height)
+		}
+
+		return model.GeneratedThumbnails{
+			Width:  width,
+			Height: height,
+
+			Card:       thumbnailPath,
+			CardWidth:  width,
+			CardHeight: height,
+
+			Retina:       thumbnailPath,
+			RetinaWidth:  width,
+			RetinaHeight: height,
+
+			AspectRatio: aspectRatio,
+		}, nil
+	}
+
+	// animated gif loses its animation, but it's a thumbnail
+	src, _, err := image.Decode(bytes.NewReader(thumbnailBytes))
+	if err != nil {
+		return model.GeneratedThumbnails{}, fmt.Errorf("thumbnail %s is corrupt: %w", thumbnailPath, err)
+	}
+
+	// browsers turn the original upright with EXIF orientation,
+	// what we encode doesn't have it so we have to do that ourselves
+	src = util.OrientImage(src, util.ImageOrientation(thumbnailBytes))
+
+	srcWidth := src.Bounds().Dx()
+	srcHeight := src.Bounds().Dy()
+
+	if srcWidth <= 0 || srcHeight <= 0 {
+		return model.GeneratedThumbnails{}, fmt.Errorf("thumbnail %s is empty", thumbnailPath)
+	}
+
+	// use jpeg if we don't need transparency
+	ext := ".jpg"
+	if !isOpaque(src) {
+		ext = ".png"
+	}
+
+	writeThumbnail := func(name string, width int) (string, int, int, error) {
+		width = min(width, srcWidth)
+		height := max(1, (srcHeight*width+srcWidth/2)/srcWidth)
+
+		resized := src
+		if width != srcWidth {
+			resized = resizeImage(src, width, height)
+		}
+
+		var buf bytes.Buffer
+		if err := encodeThumbnail(&buf, resized, ext); err != nil {
+			return "", 0, 0, err
+		}
+
+		if err := util.ReplaceFile(filepath.Join(postOutDir, name+ext), buf.Bytes(), 0644); err != nil {
+			return "", 0, 0, err
+		}
+
+		return name + ext, width, height, nil
+	}
+
+	thumbnails := model.GeneratedThumbnails{
+		Width:  srcWidth,
+		Height: srcHeight,
+
+		AspectRatio: float64(srcWidth) / float64(srcHeight),
+	}
+
+	thumbnails.Card, thumbnails.CardWidth, thumbnails.CardHeight, err = writeThumbnail(
+		ThumbnailCardName, ThumbnailCardWidth,
+	)
+	if err != nil {
+		return model.GeneratedThumbnails{}, err
+	}
+
+	thumbnails.Retina, thumbnails.RetinaWidth, thumbnails.RetinaHeight, err = writeThumbnail(
+		ThumbnailRetinaName, ThumbnailRetinaWidth,
+	)
+	if err != nil {
+		return model.GeneratedThumbnails{}, err
+	}
+
+	thumbnails.Placeholder, err = thumbnailPlaceholder(src, ext)
+	if err != nil {
+		return model.GeneratedThumbnails{}, err
+	}
+
+	thumbnails.DominantColor = dominantColor(src)
+
+	return thumbnails, nil
+}
+
+// removes thumbnail file from postOutDir if nothing uses it
+// besides thumbnails we generated from it
+//
+// returns true if it was removed
+func removeUnusedThumbnail(postOutDir string, post model.Post) (bool, error) {
+	// derived thumbnail is part of post content
+	if !post.HasThumbnail || post.ThumbnailDerived {
+		return false, nil
+	}
+
+	// svg is its own card
+	for _, used := range []string{post.ThumbnailCard, post.ThumbnailRetina, post.ShareImage} {
+		if used == post.Thumbnail {
+			return false, nil
+		}
+	}
+
+	// post can refer to it too
+	occurrences, err := countFileNameOccurrences(postOutDir, map[string]string{post.Thumbnail: ""})
+	if err != nil {
+		return false, err
+	}
+	if occurrences[post.Thumbnail] > 0 {
+		return false, nil
+	}
+
+	if err := os.Remove(filepath.Join(postOutDir, filepath.FromSlash(post.Thumbnail))); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func thumbnailPlaceholder(src image.Image, ext string) (string, error) {
+	width := min(thumbnailPlaceholderWidth, src.Bounds().Dx())
+	height := max(1, (src.Bounds().Dy()*width+src.Bounds().Dx()/2)/src.Bounds().Dx())
+
+	tiny := resizeImage(src, width, height)
+
+	var buf bytes.Buffer
+	mimeType := "image/jpeg"
+
+	if ext == ".png" {
+		mimeType = "image/png"
+		if err := png.Encode(&buf, tiny); err != nil {
+			return "", err
+		}
+	} else {
+		if err := jpeg.Encode(&buf, tiny, &jpeg.Options{Quality: thumbnailPlaceholderJpegQuality}); err != nil {
+			return "", err
+		}
+	}
+
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// find the most common color in image
+//
+// colors are bucketed so that similar colors count as the same color,
+// and we return average of the biggest bucket
+func dominantColor(src image.Image) string {
+	// we don't need every pixel to find out
+	const sampleWidth = 64
+
+	width := min(sampleWidth, src.Bounds().Dx())
+	height := max(1, (src.Bounds().Dy()*width+src.Bounds().Dx()/2)/src.Bounds().Dx())
+
+	sample := resizeImage(src, width, height).(*image.NRGBA)
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := make(map[uint16]*bucket)
+	var biggest *bucket
+
+	for y := range height {
+		for x := range width {
+			c := sample.NRGBAAt(x, y)
+
+			// ignore mostly transparent pixels
+			if c.A < 128 {
+				continue
+			}
+
+			key := uint16(c.R>>4)<<8 | uint16(c.G>>4)<<4 | uint16(c.B>>4)
+
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+
+			b.count++
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+
+			if biggest == nil || b.count > biggest.count {
+				biggest = b
+			}
+		}
+	}
+
+	if biggest == nil {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"#%02x%02x%02x",
+		biggest.r/biggest.count, biggest.g/biggest.count, biggest.b/biggest.count,
+	)
+}
+
+func encodeThumbnail(w io.Writer, img image.Image, ext string) error {
+	if ext == ".png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailJpegQuality})
+}
+
+func isOpaque(img image.Image) bool {
+	if opaquer, ok := img.(interface{ Opaque() bool }); ok {
+		return opaquer.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -81,6 +81,19 @@ class PostContainer {
         this.Dir = "";
         this.HasThumbnail = false;
         this.Thumbnail = "";
+        this.ThumbnailDerived = false;
+        this.ThumbnailWidth = 0;
+        this.ThumbnailHeight = 0;
+        this.ThumbnailCard = "";
+        this.ThumbnailCardWidth = 0;
+        this.ThumbnailCardHeight = 0;
+        this.ThumbnailRetina = "";
+        this.ThumbnailRetinaWidth = 0;
+        this.ThumbnailRetinaHeight = 0;
+        this.ThumbnailPlaceholder = "";
+        this.ThumbnailDominantColor = "";
+        this.ThumbnailAspectRatio = 0;
+        this.ShareImage = "";
     }
 }
 class Post {
@@ -93,6 +106,19 @@ class Post {
         this.dir = "";
         this.hasThumbnail = false;
         this.thumbnail = "";
+        this.thumbnailDerived = false;
+        this.thumbnailWidth = 0;
+        this.thumbnailHeight = 0;
+        this.thumbnailCard = "";
+        this.thumbnailCardWidth = 0;
+        this.thumbnailCardHeight = 0;
+        this.thumbnailRetina = "";
+        this.thumbnailRetinaWidth = 0;
+        this.thumbnailRetinaHeight = 0;
+        this.thumbnailPlaceholder = "";
+        this.thumbnailDominantColor = "";
+        this.thumbnailAspectRatio = 0;
+        this.shareImage = "";
     }
     setFromPostJsonOrThrow(json) {
         const expect = (value, type, must) => {
@@ -117,6 +143,19 @@ class Post {
         this.dir = expect(json.Dir, 'string', true);
         this.hasThumbnail = expect(json.HasThumbnail, 'boolean', false);
         this.thumbnail = expect(json.Thumbnail, 'string', false);
+        this.thumbnailDerived = expect(json.ThumbnailDerived, 'boolean', false);
+        this.thumbnailWidth = expect(json.ThumbnailWidth, 'number', false);
+        this.thumbnailHeight = expect(json.ThumbnailHeight, 'number', false);
+        this.thumbnailCard = expect(json.ThumbnailCard, 'string', false);
+        this.thumbnailCardWidth = expect(json.ThumbnailCardWidth, 'number', false);
+        this.thumbnailCardHeight = expect(json.ThumbnailCardHeight, 'number', false);
+        this.thumbnailRetina = expect(json.ThumbnailRetina, 'string', false);
+        this.thumbnailRetinaWidth = expect(json.ThumbnailRetinaWidth, 'number', false);
+        this.thumbnailRetinaHeight = expect(json.ThumbnailRetinaHeight, 'number', false);
+        this.thumbnailPlaceholder = expect(json.ThumbnailPlaceholder, 'string', false);
+        this.thumbnailDominantColor = expect(json.ThumbnailDominantColor, 'string', false);
+        this.thumbnailAspectRatio = expect(json.ThumbnailAspectRatio, 'number', false);
+        this.shareImage = expect(json.ShareImage, 'string', false);
     }
     toPostContainer() {
         const container = new PostContainer();
@@ -128,6 +167,19 @@ class Post {
         container.Dir = this.dir;
         container.HasThumbnail = this.hasThumbnail;
         container.Thumbnail = this.thumbnail;
+        container.ThumbnailDerived = this.thumbnailDerived;
+        container.ThumbnailWidth = this.thumbnailWidth;
+        container.ThumbnailHeight = this.thumbnailHeight;
+        container.ThumbnailCard = this.thumbnailCard;
+        container.ThumbnailCardWidth = this.thumbnailCardWidth;
+        container.ThumbnailCardHeight = this.thumbnailCardHeight;
+        container.ThumbnailRetina = this.thumbnailRetina;
+        container.ThumbnailRetinaWidth = this.thumbnailRetinaWidth;
+        container.ThumbnailRetinaHeight = this.thumbnailRetinaHeight;
+        container.ThumbnailPlaceholder = this.thumbnailPlaceholder;
+        container.ThumbnailDominantColor = this.thumbnailDominantColor;
+        container.ThumbnailAspectRatio = this.thumbnailAspectRatio;
+        container.ShareImage = this.shareImage;
         return container;
     }
     clone() {
@@ -435,6 +487,27 @@ function generatePostBoxFromPost(post) {
         console.log(`creating thumbnail for ${post.name}`);
         let thumbnail = document.createElement('img');
         thumbnail.src = "/posts/" + post.dir + "/" + post.thumbnail;
+        // use thumbnails we generated when compiling if there are any
+        if (post.thumbnailCard !== "") {
+            thumbnail.src = "/posts/" + post.dir + "/" + post.thumbnailCard;
+            if (post.thumbnailRetina !== "" && post.thumbnailRetina !== post.thumbnailCard) {
+                thumbnail.srcset = `/posts/${post.dir}/${post.thumbnailCard} 1x, /posts/${post.dir}/${post.thumbnailRetina} 2x`;
+            }
+        }
+        if (post.thumbnailCardWidth > 0 && post.thumbnailCardHeight > 0) {
+            thumbnail.width = post.thumbnailCardWidth;
+            thumbnail.height = post.thumbnailCardHeight;
+        }
+        // reserve space and paint placeholder while thumbnail is loading
+        if (post.thumbnailAspectRatio > 0) {
+            thumbnail.style.aspectRatio = `${post.thumbnailAspectRatio}`;
+        }
+        if (post.thumbnailDominantColor !== "") {
+            thumbnail.style.backgroundColor = post.thumbnailDominantColor;
+        }
+        if (post.thumbnailPlaceholder !== "") {
+            thumbnail.style.backgroundImage = `url("${post.thumbnailPlaceholder}")`;
+        }
         thumbnail.onclick = onclick;
         thumbnail.className = 'post-thumbnail';
         childDiv.append(thumbnail);
@@ -92,6 +92,30 @@ function generatePostBoxFromPost(post: Post): HTMLElement {
         console.log(`creating thumbnail for ${post.name}`)
         let thumbnail = document.createElement('img');
         thumbnail.src = "/posts/" + post.dir + "/" + post.thumbnail
+
+        // use thumbnails we generated when compiling if there are any
+        if (post.thumbnailCard !== "") {
+            thumbnail.src = "/posts/" + post.dir + "/" + post.thumbnailCard
+            if (post.thumbnailRetina !== "" && post.thumbnailRetina !== post.thumbnailCard) {
+                thumbnail.srcset = `/posts/${post.dir}/${post.thumbnailCard} 1x, /posts/${post.dir}/${post.thumbnailRetina} 2x`
+            }
+        }
+        if (post.thumbnailCardWidth > 0 && post.thumbnailCardHeight > 0) {
+            thumbnail.width = post.thumbnailCardWidth
+            thumbnail.height = post.thumbnailCardHeight
+        }
+
+        // reserve space and paint placeholder while thumbnail is loading
+        if (post.thumbnailAspectRatio > 0) {
+            thumbnail.style.aspectRatio = `${post.thumbnailAspectRatio}`
+        }
+        if (post.thumbnailDominantColor !== "") {
+            thumbnail.style.backgroundColor = post.thumbnailDominantColor
+        }
+        if (post.thumbnailPlaceholder !== "") {
+            thumbnail.style.backgroundImage = `url("${post.thumbnailPlaceholder}")`
+        }
+
         thumbnail.onclick = onclick;
         thumbnail.className = 'post-thumbnail'
 
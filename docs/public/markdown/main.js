@@ -81,6 +81,19 @@ class PostContainer {
         this.Dir = "";
         this.HasThumbnail = false;
         this.Thumbnail = "";
+        this.ThumbnailDerived = false;
+        this.ThumbnailWidth = 0;
+        this.ThumbnailHeight = 0;
+        this.ThumbnailCard = "";
+        this.ThumbnailCardWidth = 0;
+        this.ThumbnailCardHeight = 0;
+        this.ThumbnailRetina = "";
+        this.ThumbnailRetinaWidth = 0;
+        this.ThumbnailRetinaHeight = 0;
+        this.ThumbnailPlaceholder = "";
+        this.ThumbnailDominantColor = "";
+        this.ThumbnailAspectRatio = 0;
+        this.ShareImage = "";
     }
 }
 class Post {
@@ -93,6 +106,19 @@ class Post {
         this.dir = "";
         this.hasThumbnail = false;
         this.thumbnail = "";
+        this.thumbnailDerived = false;
+        this.thumbnailWidth = 0;
+        this.thumbnailHeight = 0;
+        this.thumbnailCard = "";
+        this.thumbnailCardWidth = 0;
+        this.thumbnailCardHeight = 0;
+        this.thumbnailRetina = "";
+        this.thumbnailRetinaWidth = 0;
+        this.thumbnailRetinaHeight = 0;
+        this.thumbnailPlaceholder = "";
+        this.thumbnailDominantColor = "";
+        this.thumbnailAspectRatio = 0;
+        this.shareImage = "";
     }
     setFromPostJsonOrThrow(json) {
         const expect = (value, type, must) => {
@@ -117,6 +143,19 @@ class Post {
         this.dir = expect(json.Dir, 'string', true);
         this.hasThumbnail = expect(json.HasThumbnail, 'boolean', false);
         this.thumbnail = expect(json.Thumbnail, 'string', false);
+        this.thumbnailDerived = expect(json.ThumbnailDerived, 'boolean', false);
+        this.thumbnailWidth = expect(json.ThumbnailWidth, 'number', false);
+        this.thumbnailHeight = expect(json.ThumbnailHeight, 'number', false);
+        this.thumbnailCard = expect(json.ThumbnailCard, 'string', false);
+        this.thumbnailCardWidth = expect(json.ThumbnailCardWidth, 'number', false);
+        this.thumbnailCardHeight = expect(json.ThumbnailCardHeight, 'number', false);
+        this.thumbnailRetina = expect(json.ThumbnailRetina, 'string', false);
+        this.thumbnailRetinaWidth = expect(json.ThumbnailRetinaWidth, 'number', false);
+        this.thumbnailRetinaHeight = expect(json.ThumbnailRetinaHeight, 'number', false);
+        this.thumbnailPlaceholder = expect(json.ThumbnailPlaceholder, 'string', false);
+        this.thumbnailDominantColor = expect(json.ThumbnailDominantColor, 'string', false);
+        this.thumbnailAspectRatio = expect(json.ThumbnailAspectRatio, 'number', false);
+        this.shareImage = expect(json.ShareImage, 'string', false);
     }
     toPostContainer() {
         const container = new PostContainer();
@@ -128,6 +167,19 @@ class Post {
         container.Dir = this.dir;
         container.HasThumbnail = this.hasThumbnail;
         container.Thumbnail = this.thumbnail;
+        container.ThumbnailDerived = this.thumbnailDerived;
+        container.ThumbnailWidth = this.thumbnailWidth;
+        container.ThumbnailHeight = this.thumbnailHeight;
+        container.ThumbnailCard = this.thumbnailCard;
+        container.ThumbnailCardWidth = this.thumbnailCardWidth;
+        container.ThumbnailCardHeight = this.thumbnailCardHeight;
+        container.ThumbnailRetina = this.thumbnailRetina;
+        container.ThumbnailRetinaWidth = this.thumbnailRetinaWidth;
+        container.ThumbnailRetinaHeight = this.thumbnailRetinaHeight;
+        container.ThumbnailPlaceholder = this.thumbnailPlaceholder;
+        container.ThumbnailDominantColor = this.thumbnailDominantColor;
+        container.ThumbnailAspectRatio = this.thumbnailAspectRatio;
+        container.ShareImage = this.shareImage;
         return container;
     }
     clone() {
@@ -374,6 +426,22 @@ function blurItAndChildren(element) {
     };
     toRecurse(element);
 }
+function getMediaNaturalSize(media) {
+    var _a, _b;
+    if (media instanceof HTMLVideoElement) {
+        return { width: media.videoWidth, height: media.videoHeight };
+    }
+    // lazy loaded image might not be loaded yet,
+    // so we use width and height attributes if they are there
+    if (media.naturalWidth === 0 && media.naturalHeight === 0) {
+        const width = parseInt((_a = media.getAttribute('width')) !== null && _a !== void 0 ? _a : '');
+        const height = parseInt((_b = media.getAttribute('height')) !== null && _b !== void 0 ? _b : '');
+        if (!isNaN(width) && !isNaN(height)) {
+            return { width: width, height: height };
+        }
+    }
+    return { width: media.naturalWidth, height: media.naturalHeight };
+}
 class Gallery {
     constructor(gallerySection) {
         this.images = [];
@@ -528,7 +596,21 @@ class Gallery {
         this.onResize();
         const waitImageLoading = (img) => {
             return new Promise((res, rej) => {
-                if (img.complete) {
+                if (img instanceof HTMLVideoElement) {
+                    // we only need the video dimension
+                    if (img.readyState >= HTMLMediaElement.HAVE_METADATA) {
+                        res();
+                    }
+                    else {
+                        img.addEventListener('loadedmetadata', () => {
+                            res();
+                        });
+                        img.addEventListener('error', () => {
+                            res();
+                        });
+                    }
+                }
+                else if (img.complete) {
                     res();
                 }
                 else {
@@ -564,8 +646,9 @@ class Gallery {
     onResize() {
         const galleryRect = this.galleryDiv.getBoundingClientRect();
         for (const img of this.images) {
-            let imgWidth = img.naturalWidth;
-            let imgHeight = img.naturalHeight;
+            const naturalSize = getMediaNaturalSize(img);
+            let imgWidth = naturalSize.width;
+            let imgHeight = naturalSize.height;
             // handle missing image
             if (imgWidth === 0 && imgHeight === 0) {
                 const half = Math.min(galleryRect.width, galleryRect.height) * 0.5;
@@ -632,6 +715,18 @@ class Gallery {
                 easing: "ease-out"
             });
         }
+        // only play the video that is selected
+        for (let i = 0; i < this.images.length; i++) {
+            const media = this.images[i];
+            if (media instanceof HTMLVideoElement) {
+                if (i === this.selectedImg) {
+                    media.play().catch(() => { });
+                }
+                else {
+                    media.pause();
+                }
+            }
+        }
         for (const dot of this.galleryDots) {
             dot.classList.remove('gallery-dot-selected');
         }
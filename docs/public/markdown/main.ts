@@ -1,7 +1,27 @@
+type GalleryMedia = HTMLImageElement | HTMLVideoElement
+
+function getMediaNaturalSize(media: GalleryMedia): { width: number, height: number } {
+    if (media instanceof HTMLVideoElement) {
+        return { width: media.videoWidth, height: media.videoHeight }
+    }
+
+    // lazy loaded image might not be loaded yet,
+    // so we use width and height attributes if they are there
+    if (media.naturalWidth === 0 && media.naturalHeight === 0) {
+        const width = parseInt(media.getAttribute('width') ?? '')
+        const height = parseInt(media.getAttribute('height') ?? '')
+        if (!isNaN(width) && !isNaN(height)) {
+            return { width: width, height: height }
+        }
+    }
+
+    return { width: media.naturalWidth, height: media.naturalHeight }
+}
+
 class Gallery {
     static GalleryMargin: number = 10 // constant
 
-    images: Array<HTMLImageElement> = []
+    images: Array<GalleryMedia> = []
 
     selectedImg: number = 0
 
@@ -44,7 +64,7 @@ class Gallery {
         this.galleryContainer = galleryContainer as HTMLElement
         for (let i = 0; i < galleryImages.length; i++) {
             const img = galleryImages[i]
-            this.images.push(img as HTMLImageElement)
+            this.images.push(img as GalleryMedia)
         }
 
         const leftButton = mustSelect('.gallery-button-left')
@@ -190,9 +210,21 @@ class Gallery {
         // ===============================================
         this.onResize()
 
-        const waitImageLoading = (img: HTMLImageElement): Promise<void> => {
+        const waitImageLoading = (img: GalleryMedia): Promise<void> => {
             return new Promise((res, rej) => {
-                if (img.complete) {
+                if (img instanceof HTMLVideoElement) {
+                    // we only need the video dimension
+                    if (img.readyState >= HTMLMediaElement.HAVE_METADATA) {
+                        res()
+                    } else {
+                        img.addEventListener('loadedmetadata', () => {
+                            res()
+                        })
+                        img.addEventListener('error', () => {
+                            res()
+                        })
+                    }
+                } else if (img.complete) {
                     res()
                 } else {
                     img.addEventListener('load', () => {
@@ -236,8 +268,10 @@ class Gallery {
         const galleryRect = this.galleryDiv.getBoundingClientRect()
 
         for (const img of this.images) {
-            let imgWidth = img.naturalWidth
-            let imgHeight = img.naturalHeight
+            const naturalSize = getMediaNaturalSize(img)
+
+            let imgWidth = naturalSize.width
+            let imgHeight = naturalSize.height
 
             // handle missing image
             if (imgWidth === 0 && imgHeight === 0) {
@@ -330,6 +364,18 @@ class Gallery {
             )
         }
 
+        // only play the video that is selected
+        for (let i = 0; i < this.images.length; i++) {
+            const media = this.images[i]
+            if (media instanceof HTMLVideoElement) {
+                if (i === this.selectedImg) {
+                    media.play().catch(() => { })
+                } else {
+                    media.pause()
+                }
+            }
+        }
+
         for (const dot of this.galleryDots) {
             dot.classList.remove('gallery-dot-selected')
         }
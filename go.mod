@@ -3,7 +3,12 @@ module blog
 go 1.24.2
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/yuin/goldmark v1.7.12 // indirect
-	golang.org/x/mod v0.25.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/yuin/goldmark v1.7.12
+	golang.org/x/image v0.28.0
+	golang.org/x/mod v0.25.0
+	golang.org/x/net v0.41.0
+	golang.org/x/sys v0.33.0
 )
+
+require golang.org/x/text v0.26.0 // indirect
@@ -3,24 +3,107 @@ package main
 import (
 	"errors"
 	"flag"
-	"log"
 	"os"
 	"time"
+
+	"blog/compiler"
+	"blog/model"
+	"blog/postlist"
+	"blog/server"
+	"blog/util"
 )
 
-var FlagTest bool
+var (
+	FlagTest       bool
+	FlagSizeReport bool
+	FlagCheck      bool
+	FlagListBuilds bool
+	FlagRollback   string
+	FlagAdopt      bool
+)
 
 func init() {
 	flag.BoolVar(&FlagTest, "test", false,
 		"Serve test posts in posts-test rather than real posts",
 	)
-}
 
-var (
-	ErrLogger  = log.New(os.Stderr, "[ FAIL! ] : ", log.Lshortfile)
-	WarnLogger = log.New(os.Stderr, "[ WARN! ] : ", log.Lshortfile)
-	Logger     = log.New(os.Stdout, "", 0)
-)
+	flag.BoolVar(&FlagSizeReport, "size-report", false,
+		"Print how big compiled posts are and exit",
+	)
+	flag.StringVar(&compiler.SizeBudgetPath, "size-budget", compiler.SizeBudgetPath,
+		"Json file with size budgets of compiled posts",
+	)
+
+	flag.IntVar(&compiler.KeepBuilds, "keep-builds", compiler.KeepBuilds,
+		"How many previous builds to keep for rollback "+
+			"(publishing and rolling back only swap output atomically on linux)",
+	)
+	flag.BoolVar(&FlagListBuilds, "list-builds", false,
+		"List kept builds and exit",
+	)
+	flag.StringVar(&FlagRollback, "rollback", "",
+		"Make build with this id live again and exit",
+	)
+
+	flag.BoolVar(&FlagAdopt, "adopt", false,
+		"Give every post directory without "+postlist.PostUUIDFileName+" a uuid and exit",
+	)
+
+	flag.BoolVar(&FlagCheck, "check", false,
+		"Rebuild posts in a temporary directory, fail if output differs and exit "+
+			"(use the same build flags output was made with)",
+	)
+
+	flag.BoolVar(&compiler.KeepFailedPosts, "keep-failed-posts", false,
+		"Publish previous output of posts that fail to compile instead of failing the build",
+	)
+
+	flag.BoolVar(&compiler.OptimizeImages, "optimize-images", false,
+		"Losslessly recompress png and jpeg files in compiled posts",
+	)
+
+	flag.Func("link-unchanged", "How to bring over files unchanged since the previous build (none, hard, reflink)",
+		func(str string) error {
+			mode, err := util.ParseLinkMode(str)
+			if err != nil {
+				return err
+			}
+			compiler.PreviousBuildLinkMode = mode
+			return nil
+		},
+	)
+
+	flag.BoolVar(&compiler.DedupAssets, "dedup-assets", false,
+		"Store large files that are the same across posts once under public/assets",
+	)
+
+	flag.StringVar(&compiler.ShareImageSettings.SiteName, "site-name", compiler.ShareImageSettings.SiteName,
+		"Site name shown in generated share images",
+	)
+	flag.StringVar(&compiler.ShareImageSettings.SiteURL, "site-url", compiler.ShareImageSettings.SiteURL,
+		"Prepended to share image urls in page metadata (e.g. https://example.com)",
+	)
+	flag.Func("share-background", "Background color of generated share images (#rrggbb)",
+		func(str string) error {
+			col, err := compiler.ParseHexColor(str)
+			if err != nil {
+				return err
+			}
+			compiler.ShareImageSettings.Background = col
+			return nil
+		},
+	)
+	flag.Func("share-foreground", "Text color of generated share images (#rrggbb)",
+		func(str string) error {
+			col, err := compiler.ParseHexColor(str)
+			if err != nil {
+				return err
+			}
+			compiler.ShareImageSettings.Foreground = col
+			return nil
+		},
+	)
+}
 
 func main() {
 	flag.Parse()
@@ -29,44 +112,62 @@ func main() {
 	// set up test
 	// =======================
 	if FlagTest {
-		PostListPath = "test/docs/public/post-list.json"
-		PostsPath = "test/posts-copy"
-		PostsOutPath = "test/docs/posts"
+		postlist.PostListPath = "test/docs/public/post-list.json"
+		server.PostsPath = "test/posts-copy"
+		server.PostsOutPath = "test/docs/posts"
+		compiler.ImageCachePath = "test/cache/images"
+		compiler.OptimizedImageCachePath = "test/cache/optimized"
+		postlist.HashCachePath = "test/cache/hashes.json"
+		compiler.SourceStampsPath = "test/cache/source-stamps.json"
+		compiler.BuildsPath = "test/builds"
+		compiler.SharedAssetsPath = "test/docs/public/assets"
+		server.TestDocsPath = "./test/docs"
 
 		err := os.Mkdir("test", 0755)
 		if err != nil && !errors.Is(err, os.ErrExist) {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
 		}
 
 		// delete PostsOutPath
-		if err := os.RemoveAll(PostsOutPath); err != nil {
-			ErrLogger.Fatal(err)
+		if err := os.RemoveAll(server.PostsOutPath); err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+
+		// delete builds of previous runs
+		if err := os.RemoveAll(compiler.BuildsPath); err != nil {
+			util.ErrLogger.Fatal(err)
 		}
 
 		// delete post root
-		if err := os.RemoveAll(PostsPath); err != nil {
-			ErrLogger.Fatal(err)
+		if err := os.RemoveAll(server.PostsPath); err != nil {
+			util.ErrLogger.Fatal(err)
 		}
 		// copy test/posts to PostsPath
-		if err := os.CopyFS(PostsPath, os.DirFS("test/posts")); err != nil && !errors.Is(err, os.ErrNotExist) {
-			ErrLogger.Fatal(err)
+		if err := os.CopyFS(server.PostsPath, os.DirFS("test/posts")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			util.ErrLogger.Fatal(err)
 		}
 
 		// delete post list
-		if err := DeleteFile(PostListPath); err != nil {
-			ErrLogger.Fatal(err)
+		if err := util.DeleteFile(postlist.PostListPath); err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+
+		// test posts don't come with uuids
+		if _, err := postlist.AdoptPosts(server.PostsPath, nil); err != nil {
+			util.ErrLogger.Fatal(err)
 		}
 
 		// fabricate post list
-		postList, err := GenerateUpdatedPostList(PostsPath, PostList{})
+		hashCache := postlist.LoadHashCache(postlist.HashCachePath)
+		postList, _, err := postlist.GenerateUpdatedPostList(server.PostsPath, model.PostList{}, hashCache)
 		if err != nil {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
 		}
 
 		// assign random creation date
 		startingDate, err := time.Parse(time.DateTime, "2005-06-07 17:35:16")
 		if err != nil {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
 		}
 		for i, post := range postList.Posts {
 			post.Date = startingDate
@@ -74,38 +175,126 @@ func main() {
 			postList.Posts[i] = post
 		}
 
+		postList, report, err := compiler.CompileBlog(server.PostsPath, postList, server.PostsOutPath)
+		if err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+		report.Log(util.Logger)
+
 		// save post list
-		err = SavePostList(postList, PostListPath)
+		err = postlist.SavePostList(postList, postlist.PostListPath)
 		if err != nil {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
+		}
+
+		if err := hashCache.Save(postlist.HashCachePath); err != nil {
+			util.WarnLogger.Printf("failed to save hash cache %s: %v", postlist.HashCachePath, err)
+		}
+	}
+
+	// =======================
+	// adopt posts
+	// =======================
+	if FlagAdopt {
+		adopted, err := postlist.AdoptPosts(server.PostsPath, nil)
+		if err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+
+		for _, post := range adopted {
+			util.Logger.Printf("adopted %s as %s", post.Dir, post.UUID)
 		}
+		util.Logger.Printf("adopted %d posts", len(adopted))
+		return
+	}
+
+	// =======================
+	// builds
+	// =======================
+	if FlagListBuilds {
+		builds, err := compiler.ListBuilds()
+		if err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+
+		for _, build := range builds {
+			live := ""
+			if build.Live {
+				live = " (live)"
+			}
+			util.Logger.Printf("%s  %3d posts%s", build.ID, build.Posts, live)
+		}
+		return
+	}
 
-		err = CompileBlog(PostsPath, postList, PostsOutPath)
+	if FlagRollback != "" {
+		build, _, err := compiler.RollbackBuild(FlagRollback, server.PostsOutPath)
 		if err != nil {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
+		}
+
+		util.Logger.Printf("rolled back to build %s", build.ID)
+		return
+	}
+
+	// =======================
+	// check output
+	// =======================
+	if FlagCheck {
+		diffs, err := compiler.CheckBuild(server.PostsPath, postlist.PostListPath, server.PostsOutPath, compiler.SharedAssetsPath)
+		if err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+
+		for _, diff := range diffs {
+			util.Logger.Print(diff.String())
+		}
+
+		if len(diffs) > 0 {
+			util.ErrLogger.Printf("output differs from sources in %d places", len(diffs))
+			os.Exit(1)
+		}
+
+		util.Logger.Printf("output is up to date")
+		return
+	}
+
+	// =======================
+	// print size report
+	// =======================
+	if FlagSizeReport {
+		sizeReport, err := compiler.CurrentSizeReport(server.PostsOutPath)
+		if err != nil {
+			util.ErrLogger.Fatal(err)
+		}
+		sizeReport.Log(util.Logger)
+
+		if len(sizeReport.Failures) > 0 {
+			os.Exit(1)
 		}
+		return
 	}
 
 	// ==============================================
 	// if there is no post-list, create one
 	// ==============================================
 	{
-		exists, err := FileExists(PostListPath, false)
+		exists, err := util.FileExists(postlist.PostListPath, false)
 		if err != nil {
-			ErrLogger.Fatal(err)
+			util.ErrLogger.Fatal(err)
 		}
 		if !exists {
-			err = SavePostList(PostList{}, PostListPath)
+			err = postlist.SavePostList(model.PostList{}, postlist.PostListPath)
 			if err != nil {
-				ErrLogger.Fatal(err)
+				util.ErrLogger.Fatal(err)
 			}
 		}
 	}
 
-	Logger.Printf("serving http://localhost:6969")
+	util.Logger.Printf("serving http://localhost:6969")
 
-	err := StartServer()
+	err := server.StartServer()
 	if err != nil {
-		ErrLogger.Fatal(err)
+		util.ErrLogger.Fatal(err)
 	}
 }
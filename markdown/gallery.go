@@ -0,0 +1,617 @@
+package markdown
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/yuin/goldmark"
+	gast "github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	gutil "github.com/yuin/goldmark/util"
+
+	"blog/util"
+)
+
+// ==================================
+// node
+// ==================================
+
+type GalleryMediaKind int
+
+const (
+	GalleryMediaImage GalleryMediaKind = iota
+	GalleryMediaAnimated
+	GalleryMediaVideo
+	GalleryMediaKindCount
+)
+
+var GalleryMediaKindStrs = [GalleryMediaKindCount]string{
+	"Image",
+	"Animated",
+	"Video",
+}
+
+func (k GalleryMediaKind) String() string {
+	if 0 <= k && k < GalleryMediaKindCount {
+		return GalleryMediaKindStrs[k]
+	}
+
+	return fmt.Sprintf("unknown GalleryMediaKind(%d)", k)
+}
+
+// get media kind from file extension
+// anything we don't know is treated as an image
+func GalleryMediaKindFromSource(src []byte) GalleryMediaKind {
+	switch util.ExtLowered(string(src)) {
+	case ".mp4", ".webm":
+		return GalleryMediaVideo
+	case ".gif":
+		return GalleryMediaAnimated
+	}
+
+	return GalleryMediaImage
+}
+
+type GalleryImage struct {
+	Kind GalleryMediaKind
+
+	AltText     []byte
+	ImageSource []byte
+
+	// poster frame for videos, can be empty
+	PosterSource []byte
+
+	// responsive image attributes, can be empty
+	SrcSet []byte
+	Sizes  []byte
+
+	// intrinsic size of image, 0 if we don't know
+	Width  int
+	Height int
+}
+
+func (gi GalleryImage) IsVideo() bool {
+	return gi.Kind == GalleryMediaVideo
+}
+
+type Gallery struct {
+	gast.BaseBlock
+
+	// glob pattern relative to post directory
+	// that will be expanded to images at compile time, can be empty
+	Source string
+	// how to sort images found with Source
+	Sort string
+	// sidecar file that holds captions for images found with Source, can be empty
+	Captions string
+
+	// line in markdown source where gallery was opened, starts from 1
+	Line int
+
+	// we found </gallery>
+	closed bool
+
+	Images []GalleryImage
+}
+
+func (g *Gallery) Dump(source []byte, level int) {
+	gast.DumpHelper(g, source, level, nil, nil)
+}
+
+// KindDefinitionList is a NodeKind of the DefinitionList node.
+var KindGallery = gast.NewNodeKind("Gallery")
+
+// Kind implements Node.Kind.
+func (g *Gallery) Kind() gast.NodeKind {
+	return KindGallery
+}
+
+func NewGallery() *Gallery {
+	return &Gallery{}
+}
+
+// ==================================
+// parser
+// ==================================
+
+type galleryParser struct {
+}
+
+var defaultGalleryParser = &galleryParser{}
+
+func NewGalleryParser() parser.BlockParser {
+	return defaultGalleryParser
+}
+
+func (g *galleryParser) Trigger() []byte {
+	return []byte{'<'}
+}
+
+func (b *galleryParser) Open(
+	parent gast.Node,
+	reader text.Reader,
+	pc parser.Context,
+) (gast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+
+	advance := 0
+
+	lineStr := string(line)
+
+	var consumed bool
+
+	lineStr, advance = ConsumeSpace(lineStr, advance)
+
+	if lineStr, advance, consumed = ConsumeLiteral(lineStr, advance, "<gallery"); !consumed {
+		return nil, parser.NoChildren
+	}
+
+	gallery := NewGallery()
+	gallery.Line = bytes.Count(reader.Source()[:segment.Start], []byte{'\n'}) + 1
+
+	// parse attributes
+	for {
+		spaceTrimmed, spaceAdvance := ConsumeSpace(lineStr, advance)
+		if len(spaceTrimmed) == len(lineStr) {
+			break
+		}
+
+		var name, value string
+		if lineStr, advance, name, value, consumed = ConsumeAttribute(spaceTrimmed, spaceAdvance); !consumed {
+			lineStr, advance = spaceTrimmed, spaceAdvance
+			break
+		}
+
+		switch name {
+		case "src":
+			gallery.Source = value
+		case "sort":
+			gallery.Sort = value
+		case "captions":
+			gallery.Captions = value
+		default:
+			return nil, parser.NoChildren
+		}
+	}
+
+	lineStr, advance = ConsumeSpace(lineStr, advance)
+
+	if lineStr, advance, consumed = ConsumeLiteral(lineStr, advance, ">"); !consumed {
+		if lineStr, advance, consumed = ConsumeLiteral(lineStr, advance, "/>"); !consumed {
+			return nil, parser.NoChildren
+		}
+		gallery.closed = true
+	}
+
+	lineStr, advance = ConsumeSpace(lineStr, advance)
+
+	if !gallery.closed {
+		if lineStr, advance, consumed = ConsumeLiteral(lineStr, advance, "</gallery>"); consumed {
+			gallery.closed = true
+		}
+	}
+
+	reader.Advance(advance)
+
+	if gallery.closed {
+		return gallery, parser.NoChildren
+	}
+
+	return gallery, parser.HasChildren
+}
+
+func (b *galleryParser) Continue(
+	node gast.Node,
+	reader text.Reader,
+	pc parser.Context,
+) parser.State {
+	gallery, isGallery := node.(*Gallery)
+	if !isGallery {
+		return parser.Close
+	}
+
+	if gallery.closed {
+		return parser.Close
+	}
+
+	line, _ := reader.PeekLine()
+
+	advance := 0
+
+	lineStr := string(line)
+
+	lineStr, advance = ConsumeSpace(lineStr, advance)
+
+	var consumed bool
+
+	if lineStr, advance, consumed = ConsumeLiteral(lineStr, advance, "</gallery>"); consumed {
+		reader.Advance(advance)
+		gallery.closed = true
+		return parser.Close
+	}
+
+	return parser.Continue | parser.HasChildren
+}
+
+func (b *galleryParser) Close(node gast.Node, reader text.Reader, pc parser.Context) {
+	// gallery can be closed without </gallery>
+	// when we reached the end of document or the container it's in has ended
+	if gallery, isGallery := node.(*Gallery); isGallery && !gallery.closed {
+		AddMarkdownError(pc, &MarkdownDiagnostic{
+			Line:    gallery.Line,
+			Message: "unterminated <gallery>, expected </gallery>",
+		})
+	}
+}
+
+func (b *galleryParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (b *galleryParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// ==================================
+// renderer
+// ==================================
+
+type GalleryHTMLRenderer struct {
+	html.Config
+}
+
+func NewGalleryHTMLRenderer(opts ...html.Option) renderer.NodeRenderer {
+	r := &GalleryHTMLRenderer{
+		Config: html.NewConfig(),
+	}
+	for _, opt := range opts {
+		opt.SetHTMLOption(&r.Config)
+	}
+	return r
+}
+
+// RegisterFuncs implements renderer.NodeRenderer.RegisterFuncs.
+func (r *GalleryHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindGallery, r.renderGallery)
+}
+
+// DefinitionListAttributeFilter defines attribute names which dl elements can have.
+// var DefinitionListAttributeFilter = html.GlobalAttributeFilter
+
+const galleryTemplateText = `
+<section class="gallery-section">
+	<div class="gallery-div">
+		<div class="gallery-img-container">
+			{{- range .Images}}
+			{{- if .IsVideo}}
+			<video class="gallery-img gallery-video" src="{{castStr .ImageSource | escapeURL | html}}"
+				{{- if .PosterSource}} poster="{{castStr .PosterSource | escapeURL | html}}"{{end}} aria-label="{{castStr .AltText| html}}" muted loop playsinline preload="metadata"></video>
+			{{- else}}
+			<img class="gallery-img" src="{{castStr .ImageSource | escapeURL | html}}" alt="{{castStr .AltText| html}}"
+				{{- if .SrcSet}} srcset="{{castStr .SrcSet | html}}" sizes="{{castStr .Sizes | html}}"{{end}}
+				{{- if and .Width .Height}} width="{{.Width}}" height="{{.Height}}"{{end}} loading="lazy" decoding="async">
+			{{- end}}
+			{{- end}}
+		</div>
+
+		<button class="gallery-button gallery-button-left"></button>
+		<button class="gallery-button gallery-button-right"></button>
+	</div>
+
+    <div class="gallery-dot-container">
+    </div>
+</section>
+`
+
+var galleryTemplate *template.Template
+
+func init() {
+	castStr := func(b []byte) string {
+		return string(b)
+	}
+
+	// escape url while keeping path separators and queries intact
+	escapeURL := func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil {
+			return url.PathEscape(s)
+		}
+		return u.String()
+	}
+
+	galleryTemplate = template.Must(
+		template.New("galleryTemplate").
+			Funcs(map[string]any{
+				"castStr":   castStr,
+				"escapeURL": escapeURL,
+			}).
+			Parse(galleryTemplateText),
+	)
+}
+
+func (r *GalleryHTMLRenderer) renderGallery(
+	w gutil.BufWriter,
+	source []byte,
+	n gast.Node,
+	entering bool,
+) (gast.WalkStatus, error) {
+	if entering {
+		if gallery, isGallery := n.(*Gallery); isGallery {
+			err := galleryTemplate.Execute(
+				w, gallery,
+			)
+
+			if err != nil {
+				return gast.WalkStop, err
+			}
+		}
+	}
+
+	return gast.WalkContinue, nil
+}
+
+// ==================================
+// transformer
+// ==================================
+
+type galleryItemASTTransformer struct {
+}
+
+var defaultGalleryItemASTTransformer = &galleryItemASTTransformer{}
+
+// NewFootnoteASTTransformer returns a new parser.ASTTransformer that
+// insert a footnote list to the last of the document.
+func NewGalleryItemASTTransformer() parser.ASTTransformer {
+	return defaultGalleryItemASTTransformer
+}
+
+func (t *galleryItemASTTransformer) Transform(
+	document *gast.Document,
+	reader text.Reader,
+	pc parser.Context,
+) {
+	// document.Dump(reader.Source(), 0)
+
+	var galleries []*Gallery
+
+	var walkFunc func(node gast.Node, parentGallery *Gallery)
+
+	walkFunc = func(node gast.Node, parentGallery *Gallery) {
+		var nextGallery *Gallery = nil
+
+		if parentGallery != nil {
+			nextGallery = parentGallery
+
+			switch item := node.(type) {
+			case *gast.Image:
+				parentGallery.Images = append(parentGallery.Images, GalleryImage{
+					Kind:        GalleryMediaKindFromSource(item.Destination),
+					AltText:     item.Text(reader.Source()),
+					ImageSource: item.Destination,
+				})
+			case *gast.Link:
+				// links are only meaningful when they point at a video
+				//
+				// [![alt](poster.png)](clip.mp4) gives us a video with a poster frame
+				// [alt](clip.mp4) gives us a video without one
+				if GalleryMediaKindFromSource(item.Destination) != GalleryMediaVideo {
+					break
+				}
+
+				galleryImage := GalleryImage{
+					Kind:        GalleryMediaVideo,
+					AltText:     item.Text(reader.Source()),
+					ImageSource: item.Destination,
+				}
+
+				if poster, isImage := item.FirstChild().(*gast.Image); isImage {
+					galleryImage.PosterSource = poster.Destination
+				}
+
+				parentGallery.Images = append(parentGallery.Images, galleryImage)
+
+				// don't visit poster image
+				return
+			}
+		} else {
+			if gallery, isGallery := node.(*Gallery); isGallery {
+				galleries = append(galleries, gallery)
+				nextGallery = gallery
+			}
+		}
+
+		child := node.FirstChild()
+
+		for range node.ChildCount() {
+			walkFunc(child, nextGallery)
+			child = child.NextSibling()
+		}
+	}
+
+	walkFunc(document, nil)
+
+	for _, g := range galleries {
+		g.RemoveChildren(g)
+
+		if g.Source != "" {
+			globbed, err := expandGallerySource(MarkdownPostDir(pc), g)
+			if err != nil {
+				AddMarkdownError(pc, &MarkdownDiagnostic{
+					Line:    g.Line,
+					Message: err.Error(),
+				})
+				continue
+			}
+
+			g.Images = append(globbed, g.Images...)
+		}
+	}
+
+	// document.Dump(reader.Source(), 0)
+}
+
+// ==================================
+// source globbing
+// ==================================
+
+// expand gallery's glob pattern against post directory
+func expandGallerySource(postDir string, g *Gallery) ([]GalleryImage, error) {
+	if postDir == "" {
+		return nil, fmt.Errorf("gallery src \"%s\" needs a post directory", g.Source)
+	}
+
+	postFS := os.DirFS(postDir)
+
+	matches, err := fs.Glob(postFS, g.Source)
+	if err != nil {
+		return nil, fmt.Errorf("gallery src \"%s\": %w", g.Source, err)
+	}
+
+	// we only want files
+	matches = slices.DeleteFunc(matches, func(match string) bool {
+		info, err := fs.Stat(postFS, match)
+		return err != nil || !info.Mode().IsRegular()
+	})
+
+	if len(matches) <= 0 {
+		return nil, fmt.Errorf("gallery src \"%s\" matched nothing", g.Source)
+	}
+
+	switch g.Sort {
+	case "", "name":
+		slices.Sort(matches)
+	case "name-desc":
+		slices.Sort(matches)
+		slices.Reverse(matches)
+	case "modtime", "modtime-desc":
+		modTimes := make(map[string]int64)
+		for _, match := range matches {
+			info, err := fs.Stat(postFS, match)
+			if err != nil {
+				return nil, err
+			}
+			modTimes[match] = info.ModTime().UnixNano()
+		}
+		slices.SortStableFunc(matches, func(a, b string) int {
+			if modTimes[a] != modTimes[b] {
+				if modTimes[a] < modTimes[b] {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+		if g.Sort == "modtime-desc" {
+			slices.Reverse(matches)
+		}
+	default:
+		return nil, fmt.Errorf("unknown gallery sort \"%s\"", g.Sort)
+	}
+
+	var captions map[string]string
+
+	if g.Captions != "" {
+		captions, err = loadGalleryCaptions(postFS, g.Captions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var images []GalleryImage
+
+	for _, match := range matches {
+		altText := strings.TrimSuffix(path.Base(match), path.Ext(match))
+		if caption, ok := captions[match]; ok {
+			altText = caption
+		}
+
+		// source is used like it was written in markdown,
+		// so file names with # or spaces have to be escaped
+		source := (&url.URL{Path: match}).String()
+
+		images = append(images, GalleryImage{
+			Kind:        GalleryMediaKindFromSource([]byte(match)),
+			AltText:     []byte(altText),
+			ImageSource: []byte(source),
+		})
+	}
+
+	return images, nil
+}
+
+// load captions from sidecar file
+//
+// each line looks like
+//
+//	image.png: caption for image
+//
+// image path is relative to the sidecar file
+// and lines starting with # are ignored
+func loadGalleryCaptions(postFS fs.FS, name string) (map[string]string, error) {
+	file, err := fs.ReadFile(postFS, name)
+	if err != nil {
+		return nil, fmt.Errorf("gallery captions: %w", err)
+	}
+
+	captions := make(map[string]string)
+
+	captionDir := path.Dir(name)
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		imageName, caption, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("gallery captions %s:%d: expected \"image: caption\"", name, lineNumber)
+		}
+
+		imagePath := path.Join(captionDir, strings.TrimSpace(imageName))
+		captions[imagePath] = strings.TrimSpace(caption)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("gallery captions: %w", err)
+	}
+
+	return captions, nil
+}
+
+// ==================================
+// extender
+// ==================================
+
+type galleryExtender struct{}
+
+var GalleryExtender = &galleryExtender{}
+
+func (e *galleryExtender) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(
+			gutil.Prioritized(NewGalleryParser(), 420),
+		),
+		parser.WithASTTransformers(
+			gutil.Prioritized(NewGalleryItemASTTransformer(), 999),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		gutil.Prioritized(NewGalleryHTMLRenderer(), 420),
+	))
+}
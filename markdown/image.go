@@ -0,0 +1,348 @@
+package markdown
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+
+	gast "github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+
+	"blog/util"
+)
+
+// matches max-width of img in /public/markdown/style.css
+const ResponsiveImageSizes = "(max-width: 1111px) 90vw, 1000px"
+
+// image that can be used in place of the original image
+type ImageVariant struct {
+	// path relative to post directory, uses forward slash
+	Source string
+
+	Width  int
+	Height int
+}
+
+// variants of images keyed by image source as written in markdown
+type ImageVariants map[string][]ImageVariant
+
+// try to get path relative to post directory from image source in markdown
+//
+// returns false if source points to somewhere outside of post
+// like https://example.com/foo.png or /public/foo.png
+func LocalImagePath(src string) (string, bool) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false
+	}
+
+	if u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+
+	if strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+
+	cleaned := path.Clean(u.Path)
+	if !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+		return "", false
+	}
+
+	return cleaned, true
+}
+
+// make srcset attribute value from variants
+func ImageSrcSet(variants []ImageVariant) string {
+	var srcSet []string
+
+	for _, v := range variants {
+		u := url.URL{Path: v.Source}
+		srcSet = append(srcSet, fmt.Sprintf("%s %dw", u.String(), v.Width))
+	}
+
+	return strings.Join(srcSet, ", ")
+}
+
+// find every image source in markdown including ones in galleries
+func FindMarkdownImages(markdownBytes []byte, postDir string) ([]string, error) {
+	document, errs := parseMarkdown(markdownBytes, postDir)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return markdownImageSources(document), nil
+}
+
+// same as FindMarkdownImages, but problems in markdown are ignored
+func ListMarkdownImages(markdownBytes []byte, postDir string) []string {
+	document, _ := parseMarkdown(markdownBytes, postDir)
+	return markdownImageSources(document)
+}
+
+// parse markdown without rendering it
+//
+// returns errors parsers and transformers reported along with the document
+func parseMarkdown(markdownBytes []byte, postDir string) (gast.Node, []error) {
+	pc := parser.NewContext()
+	pc.Set(markdownPostDirKey, postDir)
+
+	document := markdownConverter.Parser().Parse(
+		text.NewReader(markdownBytes), parser.WithContext(pc),
+	)
+
+	errs, _ := pc.Get(markdownErrorsKey).([]error)
+
+	return document, errs
+}
+
+// get image sources in document in order they appear
+func markdownImageSources(document gast.Node) []string {
+	var images []string
+
+	gast.Walk(document, func(node gast.Node, entering bool) (gast.WalkStatus, error) {
+		if !entering {
+			return gast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *gast.Image:
+			images = append(images, string(n.Destination))
+		case *Gallery:
+			for _, img := range n.Images {
+				if img.IsVideo() {
+					if len(img.PosterSource) > 0 {
+						images = append(images, string(img.PosterSource))
+					}
+				} else {
+					images = append(images, string(img.ImageSource))
+				}
+			}
+		}
+
+		return gast.WalkContinue, nil
+	})
+
+	return images
+}
+
+// ==================================
+// transformer
+// ==================================
+
+type responsiveImageASTTransformer struct {
+}
+
+var defaultResponsiveImageASTTransformer = &responsiveImageASTTransformer{}
+
+// NewResponsiveImageASTTransformer returns a new parser.ASTTransformer that
+// adds srcset and sizes to images that have variants
+func NewResponsiveImageASTTransformer() parser.ASTTransformer {
+	return defaultResponsiveImageASTTransformer
+}
+
+func (t *responsiveImageASTTransformer) Transform(
+	document *gast.Document,
+	reader text.Reader,
+	pc parser.Context,
+) {
+	imageVariants, _ := pc.Get(markdownImageVariantsKey).(ImageVariants)
+	if len(imageVariants) <= 0 {
+		return
+	}
+
+	gast.Walk(document, func(node gast.Node, entering bool) (gast.WalkStatus, error) {
+		if !entering {
+			return gast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *gast.Image:
+			if variants, ok := imageVariants[string(n.Destination)]; ok {
+				n.SetAttributeString("srcset", []byte(ImageSrcSet(variants)))
+				n.SetAttributeString("sizes", []byte(ResponsiveImageSizes))
+			}
+		case *Gallery:
+			for i, img := range n.Images {
+				if img.IsVideo() {
+					continue
+				}
+				if variants, ok := imageVariants[string(img.ImageSource)]; ok {
+					img.SrcSet = []byte(ImageSrcSet(variants))
+					img.Sizes = []byte(ResponsiveImageSizes)
+					n.Images[i] = img
+				}
+			}
+		}
+
+		return gast.WalkContinue, nil
+	})
+}
+
+// ==================================
+// dimension transformer
+// ==================================
+
+type imageDimensionASTTransformer struct {
+}
+
+var defaultImageDimensionASTTransformer = &imageDimensionASTTransformer{}
+
+// NewImageDimensionASTTransformer returns a new parser.ASTTransformer that
+// adds width, height, loading and decoding to images
+// and reports local images that don't exist
+func NewImageDimensionASTTransformer() parser.ASTTransformer {
+	return defaultImageDimensionASTTransformer
+}
+
+func (t *imageDimensionASTTransformer) Transform(
+	document *gast.Document,
+	reader text.Reader,
+	pc parser.Context,
+) {
+	postDir := MarkdownPostDir(pc)
+
+	type dimension struct {
+		width, height int
+	}
+
+	// same image could be referred multiple times
+	dimensions := make(map[string]dimension)
+
+	// returns false if image is missing
+	getDimension := func(src []byte, line int) (dimension, bool) {
+		if postDir == "" {
+			return dimension{}, true
+		}
+
+		localPath, isLocal := LocalImagePath(string(src))
+		if !isLocal {
+			return dimension{}, true
+		}
+
+		if d, ok := dimensions[localPath]; ok {
+			return d, true
+		}
+
+		d, err := getImageDimension(filepath.Join(postDir, filepath.FromSlash(localPath)))
+		if err != nil {
+			AddMarkdownError(pc, &MarkdownDiagnostic{
+				Line:    line,
+				Message: fmt.Sprintf("image \"%s\": %v", src, err),
+			})
+			return dimension{}, false
+		}
+
+		dimensions[localPath] = dimension{d.X, d.Y}
+
+		return dimensions[localPath], true
+	}
+
+	gast.Walk(document, func(node gast.Node, entering bool) (gast.WalkStatus, error) {
+		if !entering {
+			return gast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *gast.Image:
+			d, ok := getDimension(n.Destination, markdownNodeLine(n, reader.Source()))
+			if !ok {
+				return gast.WalkContinue, nil
+			}
+
+			if d.width > 0 && d.height > 0 {
+				n.SetAttributeString("width", []byte(fmt.Sprint(d.width)))
+				n.SetAttributeString("height", []byte(fmt.Sprint(d.height)))
+			}
+			n.SetAttributeString("loading", []byte("lazy"))
+			n.SetAttributeString("decoding", []byte("async"))
+		case *Gallery:
+			for i, img := range n.Images {
+				if img.IsVideo() {
+					if len(img.PosterSource) > 0 {
+						getDimension(img.PosterSource, n.Line)
+					}
+					continue
+				}
+
+				if d, ok := getDimension(img.ImageSource, n.Line); ok {
+					img.Width = d.width
+					img.Height = d.height
+					n.Images[i] = img
+				}
+			}
+		}
+
+		return gast.WalkContinue, nil
+	})
+}
+
+// EXIF is near the start of file, in jpeg it can't be bigger than 64KiB
+const imageHeadSize = 128 << 10
+
+// get dimension of image file as browser shows it,
+// EXIF orientation can turn it on its side
+//
+// image we don't know how to decode (like svg) has zero dimension
+func getImageDimension(name string) (image.Point, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return image.Point{}, fmt.Errorf("does not exist")
+		}
+		return image.Point{}, err
+	}
+	defer file.Close()
+
+	head := make([]byte, imageHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return image.Point{}, err
+	}
+	head = head[:n]
+
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return image.Point{}, nil
+		}
+		return image.Point{}, err
+	}
+
+	if util.OrientationSwapsSize(util.ImageOrientation(head)) {
+		return image.Point{X: config.Height, Y: config.Width}, nil
+	}
+	return image.Point{X: config.Width, Y: config.Height}, nil
+}
+
+// find which line node is at in markdown source
+// returns 0 if we can't find out
+func markdownNodeLine(node gast.Node, source []byte) int {
+	// inline nodes don't have lines, so we look at block they are in
+	for n := node; n != nil; n = n.Parent() {
+		if n.Type() != gast.TypeBlock {
+			continue
+		}
+
+		if lines := n.Lines(); lines != nil && lines.Len() > 0 {
+			return bytes.Count(source[:lines.At(0).Start], []byte{'\n'}) + 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,138 @@
+// converts markdown posts to html, with galleries and responsive images
+package markdown
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	gutil "github.com/yuin/goldmark/util"
+)
+
+var markdownConverter = goldmark.New(
+	goldmark.WithExtensions(
+		GalleryExtender,
+	),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(
+			gutil.Prioritized(NewResponsiveImageASTTransformer(), 1000),
+			gutil.Prioritized(NewImageDimensionASTTransformer(), 1001),
+		),
+	),
+	goldmark.WithRendererOptions(
+		html.WithUnsafe(),
+	),
+)
+
+var (
+	markdownPostDirKey       = parser.NewContextKey()
+	markdownErrorsKey        = parser.NewContextKey()
+	markdownImageVariantsKey = parser.NewContextKey()
+)
+
+// get post directory that markdown is being converted in
+// returns empty string if we don't know
+func MarkdownPostDir(pc parser.Context) string {
+	if postDir, ok := pc.Get(markdownPostDirKey).(string); ok {
+		return postDir
+	}
+	return ""
+}
+
+// problem found in markdown source
+type MarkdownDiagnostic struct {
+	// line in markdown source, starts from 1
+	Line    int
+	Message string
+}
+
+func (md *MarkdownDiagnostic) Error() string {
+	return fmt.Sprintf("line %d: %s", md.Line, md.Message)
+}
+
+// collect every MarkdownDiagnostic in err's tree
+func CollectMarkdownDiagnostics(err error) []MarkdownDiagnostic {
+	var diagnostics []MarkdownDiagnostic
+
+	var walk func(err error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+
+		if diagnostic, ok := err.(*MarkdownDiagnostic); ok {
+			diagnostics = append(diagnostics, *diagnostic)
+		}
+
+		switch unwrapper := err.(type) {
+		case interface{ Unwrap() error }:
+			walk(unwrapper.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, e := range unwrapper.Unwrap() {
+				walk(e)
+			}
+		}
+	}
+
+	walk(err)
+
+	return diagnostics
+}
+
+// goldmark doesn't let parsers and transformers return errors
+// so they report errors through parser context
+func AddMarkdownError(pc parser.Context, err error) {
+	errs, _ := pc.Get(markdownErrorsKey).([]error)
+	pc.Set(markdownErrorsKey, append(errs, err))
+}
+
+// convert markdown to html page
+//
+// postDir is used to resolve files that markdown refers to,
+// it can be empty if markdown doesn't refer to any
+//
+// images that have imageVariants get srcset and sizes attributes,
+// imageVariants can be nil
+func ConvertMarkdown(markdownBytes []byte, postDir string, imageVariants ImageVariants) ([]byte, error) {
+	pc := parser.NewContext()
+	pc.Set(markdownPostDirKey, postDir)
+	pc.Set(markdownImageVariantsKey, imageVariants)
+
+	var byteBuf bytes.Buffer
+	err := markdownConverter.Convert(markdownBytes, &byteBuf, parser.WithContext(pc))
+	if err != nil {
+		return nil, err
+	}
+
+	if errs, _ := pc.Get(markdownErrorsKey).([]error); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	page := fmt.Sprintf(markdownTemplate, string(byteBuf.Bytes()))
+
+	return []byte(page), nil
+}
+
+const markdownTemplate = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta charset="UTF-8">
+
+    <link rel="stylesheet" href="/public/shared/water.css">
+    <link rel="stylesheet" href="/public/markdown/style.css">
+</head>
+
+<body>
+%s
+
+	<script src = '/public/markdown/main.js'></script>
+</body>
+
+</html>
+`
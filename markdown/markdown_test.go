@@ -0,0 +1,512 @@
+package markdown
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePNG(t *testing.T, name string, width, height int) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvertMarkdown(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "cat.png"), 40, 30)
+
+	markdownBytes := []byte("# Cats\n\n![a cat](cat.png)\n\n![remote](https://example.com/dog.png)\n")
+
+	imageVariants := ImageVariants{
+		"cat.png": {
+			{Source: "cat.20w.png", Width: 20, Height: 15},
+			{Source: "cat.png", Width: 40, Height: 30},
+		},
+	}
+
+	htmlBytes, err := ConvertMarkdown(markdownBytes, postDir, imageVariants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(htmlBytes)
+
+	for _, want := range []string{
+		"<!DOCTYPE html>",
+		"<h1>Cats</h1>",
+		`width="40"`,
+		`height="30"`,
+		`srcset="cat.20w.png 20w, cat.png 40w"`,
+		`sizes="` + ResponsiveImageSizes + `"`,
+		`src="https://example.com/dog.png"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't have %s:\n%s", want, page)
+		}
+	}
+}
+
+func TestConvertMarkdownDiagnostics(t *testing.T) {
+	postDir := t.TempDir()
+
+	markdownBytes := []byte("# Missing\n\nsome text\n\n![gone](gone.png)\n")
+
+	_, err := ConvertMarkdown(markdownBytes, postDir, nil)
+	if err == nil {
+		t.Fatal("missing image should fail")
+	}
+
+	diagnostics := CollectMarkdownDiagnostics(err)
+	if len(diagnostics) != 1 {
+		t.Fatalf("got %d diagnostics, want 1: %v", len(diagnostics), err)
+	}
+	if diagnostics[0].Line != 5 {
+		t.Errorf("diagnostic is at line %d, want 5", diagnostics[0].Line)
+	}
+	if !strings.Contains(diagnostics[0].Message, "gone.png") {
+		t.Errorf("diagnostic doesn't say which image: %s", diagnostics[0].Message)
+	}
+
+	// without post directory nothing gets resolved
+	if _, err := ConvertMarkdown(markdownBytes, "", nil); err != nil {
+		t.Errorf("without post directory: %v", err)
+	}
+}
+
+func TestFindMarkdownImages(t *testing.T) {
+	markdownBytes := []byte("![a](a.png)\n\ntext ![b](images/b.jpg) and ![a again](a.png)\n")
+
+	images, err := FindMarkdownImages(markdownBytes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.png", "images/b.jpg", "a.png"}
+	if !slices.Equal(images, want) {
+		t.Errorf("got %v, want %v", images, want)
+	}
+}
+
+func TestLocalImagePath(t *testing.T) {
+	tests := []struct {
+		src   string
+		path  string
+		local bool
+	}{
+		{"cat.png", "cat.png", true},
+		{"./images/../cat.png", "cat.png", true},
+		{"images/cat%20face.png", "images/cat face.png", true},
+		{"/public/cat.png", "", false},
+		{"https://example.com/cat.png", "", false},
+		{"../other-post/cat.png", "", false},
+	}
+
+	for _, test := range tests {
+		path, local := LocalImagePath(test.src)
+		if path != test.path || local != test.local {
+			t.Errorf("LocalImagePath(%q) = %q, %v, want %q, %v", test.src, path, local, test.path, test.local)
+		}
+	}
+}
+
+func TestConvertMarkdownOrientation(t *testing.T) {
+	postDir := t.TempDir()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// EXIF with orientation 6, stored image is lying on its side
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	photo := []byte{0xff, 0xd8, 0xff, 0xe1, 0, byte(len(exif) + 2)}
+	photo = append(photo, exif...)
+	photo = append(photo, buf.Bytes()[2:]...)
+
+	if err := os.WriteFile(filepath.Join(postDir, "photo.jpg"), photo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	htmlBytes, err := ConvertMarkdown([]byte("![photo](photo.jpg)\n"), postDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(htmlBytes, []byte(`width="30" height="40"`)) {
+		t.Errorf("upright size isn't 30x40:\n%s", htmlBytes)
+	}
+}
+
+func TestConvertMarkdownGalleryMedia(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "poster.png"), 64, 36)
+	writePNG(t, filepath.Join(postDir, "shot.png"), 40, 30)
+
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 20, 10), color.Palette{color.Black, color.White}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(postDir, "spin.gif"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		markdown string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:     "video with poster",
+			markdown: "<gallery>\n[![boss fight](poster.png)](boss.mp4)\n</gallery>\n",
+			want: []string{
+				`<video class="gallery-img gallery-video" src="boss.mp4" poster="poster.png" aria-label="boss fight" muted loop playsinline`,
+			},
+		},
+		{
+			name:     "video without poster",
+			markdown: "<gallery>\n[menu](menu.webm)\n</gallery>\n",
+			want: []string{
+				`<video class="gallery-img gallery-video" src="menu.webm" aria-label="menu" muted loop playsinline`,
+			},
+			dontWant: []string{"poster="},
+		},
+		{
+			name:     "gif is an image",
+			markdown: "<gallery>\n![spinning](spin.gif)\n</gallery>\n",
+			want: []string{
+				`<img class="gallery-img" src="spin.gif" alt="spinning" width="20" height="10"`,
+			},
+			dontWant: []string{"<video"},
+		},
+		{
+			name:     "mixed media keep their order",
+			markdown: "<gallery>\n![shot](shot.png)\n[clip](clip.mp4)\n![spinning](spin.gif)\n</gallery>\n",
+			want: []string{
+				`src="shot.png" alt="shot" width="40" height="30"`,
+				`src="clip.mp4" aria-label="clip"`,
+				`src="spin.gif" alt="spinning"`,
+			},
+		},
+		{
+			name:     "links to images aren't slides",
+			markdown: "<gallery>\n[not a video](shot.png)\n</gallery>\n",
+			dontWant: []string{"<img", "<video"},
+		},
+		{
+			name:     "spaces are escaped",
+			markdown: "<gallery>\n[![my clip](poster.png)](<my clip.mp4>)\n</gallery>\n",
+			want:     []string{`src="my%20clip.mp4" poster="poster.png"`},
+		},
+		{
+			name:     "escaped # stays escaped",
+			markdown: "<gallery>\n[clip](clip%232.mp4)\n</gallery>\n",
+			want:     []string{`src="clip%232.mp4"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			htmlBytes, err := ConvertMarkdown([]byte(test.markdown), postDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := string(htmlBytes)
+
+			if !strings.Contains(page, `<section class="gallery-section">`) {
+				t.Fatalf("no gallery:\n%s", page)
+			}
+
+			lastIndex := 0
+			for _, want := range test.want {
+				index := strings.Index(page[lastIndex:], want)
+				if index < 0 {
+					t.Errorf("page doesn't have %s after what came before:\n%s", want, page)
+					continue
+				}
+				lastIndex += index
+			}
+			for _, dontWant := range test.dontWant {
+				if strings.Contains(page, dontWant) {
+					t.Errorf("page has %s:\n%s", dontWant, page)
+				}
+			}
+		})
+	}
+}
+
+func TestFindMarkdownImagesGalleryMedia(t *testing.T) {
+	markdownBytes := []byte("<gallery>\n![shot](shot.png)\n[![boss](poster.png)](boss.mp4)\n[menu](menu.webm)\n![spin](spin.gif)\n</gallery>\n")
+
+	images, err := FindMarkdownImages(markdownBytes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// videos aren't images, only their posters are
+	want := []string{"shot.png", "poster.png", "spin.gif"}
+	if !slices.Equal(images, want) {
+		t.Errorf("got %v, want %v", images, want)
+	}
+}
+
+func TestConvertMarkdownGalleryGlob(t *testing.T) {
+	postDir := t.TempDir()
+	// directory that matches glob isn't an image
+	if err := os.MkdirAll(filepath.Join(postDir, "screenshots", "old.png"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// written newest first so modtime order isn't name order
+	now := time.Now()
+	for i, name := range []string{"c.png", "b.png", "a.png"} {
+		fileName := filepath.Join(postDir, "screenshots", name)
+		writePNG(t, fileName, 40, 30)
+		modTime := now.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNG(t, filepath.Join(postDir, "screenshots", "boss fight #2.png"), 40, 30)
+	writePNG(t, filepath.Join(postDir, "cover.png"), 40, 30)
+
+	captions := "# captions for screenshots\n\na.png: the first room\nboss fight #2.png: second try\n"
+	if err := os.WriteFile(filepath.Join(postDir, "screenshots", "captions.txt"), []byte(captions), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		markdown string
+		want     []string
+	}{
+		{
+			name:     "sorted by name by default",
+			markdown: `<gallery src="screenshots/?.png"></gallery>`,
+			want:     []string{`src="screenshots/a.png" alt="a"`, `src="screenshots/b.png"`, `src="screenshots/c.png"`},
+		},
+		{
+			name:     "name-desc",
+			markdown: `<gallery src="screenshots/?.png" sort="name-desc"></gallery>`,
+			want:     []string{`src="screenshots/c.png"`, `src="screenshots/b.png"`, `src="screenshots/a.png"`},
+		},
+		{
+			name:     "modtime",
+			markdown: `<gallery src="screenshots/?.png" sort="modtime" />`,
+			want:     []string{`src="screenshots/c.png"`, `src="screenshots/b.png"`, `src="screenshots/a.png"`},
+		},
+		{
+			name:     "modtime-desc",
+			markdown: `<gallery src="screenshots/?.png" sort='modtime-desc'></gallery>`,
+			want:     []string{`src="screenshots/a.png"`, `src="screenshots/b.png"`, `src="screenshots/c.png"`},
+		},
+		{
+			name:     "captions from sidecar",
+			markdown: `<gallery src="screenshots/*.png" captions="screenshots/captions.txt"></gallery>`,
+			want: []string{
+				`src="screenshots/a.png" alt="the first room"`,
+				`src="screenshots/b.png" alt="b"`,
+				`src="screenshots/boss%20fight%20%232.png" alt="second try"`,
+			},
+		},
+		{
+			name:     "globbed images come before written ones",
+			markdown: "<gallery src=\"screenshots/a.png\">\n![cover](cover.png)\n</gallery>\n",
+			want:     []string{`src="screenshots/a.png"`, `src="cover.png" alt="cover"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			htmlBytes, err := ConvertMarkdown([]byte(test.markdown), postDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := string(htmlBytes)
+
+			lastIndex := 0
+			for _, want := range test.want {
+				index := strings.Index(page[lastIndex:], want)
+				if index < 0 {
+					t.Errorf("page doesn't have %s after what came before:\n%s", want, page)
+					continue
+				}
+				lastIndex += index
+			}
+			if strings.Contains(page, "captions.txt") || strings.Contains(page, "old.png") {
+				t.Errorf("gallery has things that aren't image files:\n%s", page)
+			}
+		})
+	}
+}
+
+func TestFindMarkdownImagesGalleryGlob(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "a #1.png"), 4, 4)
+
+	images, err := FindMarkdownImages([]byte(`<gallery src="*.png"></gallery>`), postDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 {
+		t.Fatalf("got %v, want one image", images)
+	}
+
+	// image variants are found through the same path as written sources
+	localPath, isLocal := LocalImagePath(images[0])
+	if !isLocal || localPath != "a #1.png" {
+		t.Errorf("LocalImagePath(%q) = %q, %v, want \"a #1.png\", true", images[0], localPath, isLocal)
+	}
+}
+
+func TestConvertMarkdownGalleryGlobErrors(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "a.png"), 4, 4)
+	if err := os.WriteFile(filepath.Join(postDir, "bad-captions.txt"), []byte("no colon here\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		markdown string
+		postDir  string
+		message  string
+	}{
+		{"matches nothing", "# Shots\n\n<gallery src=\"screenshots/*.png\"></gallery>\n", postDir, "matched nothing"},
+		{"bad pattern", "# Shots\n\n<gallery src=\"[.png\"></gallery>\n", postDir, "syntax error"},
+		{"unknown sort", "# Shots\n\n<gallery src=\"*.png\" sort=\"size\"></gallery>\n", postDir, "unknown gallery sort"},
+		{"missing captions", "# Shots\n\n<gallery src=\"*.png\" captions=\"nope.txt\"></gallery>\n", postDir, "nope.txt"},
+		{"bad captions", "# Shots\n\n<gallery src=\"*.png\" captions=\"bad-captions.txt\"></gallery>\n", postDir, "bad-captions.txt:1"},
+		{"no post directory", "# Shots\n\n<gallery src=\"*.png\"></gallery>\n", "", "needs a post directory"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ConvertMarkdown([]byte(test.markdown), test.postDir, nil)
+			if err == nil {
+				t.Fatal("should fail")
+			}
+
+			diagnostics := CollectMarkdownDiagnostics(err)
+			if len(diagnostics) != 1 {
+				t.Fatalf("got %d diagnostics, want 1: %v", len(diagnostics), err)
+			}
+			if diagnostics[0].Line != 3 {
+				t.Errorf("diagnostic is at line %d, want 3", diagnostics[0].Line)
+			}
+			if !strings.Contains(diagnostics[0].Message, test.message) {
+				t.Errorf("diagnostic %q doesn't say %q", diagnostics[0].Message, test.message)
+			}
+		})
+	}
+}
+
+func TestConvertMarkdownNestedGallery(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "a.png"), 40, 30)
+	writePNG(t, filepath.Join(postDir, "b.png"), 40, 30)
+
+	tests := []struct {
+		name     string
+		markdown string
+		want     []string
+	}{
+		{
+			name:     "in list",
+			markdown: "- level one\n\n  <gallery>\n  ![a](a.png)\n  ![b](b.png)\n  </gallery>\n- next item\n",
+			want:     []string{"<li>", `<section class="gallery-section">`, `src="a.png"`, `src="b.png"`, "</li>", "next item"},
+		},
+		{
+			name:     "in blockquote",
+			markdown: "> quoted\n>\n> <gallery>\n> ![a](a.png)\n> </gallery>\n\nafter\n",
+			want:     []string{"<blockquote>", `<section class="gallery-section">`, `src="a.png"`, "</blockquote>", "<p>after</p>"},
+		},
+		{
+			name:     "in list in blockquote",
+			markdown: "> 1. item\n>\n>    <gallery>\n>    ![b](b.png)\n>    </gallery>\n",
+			want:     []string{"<blockquote>", "<ol>", `<section class="gallery-section">`, `src="b.png"`, "</ol>", "</blockquote>"},
+		},
+		{
+			name:     "on one line",
+			markdown: "> <gallery src=\"a.png\"></gallery>\n",
+			want:     []string{"<blockquote>", `src="a.png"`, "</blockquote>"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			htmlBytes, err := ConvertMarkdown([]byte(test.markdown), postDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := string(htmlBytes)
+
+			lastIndex := 0
+			for _, want := range test.want {
+				index := strings.Index(page[lastIndex:], want)
+				if index < 0 {
+					t.Errorf("page doesn't have %s after what came before:\n%s", want, page)
+					continue
+				}
+				lastIndex += index
+			}
+			if strings.Contains(page, "&lt;gallery") || strings.Contains(page, "<gallery") {
+				t.Errorf("gallery is rendered as raw html:\n%s", page)
+			}
+		})
+	}
+}
+
+func TestConvertMarkdownUnterminatedGallery(t *testing.T) {
+	postDir := t.TempDir()
+	writePNG(t, filepath.Join(postDir, "a.png"), 40, 30)
+
+	tests := []struct {
+		name     string
+		markdown string
+		lines    []int
+	}{
+		{"at end of document", "# Title\n\ntext\n\n<gallery>\n![a](a.png)\n", []int{5}},
+		{"in blockquote that ends", "> <gallery>\n> ![a](a.png)\n\n# rest of the post\n", []int{1}},
+		{"in list item", "- item\n\n  <gallery>\n  ![a](a.png)\n- next\n", []int{3}},
+		{"two of them", "<gallery>\n\n> <gallery>\n", []int{1, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ConvertMarkdown([]byte(test.markdown), postDir, nil)
+			if err == nil {
+				t.Fatal("unterminated gallery should fail")
+			}
+
+			var lines []int
+			for _, diagnostic := range CollectMarkdownDiagnostics(err) {
+				if !strings.Contains(diagnostic.Message, "unterminated <gallery>") {
+					t.Errorf("unexpected diagnostic: %v", diagnostic.Message)
+				}
+				lines = append(lines, diagnostic.Line)
+			}
+			slices.Sort(lines)
+
+			if !slices.Equal(lines, test.lines) {
+				t.Errorf("diagnostics are at lines %v, want %v", lines, test.lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+)
+
+func ConsumeSpace(str string, advance int) (string, int) {
+	trimmed := strings.TrimLeftFunc(str, unicode.IsSpace)
+	return trimmed, advance + len(str) - len(trimmed)
+}
+
+func ConsumeLiteral(str string, advance int, literal string) (string, int, bool) {
+	if !strings.HasPrefix(str, literal) {
+		return str, advance, false
+	}
+	return str[len(literal):], advance + len(literal), true
+}
+
+// consume html style attribute like foo="bar" or foo='bar'
+//
+// value without quotes is also accepted but it can't have a space in it
+func ConsumeAttribute(str string, advance int) (string, int, string, string, bool) {
+	nameEnd := strings.IndexFunc(str, func(r rune) bool {
+		return !(r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	if nameEnd < 0 {
+		nameEnd = len(str)
+	}
+	if nameEnd == 0 {
+		return str, advance, "", "", false
+	}
+
+	name := str[:nameEnd]
+
+	rest, restAdvance := str[nameEnd:], advance+nameEnd
+	rest, restAdvance = ConsumeSpace(rest, restAdvance)
+
+	var consumed bool
+	if rest, restAdvance, consumed = ConsumeLiteral(rest, restAdvance, "="); !consumed {
+		return str, advance, "", "", false
+	}
+
+	rest, restAdvance = ConsumeSpace(rest, restAdvance)
+
+	if len(rest) <= 0 {
+		return str, advance, "", "", false
+	}
+
+	var value string
+
+	if quote := rest[0]; quote == '"' || quote == '\'' {
+		valueEnd := strings.IndexByte(rest[1:], quote)
+		if valueEnd < 0 {
+			return str, advance, "", "", false
+		}
+		value = rest[1 : 1+valueEnd]
+		rest, restAdvance = rest[valueEnd+2:], restAdvance+valueEnd+2
+	} else {
+		valueEnd := strings.IndexFunc(rest, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '>' || r == '/'
+		})
+		if valueEnd < 0 {
+			valueEnd = len(rest)
+		}
+		if valueEnd == 0 {
+			return str, advance, "", "", false
+		}
+		value = rest[:valueEnd]
+		rest, restAdvance = rest[valueEnd:], restAdvance+valueEnd
+	}
+
+	return rest, restAdvance, name, value, true
+}
@@ -0,0 +1,210 @@
+// posts and post list as they are stored in post-list.json
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PostType int
+
+const (
+	PostTypeNone PostType = iota
+	PostTypeHTML
+	PostTypeMarkDown
+	PostTypeCount
+)
+
+var PostTypeStrs = [PostTypeCount]string{
+	"None",
+	"HTML",
+	"Markdown",
+}
+
+func (pt PostType) String() string {
+	if 0 <= pt && pt < PostTypeCount {
+		return PostTypeStrs[pt]
+	}
+
+	return fmt.Sprintf("unknown PostType(%d)", pt)
+}
+
+func (pt PostType) MarshalJSON() ([]byte, error) {
+	if 0 <= pt && pt < PostTypeCount {
+		return []byte("\"" + PostTypeStrs[pt] + "\""), nil
+	}
+
+	return nil, fmt.Errorf("unknow PostType(%d)", pt)
+}
+
+func (pt *PostType) UnmarshalJSON(jsonValue []byte) error {
+	if len(jsonValue) < 2 {
+		return fmt.Errorf("unknow PostType(%s)", string(jsonValue))
+	}
+
+	jsonValue = jsonValue[1 : len(jsonValue)-1]
+
+	for i, str := range PostTypeStrs {
+		if str == string(jsonValue) {
+			*pt = PostType(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknow PostType(%s)", string(jsonValue))
+}
+
+type Post struct {
+	UUID uuid.UUID
+
+	FileHash string
+
+	Name string
+	Type PostType
+	Date time.Time
+	Dir  string
+
+	HasThumbnail bool
+	Thumbnail    string
+	// thumbnail is not a post-thumbnail file
+	// but an image we found in the post
+	ThumbnailDerived bool
+
+	// things below are filled in when post is compiled
+
+	ThumbnailWidth  int
+	ThumbnailHeight int
+
+	ThumbnailCard       string
+	ThumbnailCardWidth  int
+	ThumbnailCardHeight int
+
+	ThumbnailRetina       string
+	ThumbnailRetinaWidth  int
+	ThumbnailRetinaHeight int
+
+	// see GeneratedThumbnails
+	ThumbnailPlaceholder   string
+	ThumbnailDominantColor string
+	ThumbnailAspectRatio   float64
+
+	// image that page metadata refers to for link previews,
+	// either the thumbnail or a generated share image
+	ShareImage string
+}
+
+func (p Post) Clone() Post {
+	clone := p
+
+	clone.FileHash = strings.Clone(p.FileHash)
+
+	clone.Name = strings.Clone(p.Name)
+	clone.Dir = strings.Clone(p.Dir)
+
+	clone.Thumbnail = strings.Clone(p.Thumbnail)
+
+	clone.ThumbnailCard = strings.Clone(p.ThumbnailCard)
+	clone.ThumbnailRetina = strings.Clone(p.ThumbnailRetina)
+
+	clone.ThumbnailPlaceholder = strings.Clone(p.ThumbnailPlaceholder)
+	clone.ThumbnailDominantColor = strings.Clone(p.ThumbnailDominantColor)
+
+	clone.ShareImage = strings.Clone(p.ShareImage)
+
+	return clone
+}
+
+// copy things we get from compiling post
+func (p *Post) CarryOverCompiled(from Post) {
+	p.ThumbnailWidth = from.ThumbnailWidth
+	p.ThumbnailHeight = from.ThumbnailHeight
+
+	p.ThumbnailCard = strings.Clone(from.ThumbnailCard)
+	p.ThumbnailCardWidth = from.ThumbnailCardWidth
+	p.ThumbnailCardHeight = from.ThumbnailCardHeight
+
+	p.ThumbnailRetina = strings.Clone(from.ThumbnailRetina)
+	p.ThumbnailRetinaWidth = from.ThumbnailRetinaWidth
+	p.ThumbnailRetinaHeight = from.ThumbnailRetinaHeight
+
+	p.ThumbnailPlaceholder = strings.Clone(from.ThumbnailPlaceholder)
+	p.ThumbnailDominantColor = strings.Clone(from.ThumbnailDominantColor)
+	p.ThumbnailAspectRatio = from.ThumbnailAspectRatio
+
+	p.ShareImage = strings.Clone(from.ShareImage)
+}
+
+func (p *Post) SetGeneratedThumbnails(thumbnails GeneratedThumbnails) {
+	p.ThumbnailWidth = thumbnails.Width
+	p.ThumbnailHeight = thumbnails.Height
+
+	p.ThumbnailCard = thumbnails.Card
+	p.ThumbnailCardWidth = thumbnails.CardWidth
+	p.ThumbnailCardHeight = thumbnails.CardHeight
+
+	p.ThumbnailRetina = thumbnails.Retina
+	p.ThumbnailRetinaWidth = thumbnails.RetinaWidth
+	p.ThumbnailRetinaHeight = thumbnails.RetinaHeight
+
+	p.ThumbnailPlaceholder = thumbnails.Placeholder
+	p.ThumbnailDominantColor = thumbnails.DominantColor
+	p.ThumbnailAspectRatio = thumbnails.AspectRatio
+}
+
+func (p *Post) Dump() {
+	fmt.Printf("UUID : %v\n", p.UUID)
+
+	fmt.Printf("FileHash: %v\n", p.FileHash)
+
+	fmt.Printf("Name : %v\n", p.Name)
+	fmt.Printf("Type : %v\n", p.Type)
+	fmt.Printf("Date : %v\n", p.Date)
+	fmt.Printf("Dir  : %v\n", p.Dir)
+	if p.HasThumbnail {
+		fmt.Printf("Thumbnail : %v (%dx%d)\n", p.Thumbnail, p.ThumbnailWidth, p.ThumbnailHeight)
+		fmt.Printf("ThumbnailDerived : %v\n", p.ThumbnailDerived)
+		fmt.Printf("ThumbnailCard : %v (%dx%d)\n", p.ThumbnailCard, p.ThumbnailCardWidth, p.ThumbnailCardHeight)
+		fmt.Printf("ThumbnailRetina : %v (%dx%d)\n", p.ThumbnailRetina, p.ThumbnailRetinaWidth, p.ThumbnailRetinaHeight)
+	}
+	fmt.Printf("ShareImage : %v\n", p.ShareImage)
+}
+
+// thumbnails that we made for post
+type GeneratedThumbnails struct {
+	// size of the original thumbnail
+	Width  int
+	Height int
+
+	Card       string
+	CardWidth  int
+	CardHeight int
+
+	Retina       string
+	RetinaWidth  int
+	RetinaHeight int
+
+	// tiny version of thumbnail as data uri,
+	// shown while actual thumbnail is loading
+	Placeholder string
+	// css color like #rrggbb
+	DominantColor string
+	// width / height
+	AspectRatio float64
+}
+
+type PostList struct {
+	Posts []Post
+}
+
+func (pl *PostList) Clone() PostList {
+	clone := PostList{}
+
+	for _, p := range pl.Posts {
+		clone.Posts = append(clone.Posts, p.Clone())
+	}
+
+	return clone
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPostTypeJSON(t *testing.T) {
+	for pt := PostTypeNone; pt < PostTypeCount; pt++ {
+		jsonBytes, err := json.Marshal(pt)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", pt, err)
+		}
+
+		var got PostType
+		if err := json.Unmarshal(jsonBytes, &got); err != nil {
+			t.Fatalf("unmarshal %s: %v", jsonBytes, err)
+		}
+		if got != pt {
+			t.Errorf("%s: got %v, want %v", jsonBytes, got, pt)
+		}
+	}
+
+	if _, err := json.Marshal(PostTypeCount); err == nil {
+		t.Errorf("marshaling PostTypeCount should fail")
+	}
+
+	var pt PostType
+	if err := json.Unmarshal([]byte(`"Word"`), &pt); err == nil {
+		t.Errorf("unmarshaling unknown type should fail")
+	}
+}
+
+func TestPostListClone(t *testing.T) {
+	original := PostList{Posts: []Post{
+		{Name: "first", Dir: "first"},
+		{Name: "second", Dir: "second"},
+	}}
+
+	clone := original.Clone()
+	clone.Posts[0].Name = "changed"
+
+	if original.Posts[0].Name != "first" {
+		t.Errorf("changing clone changed original: %q", original.Posts[0].Name)
+	}
+	if len(clone.Posts) != len(original.Posts) {
+		t.Errorf("clone has %d posts, want %d", len(clone.Posts), len(original.Posts))
+	}
+}
+
+func TestCarryOverCompiled(t *testing.T) {
+	compiled := Post{
+		Name:                 "old name",
+		ThumbnailCard:        "post-thumbnail.card.png",
+		ThumbnailCardWidth:   350,
+		ThumbnailAspectRatio: 1.5,
+		ShareImage:           "post-share.png",
+	}
+
+	post := Post{Name: "new name"}
+	post.CarryOverCompiled(compiled)
+
+	if post.Name != "new name" {
+		t.Errorf("name got carried over: %q", post.Name)
+	}
+	if post.ThumbnailCard != compiled.ThumbnailCard ||
+		post.ThumbnailCardWidth != compiled.ThumbnailCardWidth ||
+		post.ThumbnailAspectRatio != compiled.ThumbnailAspectRatio ||
+		post.ShareImage != compiled.ShareImage {
+		t.Errorf("compiled things didn't carry over: %+v", post)
+	}
+}
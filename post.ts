@@ -14,6 +14,24 @@ class PostContainer {
 
     HasThumbnail: boolean = false
     Thumbnail: string = ""
+    ThumbnailDerived: boolean = false
+
+    ThumbnailWidth: number = 0
+    ThumbnailHeight: number = 0
+
+    ThumbnailCard: string = ""
+    ThumbnailCardWidth: number = 0
+    ThumbnailCardHeight: number = 0
+
+    ThumbnailRetina: string = ""
+    ThumbnailRetinaWidth: number = 0
+    ThumbnailRetinaHeight: number = 0
+
+    ThumbnailPlaceholder: string = ""
+    ThumbnailDominantColor: string = ""
+    ThumbnailAspectRatio: number = 0
+
+    ShareImage: string = ""
 }
 
 class Post {
@@ -28,6 +46,24 @@ class Post {
 
     hasThumbnail: boolean = false
     thumbnail: string = ""
+    thumbnailDerived: boolean = false
+
+    thumbnailWidth: number = 0
+    thumbnailHeight: number = 0
+
+    thumbnailCard: string = ""
+    thumbnailCardWidth: number = 0
+    thumbnailCardHeight: number = 0
+
+    thumbnailRetina: string = ""
+    thumbnailRetinaWidth: number = 0
+    thumbnailRetinaHeight: number = 0
+
+    thumbnailPlaceholder: string = ""
+    thumbnailDominantColor: string = ""
+    thumbnailAspectRatio: number = 0
+
+    shareImage: string = ""
 
     setFromPostJsonOrThrow(json: any) {
         const expect = (
@@ -62,6 +98,24 @@ class Post {
 
         this.hasThumbnail = expect(json.HasThumbnail, 'boolean', false)
         this.thumbnail = expect(json.Thumbnail, 'string', false)
+        this.thumbnailDerived = expect(json.ThumbnailDerived, 'boolean', false)
+
+        this.thumbnailWidth = expect(json.ThumbnailWidth, 'number', false)
+        this.thumbnailHeight = expect(json.ThumbnailHeight, 'number', false)
+
+        this.thumbnailCard = expect(json.ThumbnailCard, 'string', false)
+        this.thumbnailCardWidth = expect(json.ThumbnailCardWidth, 'number', false)
+        this.thumbnailCardHeight = expect(json.ThumbnailCardHeight, 'number', false)
+
+        this.thumbnailRetina = expect(json.ThumbnailRetina, 'string', false)
+        this.thumbnailRetinaWidth = expect(json.ThumbnailRetinaWidth, 'number', false)
+        this.thumbnailRetinaHeight = expect(json.ThumbnailRetinaHeight, 'number', false)
+
+        this.thumbnailPlaceholder = expect(json.ThumbnailPlaceholder, 'string', false)
+        this.thumbnailDominantColor = expect(json.ThumbnailDominantColor, 'string', false)
+        this.thumbnailAspectRatio = expect(json.ThumbnailAspectRatio, 'number', false)
+
+        this.shareImage = expect(json.ShareImage, 'string', false)
     }
 
     toPostContainer(): PostContainer {
@@ -78,6 +132,24 @@ class Post {
 
         container.HasThumbnail = this.hasThumbnail
         container.Thumbnail = this.thumbnail
+        container.ThumbnailDerived = this.thumbnailDerived
+
+        container.ThumbnailWidth = this.thumbnailWidth
+        container.ThumbnailHeight = this.thumbnailHeight
+
+        container.ThumbnailCard = this.thumbnailCard
+        container.ThumbnailCardWidth = this.thumbnailCardWidth
+        container.ThumbnailCardHeight = this.thumbnailCardHeight
+
+        container.ThumbnailRetina = this.thumbnailRetina
+        container.ThumbnailRetinaWidth = this.thumbnailRetinaWidth
+        container.ThumbnailRetinaHeight = this.thumbnailRetinaHeight
+
+        container.ThumbnailPlaceholder = this.thumbnailPlaceholder
+        container.ThumbnailDominantColor = this.thumbnailDominantColor
+        container.ThumbnailAspectRatio = this.thumbnailAspectRatio
+
+        container.ShareImage = this.shareImage
 
         return container
     }
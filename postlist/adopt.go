@@ -0,0 +1,130 @@
+package postlist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+	"blog/util"
+)
+
+// post directory without post-uuid.txt,
+// it isn't in post list until it gets adopted
+type UnadoptedPost struct {
+	Dir  string
+	Type model.PostType
+}
+
+type AdoptedPost struct {
+	Dir  string
+	UUID uuid.UUID
+}
+
+func FindUnadoptedPosts(postRoot string) ([]UnadoptedPost, error) {
+	exists, err := util.FileExists(postRoot, true)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	postDirs, err := os.ReadDir(postRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var unadopted []UnadoptedPost
+
+	for _, postDir := range postDirs {
+		if !postDir.IsDir() {
+			continue
+		}
+
+		postDirPath := filepath.Join(postRoot, postDir.Name())
+
+		_, foundUUIDFile, err := GetPostUUIDFromDir(postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if foundUUIDFile {
+			continue
+		}
+
+		postType, err := GetPostTypeFromDir(postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if postType == model.PostTypeNone {
+			continue
+		}
+
+		unadopted = append(unadopted, UnadoptedPost{Dir: postDir.Name(), Type: postType})
+	}
+
+	return unadopted, nil
+}
+
+// gives post directories in dirs a uuid by writing post-uuid.txt,
+// every unadopted post in postRoot if dirs is empty
+//
+// nothing is written unless all of dirs can be adopted
+func AdoptPosts(postRoot string, dirs []string) ([]AdoptedPost, error) {
+	if len(dirs) == 0 {
+		unadopted, err := FindUnadoptedPosts(postRoot)
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range unadopted {
+			dirs = append(dirs, post.Dir)
+		}
+	}
+
+	// check everything before writing anything
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if !filepath.IsLocal(dir) || filepath.Base(dir) != dir {
+			return nil, fmt.Errorf("%q is not a post directory", dir)
+		}
+		if seen[dir] {
+			return nil, fmt.Errorf("%s is listed twice", dir)
+		}
+		seen[dir] = true
+
+		postDirPath := filepath.Join(postRoot, dir)
+
+		postType, err := GetPostTypeFromDir(postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if postType == model.PostTypeNone {
+			return nil, fmt.Errorf("%s has no index.html or index.md", dir)
+		}
+
+		_, foundUUIDFile, err := GetPostUUIDFromDir(postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if foundUUIDFile {
+			return nil, fmt.Errorf("%s already has %s", dir, PostUUIDFileName)
+		}
+	}
+
+	var adopted []AdoptedPost
+
+	for _, dir := range dirs {
+		postUUID := uuid.New()
+		uuidPath := filepath.Join(postRoot, dir, PostUUIDFileName)
+
+		if err := os.WriteFile(uuidPath, []byte(postUUID.String()), 0664); err != nil {
+			return adopted, err
+		}
+
+		adopted = append(adopted, AdoptedPost{Dir: dir, UUID: postUUID})
+	}
+
+	return adopted, nil
+}
@@ -0,0 +1,110 @@
+package postlist
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+)
+
+// how scanned post list differs from the saved one, see DiffPostLists
+//
+// a post can be both modified and renamed
+type PostListDiff struct {
+	Added []model.Post
+	// posts whose directory is gone, as they were in saved post list
+	Removed  []model.Post
+	Modified []ModifiedPost
+	Renamed  []RenamedPost
+}
+
+type ModifiedPost struct {
+	Post        model.Post
+	OldFileHash string
+
+	// added, removed or changed files relative to post directory, sorted
+	ChangedFiles []string
+	// false if hash cache doesn't remember files post had,
+	// ChangedFiles is empty then
+	FilesKnown bool
+}
+
+type RenamedPost struct {
+	Post   model.Post
+	OldDir string
+}
+
+func (pd *PostListDiff) String() string {
+	return fmt.Sprintf(
+		"%d added, %d removed, %d modified, %d renamed",
+		len(pd.Added), len(pd.Removed), len(pd.Modified), len(pd.Renamed),
+	)
+}
+
+// compares posts by uuid, changed files come from manifests in cache
+func DiffPostLists(oldPosts model.PostList, newPosts model.PostList, cache *HashCache) PostListDiff {
+	var diff PostListDiff
+
+	oldByUUID := make(map[uuid.UUID]model.Post)
+	for _, post := range oldPosts.Posts {
+		oldByUUID[post.UUID] = post
+	}
+
+	newUUIDs := make(map[uuid.UUID]bool)
+
+	for _, post := range newPosts.Posts {
+		newUUIDs[post.UUID] = true
+
+		old, ok := oldByUUID[post.UUID]
+		if !ok {
+			diff.Added = append(diff.Added, post)
+			continue
+		}
+
+		if old.Dir != post.Dir {
+			diff.Renamed = append(diff.Renamed, RenamedPost{Post: post, OldDir: old.Dir})
+		}
+
+		if old.FileHash != post.FileHash {
+			modified := ModifiedPost{Post: post, OldFileHash: old.FileHash}
+
+			oldManifest, oldKnown := cache.Manifest(old.FileHash)
+			newManifest, newKnown := cache.Manifest(post.FileHash)
+			if oldKnown && newKnown {
+				modified.ChangedFiles = changedFiles(oldManifest, newManifest)
+				modified.FilesKnown = true
+			}
+
+			diff.Modified = append(diff.Modified, modified)
+		}
+	}
+
+	for _, post := range oldPosts.Posts {
+		if !newUUIDs[post.UUID] {
+			diff.Removed = append(diff.Removed, post)
+		}
+	}
+
+	return diff
+}
+
+func changedFiles(oldManifest PostManifest, newManifest PostManifest) []string {
+	var changed []string
+
+	for file, hash := range newManifest {
+		if oldHash, ok := oldManifest[file]; !ok || oldHash != hash {
+			changed = append(changed, file)
+		}
+	}
+	for file := range oldManifest {
+		if _, ok := newManifest[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+
+	slices.Sort(changed)
+
+	return changed
+}
@@ -0,0 +1,177 @@
+package postlist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+	"blog/util"
+)
+
+// post directories sharing one uuid,
+// usually because a post directory got copied to start a new one
+type DuplicateUUID struct {
+	UUID uuid.UUID
+
+	// directory that keeps the uuid
+	Original string
+	// newer copies, RekeyDuplicates gives them their own uuid
+	Copies []string
+}
+
+type RekeyedPost struct {
+	Dir     string
+	OldUUID uuid.UUID
+	UUID    uuid.UUID
+}
+
+// finds post directories in postRoot with the same uuid
+//
+// original is the directory oldPosts knows the uuid by,
+// if it doesn't know any of them it's the one with the oldest post-uuid.txt
+func FindDuplicateUUIDs(postRoot string, oldPosts model.PostList) ([]DuplicateUUID, error) {
+	exists, err := util.FileExists(postRoot, true)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	postDirs, err := os.ReadDir(postRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	type uuidDir struct {
+		dir     string
+		modTime time.Time
+	}
+
+	var order []uuid.UUID
+	dirsByUUID := make(map[uuid.UUID][]uuidDir)
+
+	for _, postDir := range postDirs {
+		if !postDir.IsDir() {
+			continue
+		}
+
+		postDirPath := filepath.Join(postRoot, postDir.Name())
+
+		postUUID, foundUUIDFile, err := GetPostUUIDFromDir(postDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if !foundUUIDFile {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(postDirPath, PostUUIDFileName))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := dirsByUUID[postUUID]; !ok {
+			order = append(order, postUUID)
+		}
+		dirsByUUID[postUUID] = append(dirsByUUID[postUUID], uuidDir{
+			dir:     postDir.Name(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	knownDirs := make(map[uuid.UUID]string)
+	for _, post := range oldPosts.Posts {
+		knownDirs[post.UUID] = post.Dir
+	}
+
+	var duplicates []DuplicateUUID
+
+	for _, postUUID := range order {
+		dirs := dirsByUUID[postUUID]
+		if len(dirs) < 2 {
+			continue
+		}
+
+		// known directory first, then oldest, then by name
+		knownDir := knownDirs[postUUID]
+		slices.SortFunc(dirs, func(a, b uuidDir) int {
+			if (a.dir == knownDir) != (b.dir == knownDir) {
+				if a.dir == knownDir {
+					return -1
+				}
+				return 1
+			}
+			if c := a.modTime.Compare(b.modTime); c != 0 {
+				return c
+			}
+			return strings.Compare(a.dir, b.dir)
+		})
+
+		duplicate := DuplicateUUID{UUID: postUUID, Original: dirs[0].dir}
+		for _, dir := range dirs[1:] {
+			duplicate.Copies = append(duplicate.Copies, dir.dir)
+		}
+
+		duplicates = append(duplicates, duplicate)
+	}
+
+	return duplicates, nil
+}
+
+// gives copies in dirs a new uuid, every copy FindDuplicateUUIDs finds if dirs is empty
+//
+// nothing is written unless all of dirs are copies
+func RekeyDuplicates(postRoot string, oldPosts model.PostList, dirs []string) ([]RekeyedPost, error) {
+	duplicates, err := FindDuplicateUUIDs(postRoot, oldPosts)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make(map[string]DuplicateUUID)
+	for _, duplicate := range duplicates {
+		for _, dir := range duplicate.Copies {
+			copies[dir] = duplicate
+		}
+	}
+
+	if len(dirs) == 0 {
+		for _, duplicate := range duplicates {
+			dirs = append(dirs, duplicate.Copies...)
+		}
+	}
+
+	// check everything before writing anything
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if seen[dir] {
+			return nil, fmt.Errorf("%s is listed twice", dir)
+		}
+		seen[dir] = true
+
+		if _, ok := copies[dir]; !ok {
+			return nil, fmt.Errorf("%s is not a copy of another post", dir)
+		}
+	}
+
+	var rekeyed []RekeyedPost
+
+	for _, dir := range dirs {
+		postUUID := uuid.New()
+		uuidPath := filepath.Join(postRoot, dir, PostUUIDFileName)
+
+		if err := os.WriteFile(uuidPath, []byte(postUUID.String()), 0664); err != nil {
+			return rekeyed, err
+		}
+
+		rekeyed = append(rekeyed, RekeyedPost{Dir: dir, OldUUID: copies[dir].UUID, UUID: postUUID})
+	}
+
+	return rekeyed, nil
+}
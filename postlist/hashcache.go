@@ -0,0 +1,388 @@
+package postlist
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"blog/model"
+	"blog/util"
+)
+
+// bump when what we store changes, old caches get thrown away
+const hashCacheVersion = 3
+
+// files modified this recently might change again within
+// the same mtime tick without their size changing, so we don't remember them
+const hashCacheRacyWindow = 2 * time.Second
+
+type hashCacheEntry struct {
+	Size    int64
+	ModTime int64
+	Inode   uint64
+
+	// hex encoded sha256 of the file
+	Hash string
+}
+
+// remembers hashes of files so we only hash files that changed
+//
+// files are identified by path, size, mtime and inode,
+// the cache is only an optimization and can be deleted any time
+type HashCache struct {
+	mu sync.Mutex
+
+	entries map[string]hashCacheEntry
+	// entries we looked at since loading, rest get dropped on save
+	used    map[string]bool
+	changed bool
+
+	// what files post directories had, so we can tell which files changed
+	manifests     map[string]PostManifest
+	usedManifests map[string]bool
+
+	// thumbnails we derived from post directories, empty if there was none
+	thumbnails     map[string]string
+	usedThumbnails map[string]bool
+}
+
+// relative path of every file in post directory to its hex encoded sha256
+type PostManifest map[string]string
+
+type hashCacheFile struct {
+	Version int
+	Entries map[string]hashCacheEntry
+
+	// keyed by Post.FileHash
+	Manifests map[string]PostManifest
+	// keyed by Post.FileHash, see DerivePostThumbnail
+	Thumbnails map[string]string
+}
+
+// what a scan of post directories cost
+// and what it couldn't turn into posts
+type ScanReport struct {
+	// post directories without post-uuid.txt
+	Unadopted []UnadoptedPost
+	// copies are left out of post list until they're re-keyed
+	Duplicates []DuplicateUUID
+
+	Files int
+	// files hashed because cache didn't know them
+	Hashed      int
+	HashedBytes int64
+	CacheHits   int
+
+	// posts we looked for first image in because cache didn't know them
+	DerivedThumbnails int
+
+	Duration time.Duration
+}
+
+func (sr *ScanReport) String() string {
+	str := fmt.Sprintf(
+		"scanned %d files in %v, hashed %d (%s), %d from cache",
+		sr.Files, sr.Duration.Round(time.Millisecond),
+		sr.Hashed, util.FormatByteSize(sr.HashedBytes), sr.CacheHits,
+	)
+	if sr.DerivedThumbnails > 0 {
+		str += fmt.Sprintf(", derived %d thumbnails", sr.DerivedThumbnails)
+	}
+	if len(sr.Unadopted) > 0 {
+		str += fmt.Sprintf(", %d unadopted", len(sr.Unadopted))
+	}
+	if len(sr.Duplicates) > 0 {
+		str += fmt.Sprintf(", %d duplicate uuids", len(sr.Duplicates))
+	}
+	return str
+}
+
+func NewHashCache() *HashCache {
+	return &HashCache{
+		entries: make(map[string]hashCacheEntry),
+		used:    make(map[string]bool),
+
+		manifests:     make(map[string]PostManifest),
+		usedManifests: make(map[string]bool),
+
+		thumbnails:     make(map[string]string),
+		usedThumbnails: make(map[string]bool),
+	}
+}
+
+// loads cache from name
+// missing or broken cache gives an empty one
+func LoadHashCache(name string) *HashCache {
+	cache := NewHashCache()
+
+	if name == "" {
+		return cache
+	}
+
+	jsonBytes, err := os.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			util.WarnLogger.Printf("failed to read hash cache %s: %v", name, err)
+		}
+		return cache
+	}
+
+	var cacheFile hashCacheFile
+	if err := json.Unmarshal(jsonBytes, &cacheFile); err != nil {
+		util.WarnLogger.Printf("ignoring broken hash cache %s: %v", name, err)
+		return cache
+	}
+	if cacheFile.Version != hashCacheVersion || cacheFile.Entries == nil {
+		return cache
+	}
+
+	cache.entries = cacheFile.Entries
+	if cacheFile.Manifests != nil {
+		cache.manifests = cacheFile.Manifests
+	}
+	if cacheFile.Thumbnails != nil {
+		cache.thumbnails = cacheFile.Thumbnails
+	}
+
+	return cache
+}
+
+// saves entries that were used since loading to name
+// does nothing if nothing changed
+func (hc *HashCache) Save(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if !hc.changed &&
+		len(hc.used) == len(hc.entries) &&
+		len(hc.usedManifests) == len(hc.manifests) &&
+		len(hc.usedThumbnails) == len(hc.thumbnails) {
+		return nil
+	}
+
+	cacheFile := hashCacheFile{
+		Version:    hashCacheVersion,
+		Entries:    make(map[string]hashCacheEntry),
+		Manifests:  make(map[string]PostManifest),
+		Thumbnails: make(map[string]string),
+	}
+	for key := range hc.used {
+		if entry, ok := hc.entries[key]; ok {
+			cacheFile.Entries[key] = entry
+		}
+	}
+	for fileHash := range hc.usedManifests {
+		if manifest, ok := hc.manifests[fileHash]; ok {
+			cacheFile.Manifests[fileHash] = manifest
+		}
+	}
+	for fileHash := range hc.usedThumbnails {
+		if thumbnail, ok := hc.thumbnails[fileHash]; ok {
+			cacheFile.Thumbnails[fileHash] = thumbnail
+		}
+	}
+
+	jsonBytes, err := json.Marshal(cacheFile)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	if err := util.ReplaceFile(name, jsonBytes, 0644); err != nil {
+		return err
+	}
+
+	hc.changed = false
+
+	return nil
+}
+
+// returns sha256 of file at name, from cache if file didn't change
+func (hc *HashCache) FileHash(name string, report *ScanReport) ([]byte, error) {
+	key, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   util.FileInode(info),
+	}
+
+	report.Files++
+
+	hc.mu.Lock()
+	cached, ok := hc.entries[key]
+	hc.used[key] = true
+	hc.mu.Unlock()
+
+	if ok && cached.Size == entry.Size && cached.ModTime == entry.ModTime && cached.Inode == entry.Inode {
+		if hash, err := hex.DecodeString(cached.Hash); err == nil && len(hash) == sha256.Size {
+			report.CacheHits++
+			return hash, nil
+		}
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	written, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, err
+	}
+	hash := hasher.Sum(nil)
+
+	report.Hashed++
+	report.HashedBytes += written
+
+	hc.mu.Lock()
+	if time.Since(info.ModTime()) > hashCacheRacyWindow {
+		entry.Hash = hex.EncodeToString(hash)
+		hc.entries[key] = entry
+	} else {
+		delete(hc.entries, key)
+	}
+	hc.changed = true
+	hc.mu.Unlock()
+
+	return hash, nil
+}
+
+// same as HashPostDir, but gets file hashes from cache
+//
+// result is the same as dirhash.Hash1 which is what dirhash.DefaultHash is
+func (hc *HashCache) HashPostDir(postDir string, ignore PostIgnore, report *ScanReport) (string, error) {
+	var files []string
+
+	err := WalkPostFiles(postDir, ignore, func(relPath string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			files = append(files, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slices.Sort(files)
+
+	summary := sha256.New()
+	manifest := make(PostManifest)
+
+	for _, file := range files {
+		if strings.Contains(file, "\n") {
+			return "", errors.New("dirhash: filenames with newlines are not supported")
+		}
+
+		hash, err := hc.FileHash(filepath.Join(postDir, filepath.FromSlash(file)), report)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(summary, "%x  %s\n", hash, file)
+		manifest[file] = hex.EncodeToString(hash)
+	}
+
+	fileHash := "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil))
+
+	hc.mu.Lock()
+	if _, ok := hc.manifests[fileHash]; !ok {
+		hc.manifests[fileHash] = manifest
+		hc.changed = true
+	}
+	hc.usedManifests[fileHash] = true
+	hc.mu.Unlock()
+
+	return fileHash, nil
+}
+
+// files post directory had when its hash was fileHash,
+// false if we never hashed it or cache forgot about it or there is no cache
+func (hc *HashCache) Manifest(fileHash string) (PostManifest, bool) {
+	if hc == nil {
+		return nil, false
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	manifest, ok := hc.manifests[fileHash]
+	if ok {
+		hc.usedManifests[fileHash] = true
+	}
+	return manifest, ok
+}
+
+// same as GetPostThumbnail, but derived thumbnail is remembered by
+// fileHash of post directory so post content is only read when it changed
+//
+// works without cache too
+func (hc *HashCache) GetPostThumbnail(
+	postDir string,
+	postType model.PostType,
+	fileHash string,
+	report *ScanReport,
+) (thumbnail string, hasThumbnail bool, derived bool, err error) {
+	thumbnail, hasThumbnail, err = GetPostThumbnailFromDir(postDir)
+	if err != nil || hasThumbnail {
+		return thumbnail, hasThumbnail, false, err
+	}
+
+	if hc != nil {
+		hc.mu.Lock()
+		cached, ok := hc.thumbnails[fileHash]
+		if ok {
+			hc.usedThumbnails[fileHash] = true
+		}
+		hc.mu.Unlock()
+
+		if ok {
+			return cached, cached != "", cached != "", nil
+		}
+	}
+
+	thumbnail, hasThumbnail, err = DerivePostThumbnail(postDir, postType)
+	if err != nil {
+		return "", false, false, err
+	}
+
+	report.DerivedThumbnails++
+
+	if hc != nil {
+		hc.mu.Lock()
+		hc.thumbnails[fileHash] = thumbnail
+		hc.usedThumbnails[fileHash] = true
+		hc.changed = true
+		hc.mu.Unlock()
+	}
+
+	return thumbnail, hasThumbnail, hasThumbnail, nil
+}
@@ -0,0 +1,248 @@
+package postlist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// gitignore style file that lists files in a post
+// that shouldn't be in output or affect FileHash
+//
+// one in post root applies to every post,
+// as if its patterns were in post's own .postignore
+const PostIgnoreFileName = ".postignore"
+
+// files that only mean something to us
+var defaultPostIgnore = []string{
+	"/" + PostUUIDFileName,
+	"/" + PostIgnoreFileName,
+	"/" + PostKeepMetadataFileName,
+}
+
+type postIgnorePattern struct {
+	Negate bool
+	// pattern ended with /
+	DirOnly bool
+	// pattern had / at the start or in the middle,
+	// so it matches from post directory instead of any file name
+	Anchored bool
+
+	Segments []string
+}
+
+type PostIgnore struct {
+	patterns []postIgnorePattern
+}
+
+// parses .postignore, name is only used for errors
+func ParsePostIgnore(name string, content string) (PostIgnore, error) {
+	var ignore PostIgnore
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		line = strings.TrimRight(line, " \t")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pattern postIgnorePattern
+
+		if strings.HasPrefix(line, "!") {
+			pattern.Negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			pattern.DirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if strings.Contains(line, "/") {
+			pattern.Anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		pattern.Segments = strings.Split(line, "/")
+
+		for _, segment := range pattern.Segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return PostIgnore{}, fmt.Errorf("%s:%d: bad pattern %q", name, i+1, line)
+			}
+		}
+
+		ignore.patterns = append(ignore.patterns, pattern)
+	}
+
+	return ignore, nil
+}
+
+// returns ignore with patterns appended, later ones win
+func (pi PostIgnore) With(name string, content string) (PostIgnore, error) {
+	more, err := ParsePostIgnore(name, content)
+	if err != nil {
+		return PostIgnore{}, err
+	}
+
+	var combined PostIgnore
+	combined.patterns = append(combined.patterns, pi.patterns...)
+	combined.patterns = append(combined.patterns, more.patterns...)
+
+	return combined, nil
+}
+
+// loads default patterns, .postignore in postRoot and .postignore in postDir
+func LoadPostIgnore(postRoot string, postDir string) (PostIgnore, error) {
+	ignore, err := ParsePostIgnore("default", strings.Join(defaultPostIgnore, "\n"))
+	if err != nil {
+		return PostIgnore{}, err
+	}
+
+	for _, dir := range []string{postRoot, postDir} {
+		name := filepath.Join(dir, PostIgnoreFileName)
+
+		content, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return PostIgnore{}, err
+		}
+
+		ignore, err = ignore.With(name, string(content))
+		if err != nil {
+			return PostIgnore{}, err
+		}
+	}
+
+	return ignore, nil
+}
+
+// relPath is relative to post directory and uses /
+func (pi PostIgnore) Ignored(relPath string, isDir bool) bool {
+	segments := strings.Split(path.Clean(relPath), "/")
+
+	// nothing in an ignored directory can come back
+	for i := 1; i < len(segments); i++ {
+		if pi.ignored(segments[:i], true) {
+			return true
+		}
+	}
+
+	return pi.ignored(segments, isDir)
+}
+
+func (pi PostIgnore) ignored(segments []string, isDir bool) bool {
+	ignored := false
+
+	for _, pattern := range pi.patterns {
+		if pattern.DirOnly && !isDir {
+			continue
+		}
+
+		var matched bool
+		if pattern.Anchored {
+			matched = matchIgnoreSegments(pattern.Segments, segments)
+		} else {
+			matched, _ = path.Match(pattern.Segments[0], segments[len(segments)-1])
+		}
+
+		if matched {
+			ignored = !pattern.Negate
+		}
+	}
+
+	return ignored
+}
+
+func matchIgnoreSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+
+			// trailing ** matches everything inside, but not the directory itself
+			if len(pattern) == 0 {
+				return len(name) > 0
+			}
+
+			for i := range len(name) + 1 {
+				if matchIgnoreSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// walks files in postDir that are not ignored
+// paths given to fn are relative to postDir and use /
+func WalkPostFiles(
+	postDir string,
+	ignore PostIgnore,
+	fn func(relPath string, d fs.DirEntry) error,
+) error {
+	return fs.WalkDir(os.DirFS(postDir), ".", func(relPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		if ignore.Ignored(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return fn(relPath, d)
+	})
+}
+
+// same as dirhash.HashDir but skips ignored files
+func HashPostDir(postDir string, ignore PostIgnore) (string, error) {
+	var files []string
+
+	err := WalkPostFiles(postDir, ignore, func(relPath string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			files = append(files, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	open := func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(postDir, filepath.FromSlash(name)))
+	}
+
+	return dirhash.DefaultHash(files, open)
+}
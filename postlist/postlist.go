@@ -0,0 +1,367 @@
+// finds posts in post root and keeps post list up to date with them
+package postlist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+	"blog/util"
+)
+
+var (
+	// post list of what's in output
+	PostListPath = "docs/public/post-list.json"
+
+	// where we remember hashes of post files, empty means no caching
+	HashCachePath = "cache/hashes.json"
+)
+
+func SavePostList(postList model.PostList, name string) error {
+	name = filepath.Clean(name)
+
+	dir := filepath.Dir(name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.MarshalIndent(postList, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(name, jsonBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// cache can be nil
+func GetPostFileHashFromDir(
+	postDir string,
+	ignore PostIgnore,
+	cache *HashCache,
+	report *ScanReport,
+) (string, error) {
+	if cache == nil {
+		return HashPostDir(postDir, ignore)
+	}
+	return cache.HashPostDir(postDir, ignore, report)
+}
+
+const PostUUIDFileName = "post-uuid.txt"
+
+// if post directory has this file,
+// we leave metadata in images alone
+const PostKeepMetadataFileName = "post-keep-metadata"
+
+func GetPostUUIDFromDir(postDir string) (uuid.UUID, bool, error) {
+	dirents, err := os.ReadDir(postDir)
+	if err != nil {
+		return uuid.UUID{}, false, err
+	}
+
+	for _, dirent := range dirents {
+		if !dirent.Type().IsRegular() {
+			continue
+		}
+
+		if dirent.Name() == PostUUIDFileName {
+			uuidPath := filepath.Join(postDir, dirent.Name())
+			uuidFile, err := os.ReadFile(uuidPath)
+			if err != nil {
+				return uuid.UUID{}, false, err
+			}
+
+			postUUID, err := uuid.Parse(string(uuidFile))
+			if err != nil {
+				return uuid.UUID{}, false, err
+			}
+
+			return postUUID, true, nil
+		}
+	}
+
+	return uuid.UUID{}, false, nil
+}
+
+func GetPostTypeFromDir(postDir string) (model.PostType, error) {
+	dirents, err := os.ReadDir(postDir)
+	if err != nil {
+		return model.PostTypeNone, err
+	}
+
+	for _, dirent := range dirents {
+		if !dirent.Type().IsRegular() {
+			continue
+		}
+
+		if dirent.Name() == "index.html" {
+			return model.PostTypeHTML, nil
+		}
+
+		if dirent.Name() == "index.md" {
+			return model.PostTypeMarkDown, nil
+		}
+	}
+
+	return model.PostTypeNone, nil
+}
+
+func GetPostThumbnailFromDir(postDir string) (string, bool, error) {
+	dirents, err := os.ReadDir(postDir)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, dirent := range dirents {
+		if !dirent.Type().IsRegular() {
+			continue
+		}
+
+		name := dirent.Name()
+		ext := util.ExtLowered(name)
+
+		// we only look at the name here,
+		// actual format is figured out from content when post is compiled
+		if name[:len(name)-len(ext)] == thumbnailBaseName && slices.Contains(thumbnailExts, ext) {
+			thumbnailPath := name
+			return thumbnailPath, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// try to load post list
+// file not existing isn't an error
+func LoadPostList(postListPath string) (model.PostList, error) {
+	// check if file exists
+	info, err := os.Stat(postListPath)
+
+	if err == nil { // file exists
+		mode := info.Mode()
+		if !mode.IsRegular() {
+			return model.PostList{}, fmt.Errorf("%s is not regular", postListPath)
+		}
+
+		file, err := os.ReadFile(postListPath)
+		if err != nil {
+			return model.PostList{}, err
+		}
+
+		var postList model.PostList
+
+		err = json.Unmarshal(file, &postList)
+		if err != nil {
+			return model.PostList{}, err
+		}
+
+		return postList, nil
+	} else if errors.Is(err, os.ErrNotExist) { // file does not exists
+		return model.PostList{}, nil
+	} else { // unable to check if file exists or not
+		return model.PostList{}, err
+	}
+}
+
+// scans postRoot without writing anything,
+// directories without post-uuid.txt end up in ScanReport.Unadopted
+// and copies of other posts in ScanReport.Duplicates
+//
+// hashCache can be nil, it's up to caller to save it
+func GenerateUpdatedPostList(
+	postRoot string,
+	oldPosts model.PostList,
+	hashCache *HashCache,
+) (model.PostList, ScanReport, error) {
+	var updatedPosts []model.Post
+	var newPosts []model.Post
+
+	var postDirs []os.DirEntry
+
+	{
+		exists, err := util.FileExists(postRoot, true)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+		if !exists {
+			return model.PostList{}, ScanReport{}, nil
+		}
+	}
+
+	postDirs, err := os.ReadDir(postRoot)
+	if err != nil {
+		return model.PostList{}, ScanReport{}, err
+	}
+
+	now := time.Now()
+
+	var report ScanReport
+
+	// DiffPostLists needs to know what files saved posts had
+	for _, post := range oldPosts.Posts {
+		hashCache.Manifest(post.FileHash)
+	}
+
+	// copied post directories would be mistaken for the post they're copied from
+	duplicates, err := FindDuplicateUUIDs(postRoot, oldPosts)
+	if err != nil {
+		return model.PostList{}, ScanReport{}, err
+	}
+	report.Duplicates = duplicates
+
+	isCopy := make(map[string]bool)
+	for _, duplicate := range duplicates {
+		for _, dir := range duplicate.Copies {
+			isCopy[dir] = true
+		}
+	}
+
+	for _, postDir := range postDirs {
+		if !postDir.IsDir() || isCopy[postDir.Name()] {
+			continue
+		}
+
+		postDirPath := filepath.Join(postRoot, postDir.Name())
+
+		// ===============
+		var post model.Post
+		// ===============
+
+		// ===========================================
+		// first, try to find UUID, if you couldn't
+		// it's up to AdoptPosts to make one
+		// ===========================================
+
+		// try to find uuid
+		postUUID, foundUUIDFile, err := GetPostUUIDFromDir(postDirPath)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+
+		if !foundUUIDFile {
+			postType, err := GetPostTypeFromDir(postDirPath)
+			if err != nil {
+				return model.PostList{}, ScanReport{}, err
+			}
+			if postType != model.PostTypeNone {
+				report.Unadopted = append(report.Unadopted, UnadoptedPost{
+					Dir:  postDir.Name(),
+					Type: postType,
+				})
+			}
+			continue
+		}
+
+		post.UUID = postUUID
+
+		// =======================================================================
+		// next, we need to get things that we know just by looking at directory
+		// =======================================================================
+		// get post dir
+		post.Dir = postDir.Name()
+
+		// get post hash
+		ignore, err := LoadPostIgnore(postRoot, postDirPath)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+
+		postFileHash, err := GetPostFileHashFromDir(postDirPath, ignore, hashCache, &report)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+		post.FileHash = postFileHash
+
+		// get post type
+		postType, err := GetPostTypeFromDir(postDirPath)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+		if postType == model.PostTypeNone {
+			continue
+		}
+		post.Type = postType
+
+		// get post thumbnail
+		postThumbnail, hasThumbnail, thumbnailDerived, err := hashCache.GetPostThumbnail(
+			postDirPath, postType, postFileHash, &report,
+		)
+		if err != nil {
+			return model.PostList{}, ScanReport{}, err
+		}
+		post.Thumbnail = postThumbnail
+		post.HasThumbnail = hasThumbnail
+		post.ThumbnailDerived = thumbnailDerived
+
+		// =======================================================================
+		// check if this post is a newly created post or an old post.
+		//
+		// because if it's an old post,
+		// we want it's creation date and name to carry over
+		// =======================================================================
+
+		// check if there already is a post with same uuid
+		alreadyExists := false
+		var alreadyExistingOldPost model.Post
+
+		for _, otherPost := range oldPosts.Posts {
+			if otherPost.UUID == post.UUID {
+				alreadyExists = true
+				alreadyExistingOldPost = otherPost
+				break
+			}
+		}
+
+		// carry over name and date
+		if alreadyExists {
+			post.Name = alreadyExistingOldPost.Name
+			post.Date = alreadyExistingOldPost.Date
+
+			// things we got from compiling stay the same if nothing changed
+			if alreadyExistingOldPost.FileHash == post.FileHash {
+				post.CarryOverCompiled(alreadyExistingOldPost)
+			}
+		} else {
+			post.Name = postDir.Name()
+			post.Date = now
+		}
+
+		if alreadyExists {
+			updatedPosts = append(updatedPosts, post)
+		} else {
+			newPosts = append(newPosts, post)
+		}
+	}
+
+	// sort updated posts
+	originalIndicies := make(map[uuid.UUID]int)
+	for i, post := range oldPosts.Posts {
+		originalIndicies[post.UUID] = i
+	}
+	slices.SortFunc(updatedPosts, func(a, b model.Post) int {
+		return originalIndicies[a.UUID] - originalIndicies[b.UUID]
+	})
+
+	// sort newPosts
+	slices.SortFunc(newPosts, func(a, b model.Post) int {
+		return strings.Compare(b.Name, a.Name)
+	})
+
+	newPosts = append(newPosts, updatedPosts...)
+
+	report.Duration = time.Since(now)
+
+	return model.PostList{Posts: newPosts}, report, nil
+}
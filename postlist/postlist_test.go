@@ -0,0 +1,738 @@
+package postlist
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"blog/model"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pngBytes(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func findPost(postList model.PostList, dir string) (model.Post, bool) {
+	for _, post := range postList.Posts {
+		if post.Dir == dir {
+			return post, true
+		}
+	}
+	return model.Post{}, false
+}
+
+func TestGenerateUpdatedPostList(t *testing.T) {
+	HashCachePath = ""
+
+	postRoot := t.TempDir()
+
+	writeFiles(t, filepath.Join(postRoot, "html-post"), map[string][]byte{
+		"index.html": []byte(`<html><body><img src="cat.png"></body></html>`),
+		"cat.png":    pngBytes(t, 4, 4),
+	})
+	writeFiles(t, filepath.Join(postRoot, "markdown-post"), map[string][]byte{
+		"index.md":           []byte("# hello\n"),
+		"post-thumbnail.png": pngBytes(t, 4, 4),
+	})
+	writeFiles(t, filepath.Join(postRoot, "not-a-post"), map[string][]byte{
+		"notes.txt": []byte("nothing to see"),
+	})
+
+	// nothing has a uuid yet, scanning only reports that
+	postList, scan, err := GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postList.Posts) != 0 || len(scan.Unadopted) != 2 {
+		t.Fatalf("got %d posts and %d unadopted, want 0 and 2", len(postList.Posts), len(scan.Unadopted))
+	}
+	for _, dir := range []string{"html-post", "markdown-post"} {
+		if _, err := os.Stat(filepath.Join(postRoot, dir, PostUUIDFileName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("scan wrote %s into %s", PostUUIDFileName, dir)
+		}
+	}
+
+	adopted, err := AdoptPosts(postRoot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adopted) != 2 {
+		t.Fatalf("adopted %d posts, want 2", len(adopted))
+	}
+
+	postList, scan, err = GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scan.Unadopted) != 0 {
+		t.Errorf("still unadopted after adopting: %v", scan.Unadopted)
+	}
+	if len(postList.Posts) != 2 {
+		t.Fatalf("got %d posts, want 2", len(postList.Posts))
+	}
+
+	htmlPost, ok := findPost(postList, "html-post")
+	if !ok {
+		t.Fatalf("html-post is missing")
+	}
+	if htmlPost.Type != model.PostTypeHTML {
+		t.Errorf("html-post is %v", htmlPost.Type)
+	}
+	if !htmlPost.HasThumbnail || htmlPost.Thumbnail != "cat.png" || !htmlPost.ThumbnailDerived {
+		t.Errorf("html-post should have derived thumbnail cat.png, got %+v", htmlPost)
+	}
+
+	markdownPost, ok := findPost(postList, "markdown-post")
+	if !ok {
+		t.Fatalf("markdown-post is missing")
+	}
+	if markdownPost.Type != model.PostTypeMarkDown {
+		t.Errorf("markdown-post is %v", markdownPost.Type)
+	}
+	if markdownPost.Thumbnail != "post-thumbnail.png" || markdownPost.ThumbnailDerived {
+		t.Errorf("markdown-post should use post-thumbnail.png, got %+v", markdownPost)
+	}
+
+	// post list uses uuids adoption wrote
+	for _, post := range adopted {
+		scanned, _ := findPost(postList, post.Dir)
+		if scanned.UUID != post.UUID {
+			t.Errorf("%s adopted as %v, post list has %v", post.Dir, post.UUID, scanned.UUID)
+		}
+	}
+
+	// names and dates carry over, changed posts get a new hash
+	date := time.Date(2005, 6, 7, 17, 35, 16, 0, time.UTC)
+	for i := range postList.Posts {
+		postList.Posts[i].Name = "renamed " + postList.Posts[i].Dir
+		postList.Posts[i].Date = date
+	}
+
+	writeFiles(t, filepath.Join(postRoot, "markdown-post"), map[string][]byte{
+		"index.md": []byte("# hello again\n"),
+	})
+
+	updated, _, err := GenerateUpdatedPostList(postRoot, postList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, post := range updated.Posts {
+		if post.Name != "renamed "+post.Dir || !post.Date.Equal(date) {
+			t.Errorf("%s: name and date didn't carry over: %q %v", post.Dir, post.Name, post.Date)
+		}
+
+		old, _ := findPost(postList, post.Dir)
+		if changed := post.FileHash != old.FileHash; changed != (post.Dir == "markdown-post") {
+			t.Errorf("%s: hash changed is %v", post.Dir, changed)
+		}
+	}
+}
+
+func TestAdoptPosts(t *testing.T) {
+	postRoot := t.TempDir()
+
+	writeFiles(t, postRoot, map[string][]byte{
+		"first/index.md":      []byte("# first\n"),
+		"second/index.html":   []byte("<html></html>"),
+		"not-a-post/notes.md": []byte("notes"),
+	})
+
+	unadopted, err := FindUnadoptedPosts(postRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unadopted) != 2 || unadopted[0].Dir != "first" || unadopted[0].Type != model.PostTypeMarkDown {
+		t.Fatalf("unadopted posts are %+v", unadopted)
+	}
+
+	for _, dirs := range [][]string{
+		{"not-a-post"},
+		{"../first"},
+		{"missing"},
+		{"first", "first"},
+		// one bad dir stops all of them
+		{"first", "not-a-post"},
+	} {
+		if _, err := AdoptPosts(postRoot, dirs); err == nil {
+			t.Errorf("adopting %v should fail", dirs)
+		}
+	}
+	if _, found, _ := GetPostUUIDFromDir(filepath.Join(postRoot, "first")); found {
+		t.Fatalf("failed adoption wrote %s", PostUUIDFileName)
+	}
+
+	adopted, err := AdoptPosts(postRoot, []string{"first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postUUID, found, err := GetPostUUIDFromDir(filepath.Join(postRoot, "first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adopted) != 1 || !found || postUUID != adopted[0].UUID {
+		t.Errorf("adopted %+v, %s has %v", adopted, PostUUIDFileName, postUUID)
+	}
+
+	// adopting twice doesn't give a new uuid
+	if _, err := AdoptPosts(postRoot, []string{"first"}); err == nil {
+		t.Errorf("adopting adopted post should fail")
+	}
+
+	unadopted, err = FindUnadoptedPosts(postRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unadopted) != 1 || unadopted[0].Dir != "second" {
+		t.Errorf("unadopted posts are %+v", unadopted)
+	}
+}
+
+func TestDuplicateUUIDs(t *testing.T) {
+	HashCachePath = ""
+
+	postRoot := t.TempDir()
+	postUUID := uuid.New()
+
+	for _, dir := range []string{"original", "copy"} {
+		writeFiles(t, filepath.Join(postRoot, dir), map[string][]byte{
+			"index.md":       []byte("# " + dir + "\n"),
+			PostUUIDFileName: []byte(postUUID.String()),
+		})
+	}
+
+	// copy got its post-uuid.txt later
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(postRoot, "original", PostUUIDFileName), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	postList, scan, err := GenerateUpdatedPostList(postRoot, model.PostList{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postList.Posts) != 1 || postList.Posts[0].Dir != "original" {
+		t.Fatalf("post list has %+v", postList.Posts)
+	}
+	if len(scan.Duplicates) != 1 {
+		t.Fatalf("got %d duplicates, want 1", len(scan.Duplicates))
+	}
+	duplicate := scan.Duplicates[0]
+	if duplicate.UUID != postUUID || duplicate.Original != "original" || len(duplicate.Copies) != 1 || duplicate.Copies[0] != "copy" {
+		t.Errorf("duplicate is %+v", duplicate)
+	}
+
+	// post list knowing the uuid decides over age
+	known := model.PostList{Posts: []model.Post{{UUID: postUUID, Dir: "copy"}}}
+	duplicates, err := FindDuplicateUUIDs(postRoot, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 1 || duplicates[0].Original != "copy" {
+		t.Errorf("duplicates are %+v", duplicates)
+	}
+
+	if _, err := RekeyDuplicates(postRoot, postList, []string{"original"}); err == nil {
+		t.Errorf("re-keying original should fail")
+	}
+
+	rekeyed, err := RekeyDuplicates(postRoot, postList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rekeyed) != 1 || rekeyed[0].Dir != "copy" || rekeyed[0].OldUUID != postUUID || rekeyed[0].UUID == postUUID {
+		t.Fatalf("re-keyed %+v", rekeyed)
+	}
+
+	postList, scan, err = GenerateUpdatedPostList(postRoot, postList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postList.Posts) != 2 || len(scan.Duplicates) != 0 {
+		t.Errorf("got %d posts and %d duplicates after re-keying", len(postList.Posts), len(scan.Duplicates))
+	}
+}
+
+func TestDiffPostLists(t *testing.T) {
+	postRoot := t.TempDir()
+
+	for _, dir := range []string{"changed", "moved", "removed"} {
+		writeFiles(t, filepath.Join(postRoot, dir), map[string][]byte{
+			"index.md": []byte("# " + dir + "\n"),
+			"old.txt":  []byte("old"),
+		})
+	}
+	if _, err := AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// saved cache is what update-posts leaves behind
+	cacheFile := filepath.Join(t.TempDir(), "hashes.json")
+
+	cache := NewHashCache()
+	saved, _, err := GenerateUpdatedPostList(postRoot, model.PostList{}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, filepath.Join(postRoot, "changed"), map[string][]byte{
+		"index.md":       []byte("# changed again\n"),
+		"images/new.png": pngBytes(t, 4, 4),
+	})
+	if err := os.Remove(filepath.Join(postRoot, "changed", "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(postRoot, "moved"), filepath.Join(postRoot, "moved-here")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(postRoot, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, filepath.Join(postRoot, "added"), map[string][]byte{
+		"index.md": []byte("# added\n"),
+	})
+	if _, err := AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// diff uses what scan kept in memory
+	cache = LoadHashCache(cacheFile)
+	scanned, _, err := GenerateUpdatedPostList(postRoot, saved, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := DiffPostLists(saved, scanned, cache)
+
+	if len(diff.Added) != 1 || diff.Added[0].Dir != "added" {
+		t.Errorf("added %+v", diff.Added)
+	}
+
+	removed, _ := findPost(saved, "removed")
+	if len(diff.Removed) != 1 || diff.Removed[0].UUID != removed.UUID || diff.Removed[0].Dir != "removed" {
+		t.Errorf("removed %+v", diff.Removed)
+	}
+
+	if len(diff.Renamed) != 1 || diff.Renamed[0].Post.Dir != "moved-here" || diff.Renamed[0].OldDir != "moved" {
+		t.Errorf("renamed %+v", diff.Renamed)
+	}
+
+	if len(diff.Modified) != 1 {
+		t.Fatalf("modified %+v", diff.Modified)
+	}
+	modified := diff.Modified[0]
+	want := []string{"images/new.png", "index.md", "old.txt"}
+	if modified.Post.Dir != "changed" || !modified.FilesKnown || !slices.Equal(modified.ChangedFiles, want) {
+		t.Errorf("modified %+v, want changed files %v", modified, want)
+	}
+
+	// without old files in cache we only know something changed
+	diff = DiffPostLists(saved, scanned, NewHashCache())
+	if len(diff.Modified) != 1 || diff.Modified[0].FilesKnown || len(diff.Modified[0].ChangedFiles) != 0 {
+		t.Errorf("modified without cache %+v", diff.Modified)
+	}
+}
+
+func TestSaveAndLoadPostList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "public", "post-list.json")
+
+	postList, err := LoadPostList(name)
+	if err != nil {
+		t.Fatalf("missing post list: %v", err)
+	}
+	if len(postList.Posts) != 0 {
+		t.Fatalf("missing post list has %d posts", len(postList.Posts))
+	}
+
+	saved := model.PostList{Posts: []model.Post{{
+		UUID: uuid.New(),
+		Name: "post",
+		Type: model.PostTypeMarkDown,
+		Date: time.Date(2005, 6, 7, 17, 35, 16, 0, time.UTC),
+		Dir:  "post",
+	}}}
+
+	if err := SavePostList(saved, name); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPostList(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Posts) != 1 {
+		t.Fatalf("loaded %d posts, want 1", len(loaded.Posts))
+	}
+
+	got, want := loaded.Posts[0], saved.Posts[0]
+	if got.UUID != want.UUID || got.Name != want.Name || got.Type != want.Type || !got.Date.Equal(want.Date) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPostIgnore(t *testing.T) {
+	ignore, err := ParsePostIgnore("test", "# comment\n*.psd\n/drafts/\n!keep.psd\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"cat.png", false, false},
+		{"cat.psd", false, true},
+		{"images/cat.psd", false, true},
+		{"keep.psd", false, false},
+		{"drafts", true, true},
+		{"drafts", false, false},
+		{"images/drafts", true, false},
+	}
+
+	for _, test := range tests {
+		if got := ignore.Ignored(test.path, test.isDir); got != test.ignored {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+
+	if _, err := ParsePostIgnore("test", "[\n"); err == nil {
+		t.Errorf("bad pattern should fail")
+	}
+}
+
+func TestCachedHashMatchesHashPostDir(t *testing.T) {
+	postDir := t.TempDir()
+	writeFiles(t, postDir, map[string][]byte{
+		"index.md":       []byte("# hello\n"),
+		"images/cat.png": pngBytes(t, 4, 4),
+	})
+
+	ignore, err := LoadPostIgnore(postDir, postDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := HashPostDir(postDir, ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewHashCache()
+	for range 2 {
+		var report ScanReport
+		got, err := GetPostFileHashFromDir(postDir, ignore, cache, &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("cached hash %s, want %s", got, want)
+		}
+		if report.Files != 2 {
+			t.Errorf("scanned %d files, want 2", report.Files)
+		}
+	}
+}
+
+func TestHashCacheThumbnails(t *testing.T) {
+	postRoot := t.TempDir()
+	cacheFile := filepath.Join(t.TempDir(), "hashes.json")
+
+	writeFiles(t, filepath.Join(postRoot, "with-image"), map[string][]byte{
+		"index.md": []byte("# cats\n\n![cat](cat.png)\n"),
+		"cat.png":  pngBytes(t, 4, 4),
+		"dog.png":  pngBytes(t, 8, 8),
+	})
+	writeFiles(t, filepath.Join(postRoot, "without-image"), map[string][]byte{
+		"index.md": []byte("# just text\n"),
+	})
+	writeFiles(t, filepath.Join(postRoot, "with-thumbnail"), map[string][]byte{
+		"index.md":           []byte("# thumbnail\n"),
+		"post-thumbnail.png": pngBytes(t, 4, 4),
+	})
+
+	if _, err := AdoptPosts(postRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(cache *HashCache, wantDerived int) model.PostList {
+		t.Helper()
+
+		postList, report, err := GenerateUpdatedPostList(postRoot, model.PostList{}, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.DerivedThumbnails != wantDerived {
+			t.Errorf("derived %d thumbnails, want %d", report.DerivedThumbnails, wantDerived)
+		}
+
+		withImage, _ := findPost(postList, "with-image")
+		withoutImage, _ := findPost(postList, "without-image")
+		if !withImage.HasThumbnail || !withImage.ThumbnailDerived {
+			t.Errorf("with-image has no derived thumbnail: %+v", withImage)
+		}
+		if withoutImage.HasThumbnail || withoutImage.ThumbnailDerived {
+			t.Errorf("without-image has thumbnail: %+v", withoutImage)
+		}
+
+		return postList
+	}
+
+	cache := NewHashCache()
+
+	// posts with post-thumbnail file don't need deriving
+	scan(cache, 2)
+	scan(cache, 0)
+
+	if err := cache.Save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = LoadHashCache(cacheFile)
+	scan(cache, 0)
+
+	// changed post is derived again
+	writeFiles(t, filepath.Join(postRoot, "with-image"), map[string][]byte{
+		"index.md": []byte("# dogs\n\n![dog](dog.png)\n"),
+	})
+
+	postList := scan(cache, 1)
+	if withImage, _ := findPost(postList, "with-image"); withImage.Thumbnail != "dog.png" {
+		t.Errorf("with-image thumbnail is %s, want dog.png", withImage.Thumbnail)
+	}
+
+	// changing it back finds it by old hash
+	writeFiles(t, filepath.Join(postRoot, "with-image"), map[string][]byte{
+		"index.md": []byte("# cats\n\n![cat](cat.png)\n"),
+	})
+
+	postList = scan(cache, 0)
+	if withImage, _ := findPost(postList, "with-image"); withImage.Thumbnail != "cat.png" {
+		t.Errorf("with-image thumbnail is %s, want cat.png", withImage.Thumbnail)
+	}
+
+	// without cache it's derived every time
+	scan(nil, 2)
+	scan(nil, 2)
+}
+
+func TestDerivePostThumbnail(t *testing.T) {
+	pngData := string(pngBytes(t, 4, 4))
+
+	tests := []struct {
+		name     string
+		postType model.PostType
+		files    map[string]string
+		want     string
+	}{
+		{
+			name:     "first markdown image",
+			postType: model.PostTypeMarkDown,
+			files:    map[string]string{"index.md": "# a\n\n![one](one.png)\n\n![two](two.png)\n", "one.png": pngData, "two.png": pngData},
+			want:     "one.png",
+		},
+		{
+			name:     "remote, missing, broken and unknown images are skipped",
+			postType: model.PostTypeMarkDown,
+			files: map[string]string{
+				"index.md":          "![r](https://example.com/r.png) ![m](missing.png) ![b](broken.png) ![t](notes.txt) ![ok](images/ok%20cat.png)\n",
+				"broken.png":        "not a png",
+				"notes.txt":         pngData,
+				"images/ok cat.png": pngData,
+			},
+			want: "images/ok cat.png",
+		},
+		{
+			name:     "gallery poster, not the video",
+			postType: model.PostTypeMarkDown,
+			files:    map[string]string{"index.md": "<gallery>\n[![clip](poster.png)](clip.mp4)\n</gallery>\n", "poster.png": pngData, "clip.mp4": "video"},
+			want:     "poster.png",
+		},
+		{
+			name:     "gallery glob",
+			postType: model.PostTypeMarkDown,
+			files:    map[string]string{"index.md": "<gallery src=\"shots/*.png\"></gallery>\n", "shots/b.png": pngData, "shots/a.png": pngData},
+			want:     "shots/a.png",
+		},
+		{
+			name:     "broken markdown still gives thumbnail",
+			postType: model.PostTypeMarkDown,
+			files:    map[string]string{"index.md": "![one](one.png)\n\n<gallery>\n", "one.png": pngData},
+			want:     "one.png",
+		},
+		{
+			name:     "og:image comes before img",
+			postType: model.PostTypeHTML,
+			files: map[string]string{
+				"index.html": `<html><head><meta property="og:image" content="og.png"></head><body><img src="img.png"></body></html>`,
+				"og.png":     pngData,
+				"img.png":    pngData,
+			},
+			want: "og.png",
+		},
+		{
+			name:     "first usable img",
+			postType: model.PostTypeHTML,
+			files:    map[string]string{"index.html": `<img src="/public/logo.png"><img src="img.png">`, "img.png": pngData},
+			want:     "img.png",
+		},
+		{
+			name:     "no images",
+			postType: model.PostTypeMarkDown,
+			files:    map[string]string{"index.md": "# just text\n"},
+			want:     "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			postDir := t.TempDir()
+			files := make(map[string][]byte)
+			for name, content := range test.files {
+				files[name] = []byte(content)
+			}
+			writeFiles(t, postDir, files)
+
+			thumbnail, hasThumbnail, err := DerivePostThumbnail(postDir, test.postType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumbnail != test.want || hasThumbnail != (test.want != "") {
+				t.Errorf("got %q, %v, want %q", thumbnail, hasThumbnail, test.want)
+			}
+
+			// post-thumbnail file wins over deriving
+			writeFiles(t, postDir, map[string][]byte{"post-thumbnail.png": []byte(pngData)})
+			thumbnail, _, derived, err := GetPostThumbnail(postDir, test.postType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumbnail != "post-thumbnail.png" || derived {
+				t.Errorf("with post-thumbnail.png got %q, derived %v", thumbnail, derived)
+			}
+		})
+	}
+}
+
+func TestPostIgnoreFileHash(t *testing.T) {
+	postRoot := t.TempDir()
+	postDir := filepath.Join(postRoot, "post")
+
+	writeFiles(t, postRoot, map[string][]byte{
+		PostIgnoreFileName: []byte("*.psd\n"),
+	})
+	writeFiles(t, postDir, map[string][]byte{
+		PostIgnoreFileName:     []byte("drafts/\n!keep.psd\n"),
+		PostUUIDFileName:       []byte(uuid.NewString()),
+		"index.md":             []byte("# hello\n"),
+		"art.psd":              []byte("layers"),
+		"keep.psd":             []byte("kept layers"),
+		"drafts/old.md":        []byte("# old\n"),
+		"images/drafts/cat.md": []byte("drafts/ isn't anchored, so this goes too"),
+		"images/cat.md":        []byte("# cat\n"),
+	})
+
+	hash := func() string {
+		t.Helper()
+
+		ignore, err := LoadPostIgnore(postRoot, postDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileHash, err := GetPostFileHashFromDir(postDir, ignore, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// cached hash has to agree
+		cached, err := GetPostFileHashFromDir(postDir, ignore, NewHashCache(), &ScanReport{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != fileHash {
+			t.Errorf("cached hash %s, want %s", cached, fileHash)
+		}
+
+		return fileHash
+	}
+
+	ignore, err := LoadPostIgnore(postRoot, postDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	err = WalkPostFiles(postDir, ignore, func(relPath string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			walked = append(walked, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(walked)
+	if want := []string{"images/cat.md", "index.md", "keep.psd"}; !slices.Equal(walked, want) {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+
+	before := hash()
+
+	// ignored files don't change hash
+	writeFiles(t, postDir, map[string][]byte{
+		"art.psd":       []byte("more layers"),
+		"drafts/new.md": []byte("# new\n"),
+	})
+	if after := hash(); after != before {
+		t.Errorf("changing ignored files changed hash")
+	}
+
+	// rest do
+	writeFiles(t, postDir, map[string][]byte{
+		"keep.psd": []byte("changed layers"),
+	})
+	if after := hash(); after == before {
+		t.Errorf("changing keep.psd didn't change hash")
+	}
+
+	writeFiles(t, postDir, map[string][]byte{
+		PostIgnoreFileName: []byte("[\n"),
+	})
+	if _, err := LoadPostIgnore(postRoot, postDir); err == nil || !strings.Contains(err.Error(), PostIgnoreFileName+":1") {
+		t.Errorf("bad pattern gives %v", err)
+	}
+}
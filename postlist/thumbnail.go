@@ -0,0 +1,234 @@
+package postlist
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+
+	"blog/markdown"
+	"blog/model"
+	"blog/util"
+)
+
+// thumbnail file name without extension
+const thumbnailBaseName = "post-thumbnail"
+
+var thumbnailExts = []string{
+	".jpeg", ".jpg", ".png", ".bmp", ".gif", ".webp", ".svg",
+}
+
+// find out what format thumbnail is by looking at its content
+//
+// returns format name image package uses ("jpeg", "png" ...) or "svg"
+func SniffThumbnailFormat(thumbnailBytes []byte) (string, error) {
+	_, format, err := image.DecodeConfig(bytes.NewReader(thumbnailBytes))
+	if err == nil {
+		return format, nil
+	}
+
+	if isSVG(thumbnailBytes) {
+		return "svg", nil
+	}
+
+	return "", fmt.Errorf("not a image format we know")
+}
+
+// check if first element is <svg>
+func isSVG(file []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(file))
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t.Name.Local == "svg"
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+// get svg size from width and height, or from viewBox
+// returns 0 if we couldn't figure it out
+func SVGDimension(file []byte) (int, int) {
+	decoder := xml.NewDecoder(bytes.NewReader(file))
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var width, height float64
+		var viewBox []float64
+
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width, _ = strconv.ParseFloat(strings.TrimSuffix(attr.Value, "px"), 64)
+			case "height":
+				height, _ = strconv.ParseFloat(strings.TrimSuffix(attr.Value, "px"), 64)
+			case "viewBox":
+				for _, field := range strings.FieldsFunc(attr.Value, func(r rune) bool {
+					return r == ' ' || r == ','
+				}) {
+					v, err := strconv.ParseFloat(field, 64)
+					if err != nil {
+						break
+					}
+					viewBox = append(viewBox, v)
+				}
+			}
+		}
+
+		if width > 0 && height > 0 {
+			return int(width + 0.5), int(height + 0.5)
+		}
+
+		if len(viewBox) == 4 && viewBox[2] > 0 && viewBox[3] > 0 {
+			return int(viewBox[2] + 0.5), int(viewBox[3] + 0.5)
+		}
+
+		return 0, 0
+	}
+}
+
+// find post thumbnail
+//
+// if there is no post-thumbnail file, we use first image in the post instead
+// and derived is set to true
+func GetPostThumbnail(postDir string, postType model.PostType) (thumbnail string, hasThumbnail bool, derived bool, err error) {
+	thumbnail, hasThumbnail, err = GetPostThumbnailFromDir(postDir)
+	if err != nil || hasThumbnail {
+		return thumbnail, hasThumbnail, false, err
+	}
+
+	thumbnail, hasThumbnail, err = DerivePostThumbnail(postDir, postType)
+	return thumbnail, hasThumbnail, hasThumbnail, err
+}
+
+// get first local image in post that can be used as a thumbnail
+//
+// for markdown post, it's first image or gallery image in index.md
+// for html post, it's og:image or first <img> in index.html
+func DerivePostThumbnail(postDir string, postType model.PostType) (string, bool, error) {
+	var candidates []string
+
+	switch postType {
+	case model.PostTypeMarkDown:
+		markdownBytes, err := os.ReadFile(filepath.Join(postDir, "index.md"))
+		if err != nil {
+			return "", false, err
+		}
+
+		// problems in markdown are reported when post is compiled
+		candidates = markdown.ListMarkdownImages(markdownBytes, postDir)
+	case model.PostTypeHTML:
+		htmlBytes, err := os.ReadFile(filepath.Join(postDir, "index.html"))
+		if err != nil {
+			return "", false, err
+		}
+
+		candidates = htmlImageSources(htmlBytes)
+	}
+
+	for _, candidate := range candidates {
+		localPath, isLocal := markdown.LocalImagePath(candidate)
+		if !isLocal {
+			continue
+		}
+
+		if !slices.Contains(thumbnailExts, util.ExtLowered(localPath)) {
+			continue
+		}
+
+		// we don't want to derive a thumbnail that will fail to compile
+		file, err := os.ReadFile(filepath.Join(postDir, filepath.FromSlash(localPath)))
+		if err != nil {
+			continue
+		}
+		if _, err := SniffThumbnailFormat(file); err != nil {
+			continue
+		}
+
+		return localPath, true, nil
+	}
+
+	return "", false, nil
+}
+
+// get og:image and every <img> src in html, og:image comes first
+func htmlImageSources(htmlBytes []byte) []string {
+	var ogImages []string
+	var imgs []string
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(htmlBytes))
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		getAttr := func(key string) string {
+			for _, attr := range token.Attr {
+				if attr.Key == key {
+					return attr.Val
+				}
+			}
+			return ""
+		}
+
+		switch token.DataAtom {
+		case atom.Meta:
+			property := getAttr("property")
+			if property == "" {
+				property = getAttr("name")
+			}
+			if property == "og:image" {
+				if content := getAttr("content"); content != "" {
+					ogImages = append(ogImages, content)
+				}
+			}
+		case atom.Img:
+			if src := getAttr("src"); src != "" {
+				imgs = append(imgs, src)
+			}
+		}
+	}
+
+	return append(ogImages, imgs...)
+}
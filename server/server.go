@@ -0,0 +1,489 @@
+// admin page and api it uses to update posts
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"blog/compiler"
+	"blog/model"
+	"blog/postlist"
+	"blog/util"
+)
+
+func StartServer() error {
+	http.Handle("/", LogReqest(NoCache(http.FileServer(http.Dir("./docs")))))
+	http.Handle("/admin/",
+		LogReqest(
+			NoCache(
+				http.StripPrefix("/admin/", http.FileServer(http.Dir("./admin"))),
+			),
+		),
+	)
+	http.Handle("/api/", LogReqest(&AdminAPIHandler{}))
+
+	if TestDocsPath != "" {
+		testSever := LogReqest(NoCache(http.FileServer(http.Dir(TestDocsPath))))
+		http.Handle("/public/post-list.json", testSever)
+		http.Handle("/posts/", testSever)
+		http.Handle(compiler.SharedAssetsURL+"/", testSever)
+	}
+
+	err := http.ListenAndServe(":6969", nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// copy pasted from https://stackoverflow.com/questions/33880343/go-webserver-dont-cache-files-using-timestamp
+
+var noCacheHeaders = map[string]string{
+	"Expires":         time.Unix(0, 0).Format(time.RFC1123),
+	"Cache-Control":   "no-cache, private, max-age=0",
+	"Pragma":          "no-cache",
+	"X-Accel-Expires": "0",
+}
+
+var etagHeaders = []string{
+	"ETag",
+	"If-Modified-Since",
+	"If-Match",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+}
+
+func LogReqest(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		util.Logger.Printf("request : %v - %v", r.URL.String(), r.Method)
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func NoCache(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// Delete any ETag headers that may have been set
+		for _, v := range etagHeaders {
+			if r.Header.Get(v) != "" {
+				r.Header.Del(v)
+			}
+		}
+
+		// Set our NoCache headers
+		for k, v := range noCacheHeaders {
+			w.Header().Set(k, v)
+		}
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+type AdminAPIHandler struct{}
+
+var (
+	PostsPath    = "posts"
+	PostsOutPath = "docs/posts"
+
+	// if set, post list, posts and shared assets are served from here
+	// instead of docs
+	TestDocsPath = ""
+)
+
+// hash cache lives in memory between requests,
+// so get-posts doesn't write anything and update-posts saves it
+var (
+	hashCacheMu   sync.Mutex
+	hashCache     *postlist.HashCache
+	hashCachePath string
+)
+
+func getHashCache() *postlist.HashCache {
+	hashCacheMu.Lock()
+	defer hashCacheMu.Unlock()
+
+	if hashCache == nil || hashCachePath != postlist.HashCachePath {
+		hashCache = postlist.LoadHashCache(postlist.HashCachePath)
+		hashCachePath = postlist.HashCachePath
+	}
+
+	return hashCache
+}
+
+func (aa *AdminAPIHandler) ServeHTTP(
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	for k, v := range noCacheHeaders {
+		res.Header().Set(k, v)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	getErrResponse := func(err error) []byte {
+		var resStruct struct {
+			Result string
+			Error  string
+
+			Diagnostics []compiler.Diagnostic
+		}
+
+		resStruct.Result = "fail"
+		resStruct.Error = err.Error()
+		resStruct.Diagnostics = compiler.CollectDiagnostics(err)
+
+		resBytes, marshalErr := json.Marshal(resStruct)
+		if marshalErr != nil {
+			util.ErrLogger.Fatal(marshalErr)
+		}
+
+		return resBytes
+	}
+
+	getResponse := func() ([]byte, int) {
+		if req.URL.Path == "/api/get-posts" {
+			if req.Method != "GET" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be GET", req.Method),
+				), 400
+			}
+
+			oldPosts, err := postlist.LoadPostList(postlist.PostListPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			cache := getHashCache()
+
+			newPosts, scan, err := postlist.GenerateUpdatedPostList(PostsPath, oldPosts, cache)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			util.Logger.Print(scan.String())
+
+			// scan kept what files old posts had in cache
+			diff := postlist.DiffPostLists(oldPosts, newPosts, cache)
+
+			util.Logger.Print(diff.String())
+
+			var resStruct struct {
+				Result string
+
+				Old model.PostList
+				New model.PostList
+
+				Diff postlist.PostListDiff
+				Scan postlist.ScanReport
+			}
+
+			resStruct.Result = "success"
+			resStruct.Old = oldPosts
+			resStruct.New = newPosts
+			resStruct.Diff = diff
+			resStruct.Scan = scan
+
+			resBytes, err := json.MarshalIndent(resStruct, "", "  ")
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/adopt-posts" {
+			if req.Method != "POST" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be POST", req.Method),
+				), 400
+			}
+
+			body, err := io.ReadAll(req.Body)
+			defer req.Body.Close()
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			// no dirs adopts every unadopted post
+			var reqStruct struct {
+				Dirs []string
+			}
+
+			if len(body) > 0 {
+				err = json.Unmarshal(body, &reqStruct)
+				if err != nil {
+					return getErrResponse(err), 400
+				}
+			}
+
+			adopted, err := postlist.AdoptPosts(PostsPath, reqStruct.Dirs)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			for _, post := range adopted {
+				util.Logger.Printf("adopted %s as %s", post.Dir, post.UUID)
+			}
+
+			var resStruct struct {
+				Result string
+
+				Adopted []postlist.AdoptedPost
+			}
+
+			resStruct.Result = "success"
+			resStruct.Adopted = adopted
+
+			resBytes, err := json.Marshal(resStruct)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/rekey-duplicates" {
+			if req.Method != "POST" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be POST", req.Method),
+				), 400
+			}
+
+			body, err := io.ReadAll(req.Body)
+			defer req.Body.Close()
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			// no dirs re-keys every copy
+			var reqStruct struct {
+				Dirs []string
+			}
+
+			if len(body) > 0 {
+				err = json.Unmarshal(body, &reqStruct)
+				if err != nil {
+					return getErrResponse(err), 400
+				}
+			}
+
+			// post list decides which directory is the original
+			oldPosts, err := postlist.LoadPostList(postlist.PostListPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			rekeyed, err := postlist.RekeyDuplicates(PostsPath, oldPosts, reqStruct.Dirs)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			for _, post := range rekeyed {
+				util.Logger.Printf("re-keyed %s from %s to %s", post.Dir, post.OldUUID, post.UUID)
+			}
+
+			var resStruct struct {
+				Result string
+
+				Rekeyed []postlist.RekeyedPost
+			}
+
+			resStruct.Result = "success"
+			resStruct.Rekeyed = rekeyed
+
+			resBytes, err := json.Marshal(resStruct)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/update-posts" {
+			if req.Method != "PUT" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be PUT", req.Method),
+				), 400
+			}
+
+			body, err := io.ReadAll(req.Body)
+			defer req.Body.Close()
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			var updatedPostList model.PostList
+
+			err = json.Unmarshal(body, &updatedPostList)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			for i, post := range updatedPostList.Posts {
+				post.Dir = filepath.Base(post.Dir)
+				updatedPostList.Posts[i] = post
+			}
+
+			updatedPostList, report, err := compiler.CompileBlog(PostsPath, updatedPostList, PostsOutPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			report.Log(util.Logger)
+
+			var resStruct struct {
+				Result string
+
+				PostList model.PostList
+				Report   compiler.BuildReport
+			}
+
+			resStruct.Result = "success"
+			if report.Partial() {
+				resStruct.Result = "partial"
+			}
+			resStruct.PostList = updatedPostList
+			resStruct.Report = report
+
+			resBytes, err := json.Marshal(resStruct)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			err = postlist.SavePostList(updatedPostList, postlist.PostListPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			if err := getHashCache().Save(postlist.HashCachePath); err != nil {
+				util.WarnLogger.Printf("failed to save hash cache %s: %v", postlist.HashCachePath, err)
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/size-report" {
+			if req.Method != "GET" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be GET", req.Method),
+				), 400
+			}
+
+			sizeReport, err := compiler.CurrentSizeReport(PostsOutPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			var resStruct struct {
+				Result string
+
+				SizeReport compiler.SizeReport
+			}
+
+			resStruct.Result = "success"
+			resStruct.SizeReport = sizeReport
+
+			resBytes, err := json.MarshalIndent(resStruct, "", "  ")
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/builds" {
+			if req.Method != "GET" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be GET", req.Method),
+				), 400
+			}
+
+			builds, err := compiler.ListBuilds()
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			var resStruct struct {
+				Result string
+
+				Builds []compiler.BuildInfo
+			}
+
+			resStruct.Result = "success"
+			resStruct.Builds = builds
+
+			resBytes, err := json.MarshalIndent(resStruct, "", "  ")
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else if req.URL.Path == "/api/rollback" {
+			if req.Method != "POST" {
+				return getErrResponse(
+					fmt.Errorf("wrong method %s, should be POST", req.Method),
+				), 400
+			}
+
+			body, err := io.ReadAll(req.Body)
+			defer req.Body.Close()
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			var reqStruct struct {
+				ID string
+			}
+
+			err = json.Unmarshal(body, &reqStruct)
+			if err != nil {
+				return getErrResponse(err), 400
+			}
+
+			build, postList, err := compiler.RollbackBuild(reqStruct.ID, PostsOutPath)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			util.Logger.Printf("rolled back to build %s", build.ID)
+
+			var resStruct struct {
+				Result string
+
+				Build    compiler.BuildInfo
+				PostList model.PostList
+			}
+
+			resStruct.Result = "success"
+			resStruct.Build = build
+			resStruct.PostList = postList
+
+			resBytes, err := json.Marshal(resStruct)
+			if err != nil {
+				return getErrResponse(err), 500
+			}
+
+			return resBytes, 200
+		} else {
+			return getErrResponse(fmt.Errorf("unknown api %v", req.URL)), 400
+		}
+	}
+
+	toWrite, code := getResponse()
+
+	res.Header().Set("Content-Length", fmt.Sprintf("%d", len(toWrite)))
+
+	res.WriteHeader(code)
+
+	written := 0
+
+	for written < len(toWrite) {
+		w, err := res.Write(toWrite[written:])
+		if err != nil {
+			util.ErrLogger.Printf("failed to write to client")
+			break
+		}
+		written += w
+	}
+}
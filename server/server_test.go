@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blog/compiler"
+	"blog/model"
+	"blog/postlist"
+)
+
+func setupServer(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	saved := []*string{
+		&PostsPath, &PostsOutPath,
+		&postlist.PostListPath, &postlist.HashCachePath,
+		&compiler.ImageCachePath, &compiler.OptimizedImageCachePath, &compiler.SourceStampsPath,
+		&compiler.SharedAssetsPath, &compiler.BuildsPath, &compiler.SizeBudgetPath,
+	}
+	values := make([]string, len(saved))
+	for i, p := range saved {
+		values[i] = *p
+	}
+	t.Cleanup(func() {
+		for i, p := range saved {
+			*p = values[i]
+		}
+	})
+
+	PostsPath = filepath.Join(dir, "posts")
+	PostsOutPath = filepath.Join(dir, "docs", "posts")
+	postlist.PostListPath = filepath.Join(dir, "docs", "public", "post-list.json")
+	postlist.HashCachePath = filepath.Join(dir, "cache", "hashes.json")
+	compiler.ImageCachePath = ""
+	compiler.OptimizedImageCachePath = ""
+	compiler.SourceStampsPath = ""
+	compiler.SharedAssetsPath = filepath.Join(dir, "docs", "public", "assets")
+	compiler.BuildsPath = filepath.Join(dir, "builds")
+	compiler.SizeBudgetPath = ""
+
+	postDir := filepath.Join(PostsPath, "hello")
+	if err := os.MkdirAll(postDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(postDir, "index.md"), []byte("# hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serveAPI(t *testing.T, method string, path string, body string) (int, map[string]json.RawMessage) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	(&AdminAPIHandler{}).ServeHTTP(rec, req)
+
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: response is not json: %v\n%s", method, path, err, rec.Body.String())
+	}
+
+	if got := rec.Header().Get("Cache-Control"); got != noCacheHeaders["Cache-Control"] {
+		t.Errorf("%s %s: Cache-Control is %q", method, path, got)
+	}
+
+	return rec.Code, res
+}
+
+func TestGetAndUpdatePosts(t *testing.T) {
+	setupServer(t)
+
+	// looking doesn't adopt anything
+	code, res := serveAPI(t, "GET", "/api/get-posts", "")
+	if code != 200 {
+		t.Fatalf("get-posts: %d %s", code, res["Error"])
+	}
+
+	var scan postlist.ScanReport
+	if err := json.Unmarshal(res["Scan"], &scan); err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.Unadopted) != 1 || scan.Unadopted[0].Dir != "hello" {
+		t.Fatalf("unadopted posts are %+v", scan.Unadopted)
+	}
+	if _, err := os.Stat(filepath.Join(PostsPath, "hello", postlist.PostUUIDFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get-posts wrote %s", postlist.PostUUIDFileName)
+	}
+
+	code, res = serveAPI(t, "POST", "/api/adopt-posts", `{"Dirs": ["hello"]}`)
+	if code != 200 {
+		t.Fatalf("adopt-posts: %d %s", code, res["Error"])
+	}
+
+	code, res = serveAPI(t, "GET", "/api/get-posts", "")
+	if code != 200 {
+		t.Fatalf("get-posts: %d %s", code, res["Error"])
+	}
+
+	var newPosts model.PostList
+	if err := json.Unmarshal(res["New"], &newPosts); err != nil {
+		t.Fatal(err)
+	}
+
+	var diff postlist.PostListDiff
+	if err := json.Unmarshal(res["Diff"], &diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Dir != "hello" {
+		t.Errorf("diff added %+v", diff.Added)
+	}
+
+	// hash cache is only saved once posts are updated
+	if _, err := os.Stat(postlist.HashCachePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get-posts wrote hash cache: %v", err)
+	}
+	if len(newPosts.Posts) != 1 || newPosts.Posts[0].Dir != "hello" {
+		t.Fatalf("get-posts found %+v", newPosts.Posts)
+	}
+
+	newPosts.Posts[0].Name = "Hello"
+	body, err := json.Marshal(newPosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, res = serveAPI(t, "PUT", "/api/update-posts", string(body))
+	if code != 200 {
+		t.Fatalf("update-posts: %d %s", code, res["Error"])
+	}
+	if string(res["Result"]) != `"success"` {
+		t.Errorf("update-posts result is %s", res["Result"])
+	}
+
+	saved, err := postlist.LoadPostList(postlist.PostListPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Posts) != 1 || saved.Posts[0].Name != "Hello" {
+		t.Errorf("saved post list is %+v", saved.Posts)
+	}
+
+	if _, err := os.Stat(filepath.Join(PostsOutPath, "hello", "index.html")); err != nil {
+		t.Errorf("post didn't get compiled: %v", err)
+	}
+	if _, err := os.Stat(postlist.HashCachePath); err != nil {
+		t.Errorf("update-posts didn't save hash cache: %v", err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	setupServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"POST", "/api/get-posts", http.StatusBadRequest},
+		{"GET", "/api/update-posts", http.StatusBadRequest},
+		{"GET", "/api/no-such-thing", http.StatusBadRequest},
+		{"POST", "/api/rollback", http.StatusBadRequest},
+		{"GET", "/api/adopt-posts", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		code, res := serveAPI(t, test.method, test.path, "")
+		if code != test.code {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, code, test.code)
+		}
+		if string(res["Result"]) != `"fail"` {
+			t.Errorf("%s %s: result is %s", test.method, test.path, res["Result"])
+		}
+	}
+}
+
+func TestUpdatePostsDiagnostics(t *testing.T) {
+	setupServer(t)
+
+	postFile := filepath.Join(PostsPath, "hello", "index.md")
+	if err := os.WriteFile(postFile, []byte("# hello\n\n> <gallery>\n\nrest of post\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, res := serveAPI(t, "POST", "/api/adopt-posts", ""); code != 200 {
+		t.Fatalf("adopt-posts: %d %s", code, res["Error"])
+	}
+
+	code, res := serveAPI(t, "GET", "/api/get-posts", "")
+	if code != 200 {
+		t.Fatalf("get-posts: %d %s", code, res["Error"])
+	}
+
+	code, res = serveAPI(t, "PUT", "/api/update-posts", string(res["New"]))
+	if code != 500 || string(res["Result"]) != `"fail"` {
+		t.Fatalf("update-posts: %d %s", code, res["Result"])
+	}
+
+	var diagnostics []compiler.Diagnostic
+	if err := json.Unmarshal(res["Diagnostics"], &diagnostics); err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 1 {
+		t.Fatalf("got %d diagnostics, want 1: %+v", len(diagnostics), diagnostics)
+	}
+
+	diagnostic := diagnostics[0]
+	if diagnostic.Dir != "hello" || diagnostic.File != "index.md" || diagnostic.Line != 3 {
+		t.Errorf("diagnostic points to %s", diagnostic)
+	}
+	if !strings.Contains(diagnostic.Message, "unterminated <gallery>") {
+		t.Errorf("diagnostic says %q", diagnostic.Message)
+	}
+}
+
+func TestUpdatePostsPartial(t *testing.T) {
+	setupServer(t)
+
+	savedKeep := compiler.KeepFailedPosts
+	t.Cleanup(func() { compiler.KeepFailedPosts = savedKeep })
+	compiler.KeepFailedPosts = true
+
+	if code, res := serveAPI(t, "POST", "/api/adopt-posts", ""); code != 200 {
+		t.Fatalf("adopt-posts: %d %s", code, res["Error"])
+	}
+
+	code, res := serveAPI(t, "GET", "/api/get-posts", "")
+	if code != 200 {
+		t.Fatalf("get-posts: %d %s", code, res["Error"])
+	}
+
+	code, res = serveAPI(t, "PUT", "/api/update-posts", string(res["New"]))
+	if code != 200 || string(res["Result"]) != `"success"` {
+		t.Fatalf("update-posts: %d %s %s", code, res["Result"], res["Error"])
+	}
+
+	postFile := filepath.Join(PostsPath, "hello", "index.md")
+	if err := os.WriteFile(postFile, []byte("# hello\n\n![gone](gone.png)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, res = serveAPI(t, "GET", "/api/get-posts", "")
+	if code != 200 {
+		t.Fatalf("get-posts: %d %s", code, res["Error"])
+	}
+
+	code, res = serveAPI(t, "PUT", "/api/update-posts", string(res["New"]))
+	if code != 200 || string(res["Result"]) != `"partial"` {
+		t.Fatalf("update-posts: %d %s %s", code, res["Result"], res["Error"])
+	}
+
+	var report compiler.BuildReport
+	if err := json.Unmarshal(res["Report"], &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Dir != "hello" || !report.Failed[0].KeptPrevious {
+		t.Errorf("failed posts are %+v", report.Failed)
+	}
+
+	if _, err := os.Stat(filepath.Join(PostsOutPath, "hello", "index.html")); err != nil {
+		t.Errorf("previous output of hello is gone: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// number of bytes, in json it can be a number
+// or a string like "512KiB", "5MB" or "1.5 GiB"
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	Suffix string
+	Size   int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+func ParseByteSize(input string) (ByteSize, error) {
+	str := strings.TrimSpace(input)
+
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if rest, ok := strings.CutSuffix(str, u.Suffix); ok {
+			str = strings.TrimSpace(rest)
+			unit = u.Size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+
+	return ByteSize(value * float64(unit)), nil
+}
+
+func (bs *ByteSize) UnmarshalJSON(jsonValue []byte) error {
+	var number int64
+	if err := json.Unmarshal(jsonValue, &number); err == nil {
+		*bs = ByteSize(number)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(jsonValue, &str); err != nil {
+		return fmt.Errorf("size should be a number or a string, got %s", string(jsonValue))
+	}
+
+	size, err := ParseByteSize(str)
+	if err != nil {
+		return err
+	}
+	*bs = size
+
+	return nil
+}
+
+func FormatByteSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package util
+
+import "io/fs"
+
+// we don't know, size and mtime will have to do
+func FileInode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,12 @@
+package util
+
+import (
+	"log"
+	"os"
+)
+
+var (
+	ErrLogger  = log.New(os.Stderr, "[ FAIL! ] : ", log.Lshortfile)
+	WarnLogger = log.New(os.Stderr, "[ WARN! ] : ", log.Lshortfile)
+	Logger     = log.New(os.Stdout, "", 0)
+)
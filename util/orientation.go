@@ -0,0 +1,196 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// EXIF orientation says how stored pixels have to be turned to be upright
+//
+//	1 upright, 2 mirrored, 3 upside down, 4 upside down and mirrored,
+//	5 to 8 are the same with image lying on its side
+const ExifOrientationTag = 0x0112
+
+var (
+	jpegExifPrefix = []byte("Exif\x00\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// returns orientation in tiff structure of EXIF
+// returns 0 if there is none
+func ExifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == ExifOrientationTag {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 0
+}
+
+// returns EXIF orientation of jpeg or png in data,
+// 1 if it has none or data is something else
+func ImageOrientation(data []byte) int {
+	var orientation int
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		orientation = jpegOrientation(data)
+	case bytes.HasPrefix(data, pngSignature):
+		orientation = pngOrientation(data)
+	}
+
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+func jpegOrientation(data []byte) int {
+	pos := 2
+
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return 0
+		}
+		marker := data[pos+1]
+
+		// padding
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// markers without length
+		if marker == 0x01 || (0xd0 <= marker && marker <= 0xd7) {
+			pos += 2
+			continue
+		}
+		// EXIF comes before image data
+		if marker == 0xda || marker == 0xd9 {
+			return 0
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 0
+		}
+		segment := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		if marker == 0xe1 && bytes.HasPrefix(segment, jpegExifPrefix) {
+			return ExifOrientation(segment[len(jpegExifPrefix):])
+		}
+	}
+
+	return 0
+}
+
+func pngOrientation(data []byte) int {
+	pos := len(pngSignature)
+
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+
+		end := pos + 8 + length + 4 // length, type, data, crc
+		if length < 0 || end > len(data) || end < pos {
+			return 0
+		}
+
+		if chunkType == "eXIf" {
+			return ExifOrientation(data[pos+8 : pos+8+length])
+		}
+		if chunkType == "IEND" {
+			return 0
+		}
+
+		pos = end
+	}
+
+	return 0
+}
+
+// true if orientation turns image on its side,
+// so width and height trade places
+func OrientationSwapsSize(orientation int) bool {
+	return 5 <= orientation && orientation <= 8
+}
+
+// returns img turned upright according to EXIF orientation
+func OrientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// draw has fast paths for what decoders give us
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dstWidth, dstHeight := width, height
+	if OrientationSwapsSize(orientation) {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := range dstHeight {
+		for x := range dstWidth {
+			var srcX, srcY int
+
+			switch orientation {
+			case 2:
+				srcX, srcY = width-1-x, y
+			case 3:
+				srcX, srcY = width-1-x, height-1-y
+			case 4:
+				srcX, srcY = x, height-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height-1-x
+			case 7:
+				srcX, srcY = width-1-y, height-1-x
+			case 8:
+				srcX, srcY = width-1-y, x
+			}
+
+			srcOff := src.PixOffset(srcX, srcY)
+			dstOff := dst.PixOffset(x, y)
+			copy(dst.Pix[dstOff:dstOff+4], src.Pix[srcOff:srcOff+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// clones src to dst sharing the data until one of them changes
+func reflinkFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	cloneErr := unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd()))
+	closeErr := dstFile.Close()
+
+	if cloneErr != nil {
+		os.Remove(dst)
+		return cloneErr
+	}
+	if closeErr != nil {
+		os.Remove(dst)
+		return closeErr
+	}
+
+	return os.Chtimes(dst, time.Time{}, info.ModTime())
+}
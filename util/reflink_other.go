@@ -0,0 +1,9 @@
+//go:build !linux
+
+package util
+
+import "errors"
+
+func reflinkFile(src, dst string) error {
+	return errors.ErrUnsupported
+}
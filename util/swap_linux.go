@@ -0,0 +1,20 @@
+package util
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// swaps two paths in one step with renameat2
+// errors.ErrUnsupported if kernel or file system can't do it
+func ExchangePaths(a, b string) error {
+	// paths are relative to working directory
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+		return errors.ErrUnsupported
+	}
+
+	return err
+}
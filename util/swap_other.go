@@ -0,0 +1,9 @@
+//go:build !linux
+
+package util
+
+import "errors"
+
+func ExchangePaths(a, b string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,217 @@
+// file helpers and loggers everything else uses
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func FileExists(name string, isDir bool) (bool, error) {
+	info, err := os.Stat(name)
+
+	if err == nil { // file exists
+		mode := info.Mode()
+		if isDir && !mode.IsDir() {
+			return false, nil
+		}
+
+		if !isDir && !mode.IsRegular() {
+			return false, nil
+		}
+
+		return true, nil
+	} else if errors.Is(err, os.ErrNotExist) { // file does not exists
+		return false, nil
+	} else { // unable to check if file exists or not
+		return false, err
+	}
+}
+
+// delete a file
+// unlike os.Remove,
+// it's not an error if file didn't exist in a first place
+func DeleteFile(name string) error {
+	name = filepath.Clean(name)
+
+	exists, err := FileExists(name, false)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	err = os.Remove(name)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// copies src to dst without reading it all in memory
+// dst gets the same permission and modification time as src
+//
+// dst is replaced rather than written over,
+// so files hard linked to it stay the same
+func CopyFile(src, dst string) error {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("file is not a regular file")
+	}
+
+	if err := DeleteFile(dst); err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	// on linux this lets kernel do the copying
+	_, err = io.Copy(dstFile, srcFile)
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		DeleteFile(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, time.Time{}, info.ModTime())
+}
+
+// how CopyFileReusing brings over files from previous build
+type LinkMode int
+
+const (
+	// always copy
+	LinkModeNone LinkMode = iota
+	// hard link, output files should never be written in place
+	LinkModeHard
+	// copy on write clone, falls back to copying
+	// if file system doesn't support it
+	LinkModeReflink
+	LinkModeCount
+)
+
+var LinkModeStrs = [LinkModeCount]string{
+	"none",
+	"hard",
+	"reflink",
+}
+
+func (lm LinkMode) String() string {
+	if 0 <= lm && lm < LinkModeCount {
+		return LinkModeStrs[lm]
+	}
+
+	return fmt.Sprintf("unknown LinkMode(%d)", lm)
+}
+
+func ParseLinkMode(str string) (LinkMode, error) {
+	for i, modeStr := range LinkModeStrs {
+		if modeStr == str {
+			return LinkMode(i), nil
+		}
+	}
+
+	return LinkModeNone, fmt.Errorf("unknown link mode %q", str)
+}
+
+// copies src to dst, but if previous was copied from src
+// when src looked like stamp it's linked to dst instead
+//
+// previous can be empty, stamp can be zero
+// returns true if dst was linked and what src looks like now
+func CopyFileReusing(src, dst, previous string, stamp SourceStamp, mode LinkMode) (bool, SourceStamp, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, SourceStamp{}, err
+	}
+	srcStamp := StampOf(srcInfo)
+
+	if previous == "" || mode == LinkModeNone || stamp != srcStamp {
+		return false, srcStamp, CopyFile(src, dst)
+	}
+
+	previousInfo, err := os.Lstat(previous)
+	if err != nil || !previousInfo.Mode().IsRegular() || previousInfo.Size() != srcInfo.Size() {
+		return false, srcStamp, CopyFile(src, dst)
+	}
+
+	if err := DeleteFile(dst); err != nil {
+		return false, srcStamp, err
+	}
+
+	switch mode {
+	case LinkModeHard:
+		err = os.Link(previous, dst)
+	case LinkModeReflink:
+		err = reflinkFile(previous, dst)
+	}
+
+	if err != nil {
+		// different file system or no support for it
+		return false, srcStamp, CopyFile(src, dst)
+	}
+
+	return true, srcStamp, nil
+}
+
+// what a source file looked like when it was copied to output
+//
+// output files all have the same modification time,
+// so this is how we tell if a file from previous build can be reused
+type SourceStamp struct {
+	Size    int64
+	ModTime int64
+	Inode   uint64
+}
+
+func StampOf(info fs.FileInfo) SourceStamp {
+	return SourceStamp{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   FileInode(info),
+	}
+}
+
+// writes data to a new file and renames it to name
+// so that files hard linked to name stay the same
+func ReplaceFile(name string, data []byte, perm os.FileMode) error {
+	tmpName := name + ".tmp"
+
+	if err := os.WriteFile(tmpName, data, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpName, name); err != nil {
+		DeleteFile(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+func ExtLowered(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
@@ -0,0 +1,265 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		size  ByteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"512KiB", 512 << 10},
+		{"5MB", 5 * 1000 * 1000},
+		{"1.5 GiB", 3 << 29},
+		{" 2 KB ", 2000},
+	}
+
+	for _, test := range tests {
+		size, err := ParseByteSize(test.input)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): %v", test.input, err)
+			continue
+		}
+		if size != test.size {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", test.input, size, test.size)
+		}
+	}
+
+	for _, input := range []string{"", "lots", "-1KiB", "5 XB"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) should fail", input)
+		}
+	}
+}
+
+func TestByteSizeJSON(t *testing.T) {
+	var sizes []ByteSize
+	if err := json.Unmarshal([]byte(`[1024, "1KiB"]`), &sizes); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[0] != 1024 || sizes[1] != 1024 {
+		t.Errorf("got %v", sizes)
+	}
+
+	if err := json.Unmarshal([]byte(`[true]`), &sizes); err == nil {
+		t.Errorf("bool size should fail")
+	}
+}
+
+func TestCopyFileReusing(t *testing.T) {
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src.txt")
+	previous := filepath.Join(dir, "previous.txt")
+	dst := filepath.Join(dir, "dst.txt")
+
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// first copy, nothing to reuse
+	linked, stamp, err := CopyFileReusing(src, previous, "", SourceStamp{}, LinkModeHard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked {
+		t.Errorf("linked without previous file")
+	}
+
+	// source didn't change, previous copy gets linked
+	linked, _, err = CopyFileReusing(src, dst, previous, stamp, LinkModeHard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !linked {
+		t.Errorf("unchanged file wasn't linked")
+	}
+
+	content, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("dst has %q", content)
+	}
+
+	// with a stamp that doesn't match it's copied
+	linked, _, err = CopyFileReusing(src, dst, previous, SourceStamp{Size: 1}, LinkModeHard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked {
+		t.Errorf("linked even though stamp didn't match")
+	}
+}
+
+func TestParseLinkMode(t *testing.T) {
+	for mode := LinkModeNone; mode < LinkModeCount; mode++ {
+		parsed, err := ParseLinkMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("ParseLinkMode(%q) = %v, %v", mode.String(), parsed, err)
+		}
+	}
+
+	if _, err := ParseLinkMode("symbolic"); err == nil {
+		t.Errorf("unknown mode should fail")
+	}
+}
+
+// tiff structure of EXIF with only orientation in it
+func orientationExif(orientation int) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, ExifOrientationTag)
+	tiff = append(tiff, 0, 3, 0, 0, 0, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	return append(tiff, 0, 0, 0, 0, 0, 0)
+}
+
+func TestImageOrientation(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+
+	var jpegBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	plainJpeg := jpegBuf.Bytes()
+
+	exif := append([]byte("Exif\x00\x00"), orientationExif(6)...)
+	rotatedJpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	rotatedJpeg = binary.BigEndian.AppendUint16(rotatedJpeg, uint16(len(exif)+2))
+	rotatedJpeg = append(rotatedJpeg, exif...)
+	rotatedJpeg = append(rotatedJpeg, plainJpeg[2:]...)
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatal(err)
+	}
+	plainPng := pngBuf.Bytes()
+
+	// eXIf goes right after IHDR
+	ihdrEnd := 8 + 8 + 13 + 4
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(orientationExif(3))))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, orientationExif(3)...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	rotatedPng := append(append(slices.Clone(plainPng[:ihdrEnd]), chunk...), plainPng[ihdrEnd:]...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		orientation int
+	}{
+		{"plain jpeg", plainJpeg, 1},
+		{"rotated jpeg", rotatedJpeg, 6},
+		{"plain png", plainPng, 1},
+		{"rotated png", rotatedPng, 3},
+		{"not an image", []byte("hello"), 1},
+		{"truncated jpeg", rotatedJpeg[:10], 1},
+	}
+
+	for _, test := range tests {
+		if got := ImageOrientation(test.data); got != test.orientation {
+			t.Errorf("%s: orientation %d, want %d", test.name, got, test.orientation)
+		}
+	}
+
+	// rotated files still decode
+	if _, err := jpeg.Decode(bytes.NewReader(rotatedJpeg)); err != nil {
+		t.Errorf("rotated jpeg: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(rotatedPng)); err != nil {
+		t.Errorf("rotated png: %v", err)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// 3x2 with marked top left pixel
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	marked := color.NRGBA{R: 255, A: 255}
+	src.SetNRGBA(0, 0, marked)
+
+	tests := []struct {
+		orientation int
+		// where top left pixel ends up
+		x, y int
+	}{
+		{1, 0, 0},
+		{2, 2, 0},
+		{3, 2, 1},
+		{4, 0, 1},
+		{5, 0, 0},
+		{6, 1, 0},
+		{7, 1, 2},
+		{8, 0, 2},
+	}
+
+	for _, test := range tests {
+		dst := OrientImage(src, test.orientation)
+
+		width, height := 3, 2
+		if OrientationSwapsSize(test.orientation) {
+			width, height = 2, 3
+		}
+		if dst.Bounds().Dx() != width || dst.Bounds().Dy() != height {
+			t.Errorf("orientation %d: size %v", test.orientation, dst.Bounds())
+			continue
+		}
+
+		if got := color.NRGBAModel.Convert(dst.At(test.x, test.y)); got != marked {
+			t.Errorf("orientation %d: top left didn't end up at %d,%d", test.orientation, test.x, test.y)
+		}
+	}
+}
+
+func TestExchangePaths(t *testing.T) {
+	dir := t.TempDir()
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	for _, p := range []string{a, b} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(p, "name.txt"), []byte(filepath.Base(p)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ExchangePaths(a, b)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("can't exchange paths here")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{a: "b", b: "a"} {
+		got, err := os.ReadFile(filepath.Join(p, "name.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s has %s, want %s", p, got, want)
+		}
+	}
+
+	if err := ExchangePaths(a, filepath.Join(dir, "missing")); err == nil {
+		t.Error("exchanged with missing path")
+	}
+}